@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	be "github.com/TeaPartyCrypto/partybridge/pkg"
+)
+
+// adminClient calls the admin API.
+type adminClient struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+func newAdminClient(baseURL, token string) *adminClient {
+	if baseURL == "" {
+		baseURL = "http://localhost:9090"
+	}
+	return &adminClient{
+		url:   strings.TrimSuffix(baseURL, "/") + "/admin/v1",
+		token: token,
+		http:  &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// do calls the admin API and decodes the reply into out. Errors of the API are returned with
+// their code.
+func (a *adminClient) do(method, path string, query url.Values, body, out interface{}) error {
+	if a.token == "" {
+		return fmt.Errorf("PARTYBRIDGE_ADMIN_TOKEN is not set")
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	u := a.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var apiErr be.ErrorMsg
+		if err := json.NewDecoder(res.Body).Decode(&apiErr); err != nil || apiErr.Code == "" {
+			return fmt.Errorf("%s %s: %s", method, path, res.Status)
+		}
+		return fmt.Errorf("%s: %s", apiErr.Code, apiErr.Message)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// action posts an admin action and prints its result.
+func (c *cli) action(path string, body interface{}, dryRun bool) error {
+	query := url.Values{}
+	if dryRun {
+		query.Set("dryRun", "true")
+	}
+	var result be.AdminActionResult
+	if err := c.admin.do(http.MethodPost, path, query, body, &result); err != nil {
+		return err
+	}
+	return c.print(result, func(w *tabwriter.Writer) {
+		if result.DryRun {
+			fmt.Fprint(w, "dry run: ")
+		}
+		fmt.Fprintln(w, result.Message)
+		if result.Pause != nil {
+			fmt.Fprintf(w, "paused by %s at %s\n", result.Pause.PausedBy, result.Pause.PausedTime.Format(time.RFC3339))
+		}
+		if result.Bridge != nil {
+			fmt.Fprintln(w)
+			bridgeTable(w, []be.AdminBridgeView{*result.Bridge})
+		}
+	})
+}
+
+// actionFlags are the flags every admin action takes.
+type actionFlags struct {
+	fs     *flag.FlagSet
+	note   *string
+	dryRun *bool
+}
+
+func newActionFlags(name string) actionFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return actionFlags{
+		fs:     fs,
+		note:   fs.String("note", "", "a note for the audit log"),
+		dryRun: fs.Bool("dry-run", false, "check the action and print what it would do without doing it"),
+	}
+}
+
+// parse parses args and returns the one argument the action is taken on.
+func (f actionFlags) parse(args []string) (string, error) {
+	f.fs.Parse(args)
+	if f.fs.NArg() != 1 {
+		return "", errUsage
+	}
+	return f.fs.Arg(0), nil
+}
+
+func (c *cli) bridges(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("bridges list", flag.ExitOnError)
+		list := fs.String("list", "failed", "active, held, unconfirmed, burns, failed, expired or stuck")
+		fs.Parse(args[1:])
+		var bridges []be.AdminBridgeView
+		if err := c.admin.do(http.MethodGet, "/bridges", url.Values{"list": {*list}}, nil, &bridges); err != nil {
+			return err
+		}
+		return c.print(bridges, func(w *tabwriter.Writer) { bridgeTable(w, bridges) })
+
+	case "get":
+		if len(args) != 2 {
+			return errUsage
+		}
+		var bridge be.AdminBridgeView
+		if err := c.admin.do(http.MethodGet, "/bridges/"+url.PathEscape(args[1]), nil, nil, &bridge); err != nil {
+			return err
+		}
+		return c.print(bridge, func(w *tabwriter.Writer) { bridgeDetails(w, bridge) })
+
+	case "retry":
+		f := newActionFlags("bridges retry")
+		force := f.fs.Bool("force", false, "retry even if the escrow does not hold the deposit")
+		id, err := f.parse(args[1:])
+		if err != nil {
+			return err
+		}
+		return c.action("/bridges/"+url.PathEscape(id)+"/retry", map[string]interface{}{"note": *f.note, "force": *force}, *f.dryRun)
+
+	case "refund":
+		f := newActionFlags("bridges refund")
+		refundAddress := f.fs.String("refund-address", "", "refund to this address instead of the refund address of the bridge")
+		force := f.fs.Bool("force", false, "refund an unconfirmed bridge, once its settlement was checked")
+		id, err := f.parse(args[1:])
+		if err != nil {
+			return err
+		}
+		return c.action("/bridges/"+url.PathEscape(id)+"/refund", map[string]interface{}{"note": *f.note, "refundAddress": *refundAddress, "force": *force}, *f.dryRun)
+
+	case "resolve", "unlock":
+		f := newActionFlags("bridges " + args[0])
+		id, err := f.parse(args[1:])
+		if err != nil {
+			return err
+		}
+		return c.action("/bridges/"+url.PathEscape(id)+"/"+args[0], map[string]interface{}{"note": *f.note}, *f.dryRun)
+	}
+	return errUsage
+}
+
+func bridgeTable(w *tabwriter.Writer, bridges []be.AdminBridgeView) {
+	row(w, "ID", "LIST", "STATE", "ROUTE", "AMOUNT", "RECEIVED", "CREATED", "LOCKED BY", "FAILURE")
+	for _, b := range bridges {
+		row(w, b.TransactionID, b.List, b.State, b.Route.Key(), b.Amount, b.ReceivedAmount, b.CreatedTime, b.LockedBy, b.FailureReason)
+	}
+}
+
+func bridgeDetails(w *tabwriter.Writer, b be.AdminBridgeView) {
+	for _, field := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"ID", b.TransactionID},
+		{"List", b.List},
+		{"State", b.State},
+		{"Route", b.Route.Key()},
+		{"Escrow", b.Address},
+		{"Amount", b.Amount},
+		{"Received", b.ReceivedAmount},
+		{"Payment", b.PaymentStatus},
+		{"Shipping address", b.ShippingAddress},
+		{"Refund address", b.RefundAddress},
+		{"Deadline", time.Unix(b.Deadline, 0)},
+		{"Created", b.CreatedTime},
+		{"Deposited", b.DepositedTime},
+		{"Deposit tx", b.DepositTxHash},
+		{"Settled", b.SettledTime},
+		{"Settlement tx", b.SettlementTxHash},
+		{"Refunded", b.RefundedTime},
+		{"Refund tx", b.RefundTxHash},
+		{"Refund amount", b.RefundAmount},
+		{"Failure", b.FailureReason},
+		{"Session", b.SessionID},
+		{"Client", b.ClientID},
+		{"Locked", b.Locked},
+		{"Locked by", b.LockedBy},
+		{"Locked since", b.LockedTime},
+		{"Grace until", b.GraceUntil},
+		{"Resolved by", b.ResolvedBy},
+		{"Resolution", b.ResolutionNote},
+	} {
+		row(w, field.name, field.value)
+	}
+}
+
+func (c *cli) routes(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		var routes []be.AdminRouteView
+		if err := c.admin.do(http.MethodGet, "/routes", nil, nil, &routes); err != nil {
+			return err
+		}
+		return c.print(routes, func(w *tabwriter.Writer) {
+			row(w, "ROUTE", "STATUS", "PAUSED BY", "SINCE", "NOTE")
+			for _, r := range routes {
+				if r.Paused == nil {
+					row(w, r.Route.Key(), "active", "", "", "")
+					continue
+				}
+				row(w, r.Route.Key(), "paused by "+r.Paused.Key(), r.Paused.PausedBy, r.Paused.PausedTime, r.Paused.Note)
+			}
+		})
+	}
+	return errUsage
+}
+
+func (c *cli) pauses(args []string) error {
+	if len(args) != 1 || args[0] != "list" {
+		return errUsage
+	}
+	var pauses []be.Pause
+	if err := c.admin.do(http.MethodGet, "/pauses", nil, nil, &pauses); err != nil {
+		return err
+	}
+	return c.print(pauses, func(w *tabwriter.Writer) {
+		row(w, "PAUSE", "PAUSED BY", "SINCE", "NOTE")
+		for _, p := range pauses {
+			row(w, p.Key(), p.PausedBy, p.PausedTime, p.Note)
+		}
+	})
+}
+
+// pause turns a kill switch on, or off for resume. The switch is global or a scope and its
+// target, e.g. "chain octa".
+func (c *cli) pause(action string) func([]string) error {
+	return func(args []string) error {
+		f := newActionFlags(action)
+		f.fs.Parse(args)
+		scope, target := f.fs.Arg(0), f.fs.Arg(1)
+		if (scope == be.PauseGlobal && f.fs.NArg() != 1) || (scope != be.PauseGlobal && f.fs.NArg() != 2) {
+			return errUsage
+		}
+		body := map[string]interface{}{"note": *f.note, "target": target}
+		return c.action("/pauses/"+url.PathEscape(scope)+"/"+action, body, *f.dryRun)
+	}
+}
+
+func (c *cli) reserves(args []string) error {
+	var reserves []be.Reserve
+	if err := c.admin.do(http.MethodGet, "/reserves", nil, nil, &reserves); err != nil {
+		return err
+	}
+	return c.print(reserves, func(w *tabwriter.Writer) {
+		row(w, "ROUTE", "PENDING", "BRIDGES", "TOTAL SUPPLY", "CAP", "MINTED TODAY", "DAILY CAP", "REMAINING", "ERROR")
+		for _, r := range reserves {
+			if r.Capacity == nil {
+				row(w, r.Route.Key(), r.Pending, r.PendingCount, "", "", "", "", "", r.Error)
+				continue
+			}
+			row(w, r.Route.Key(), r.Pending, r.PendingCount, r.Capacity.TotalSupply, r.Capacity.Cap,
+				r.Capacity.DailyMinted, r.Capacity.DailyMintCap, r.Capacity.Remaining, r.Error)
+		}
+	})
+}
+
+func (c *cli) audit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "how many entries to show")
+	offset := fs.Int("offset", 0, "how many of the newest entries to skip")
+	fs.Parse(args)
+
+	query := url.Values{"limit": {strconv.Itoa(*limit)}, "offset": {strconv.Itoa(*offset)}}
+	var entries []be.AuditEntry
+	if err := c.admin.do(http.MethodGet, "/audit", query, nil, &entries); err != nil {
+		return err
+	}
+	return c.print(entries, func(w *tabwriter.Writer) {
+		row(w, "TIME", "ACTOR", "ACTION", "TARGET", "DRY RUN", "NOTE", "ERROR")
+		for _, e := range entries {
+			row(w, e.Time, e.Actor, e.Action, e.Target, e.DryRun, e.Note, e.Error)
+		}
+	})
+}
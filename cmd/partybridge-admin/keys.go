@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	be "github.com/TeaPartyCrypto/partybridge/pkg"
+)
+
+// keys manages the API keys of integrator clients in Redis.
+func (c *cli) keys(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	keys := be.NewKeyStore(c.redis())
+	ctx := context.Background()
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("keys add", flag.ExitOnError)
+		name := fs.String("name", "", "a name for the key")
+		clientID := fs.String("client", "", "the client id the key belongs to")
+		scopes := fs.String("scopes", "quote,bridge,read", "comma separated scopes: "+strings.Join(be.Scopes, ", "))
+		routes := fs.String("routes", "", "comma separated routes the key may bridge over, all when empty")
+		rateLimit := fs.Int("rate-limit", 0, "requests per minute, API_KEY_RATE_LIMIT when 0")
+		dryRun := fs.Bool("dry-run", false, "print the key that would be added without adding it")
+		fs.Parse(args[1:])
+
+		if *dryRun {
+			if err := be.ValidateKey(*clientID, split(*scopes), split(*routes)); err != nil {
+				return err
+			}
+			key := be.APIKey{Name: *name, ClientID: *clientID, Scopes: split(*scopes), Routes: split(*routes), RateLimit: *rateLimit}
+			return c.print(key, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "dry run: a key would be added")
+				fmt.Fprintln(w)
+				keyTable(w, []be.APIKey{key})
+			})
+		}
+		key, token, err := keys.Create(ctx, *name, *clientID, split(*scopes), split(*routes), *rateLimit)
+		if err != nil {
+			return err
+		}
+		return c.printToken("added", key, token)
+
+	case "rotate":
+		fs := flag.NewFlagSet("keys rotate", flag.ExitOnError)
+		id := fs.String("id", "", "the id of the key")
+		grace := fs.Duration("grace", 24*time.Hour, "how long the old key keeps working")
+		dryRun := fs.Bool("dry-run", false, "check the key without rotating it")
+		fs.Parse(args[1:])
+
+		if *dryRun {
+			return c.dryRunKey(ctx, keys, *id, fmt.Sprintf("would be rotated, the old secret would work for %s", *grace))
+		}
+		key, token, err := keys.Rotate(ctx, *id, *grace)
+		if err != nil {
+			return err
+		}
+		return c.printToken("rotated", key, token)
+
+	case "revoke":
+		fs := flag.NewFlagSet("keys revoke", flag.ExitOnError)
+		id := fs.String("id", "", "the id of the key")
+		dryRun := fs.Bool("dry-run", false, "check the key without revoking it")
+		fs.Parse(args[1:])
+
+		if *dryRun {
+			return c.dryRunKey(ctx, keys, *id, "would be revoked")
+		}
+		key, err := keys.Revoke(ctx, *id)
+		if err != nil {
+			return err
+		}
+		return c.printToken("revoked", key, "")
+
+	case "list":
+		all, err := keys.List(ctx)
+		if err != nil {
+			return err
+		}
+		for i := range all {
+			all[i] = redactKey(all[i])
+		}
+		return c.print(all, func(w *tabwriter.Writer) { keyTable(w, all) })
+	}
+	return errUsage
+}
+
+// dryRunKey prints what would happen to the key with id.
+func (c *cli) dryRunKey(ctx context.Context, keys *be.KeyStore, id, what string) error {
+	key, err := keys.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	k := redactKey(key)
+	return c.print(k, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "dry run: key %s of %s %s\n\n", k.ID, k.ClientID, what)
+		keyTable(w, []be.APIKey{k})
+	})
+}
+
+// printToken prints a key and, once, its token.
+func (c *cli) printToken(what string, key be.APIKey, token string) error {
+	key = redactKey(key)
+	out := struct {
+		be.APIKey
+		Token string `json:"token,omitempty"`
+	}{key, token}
+	return c.print(out, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "%s key %s for %s\n", what, key.ID, key.ClientID)
+		if token != "" {
+			fmt.Fprintln(w, token)
+		}
+	})
+}
+
+// redactKey drops the secret hashes of a key, they are of no use to operators.
+func redactKey(key be.APIKey) be.APIKey {
+	key.SecretHash = ""
+	key.PreviousSecretHash = ""
+	return key
+}
+
+func keyTable(w *tabwriter.Writer, keys []be.APIKey) {
+	row(w, "ID", "NAME", "CLIENT", "SCOPES", "ROUTES", "RATE LIMIT", "CREATED", "STATUS")
+	for _, key := range keys {
+		status := "active"
+		if key.Revoked() {
+			status = "revoked " + key.RevokedTime.Format(time.RFC3339)
+		}
+		row(w, key.ID, key.Name, key.ClientID, strings.Join(key.Scopes, ","), strings.Join(key.Routes, ","),
+			key.RateLimit, key.CreatedTime, status)
+	}
+}
+
+func split(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
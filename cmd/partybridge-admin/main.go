@@ -0,0 +1,101 @@
+// partybridge-admin is the operator CLI of the bridge. Bridges, routes, reserves and the audit
+// log are managed through the admin API, keys and storage migrations directly in Redis and
+// shim certificates on disk.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const usage = `usage: partybridge-admin [-o table|json] <command> [flags] [args]
+
+commands:
+  bridges list [-list failed|active|held|unconfirmed|burns|expired|stuck]
+  bridges get <id>
+  bridges retry [-force] [-note] [-dry-run] <id>
+  bridges refund [-refund-address] [-force] [-note] [-dry-run] <id>
+  bridges resolve -note <note> [-dry-run] <id>
+  bridges unlock [-note] [-dry-run] <id>
+  routes list
+  pauses list
+  pause [-note] [-dry-run] global|route <route>|chain <chain>|asset <currency>
+  resume [-note] [-dry-run] global|route <route>|chain <chain>|asset <currency>
+  reserves
+  audit [-limit] [-offset]
+  keys add|rotate|revoke|list
+  shim certs [-dir]
+  shim rotate-certs [-dir] -cert <file> -key <file> [-ca <file>] [-dry-run]
+  migrate list
+  migrate run [-dry-run] <name>|all
+
+Flags go before the arguments of a command. The admin API is reached at
+PARTYBRIDGE_ADMIN_URL (default http://localhost:9090) with the token in
+PARTYBRIDGE_ADMIN_TOKEN. Redis is configured with REDIS_ADDRESS, REDIS_PASSWORD
+and REDIS_DB, and the shim certificates are in SHIM_CA_CERT.
+`
+
+// cli holds what the commands share.
+type cli struct {
+	// output is table or json.
+	output string
+	admin  *adminClient
+}
+
+// redis returns a client of the Redis the bridge stores its data in.
+func (c *cli) redis() *redis.Client {
+	db, _ := strconv.Atoi(os.Getenv("REDIS_DB"))
+	return redis.NewClient(&redis.Options{
+		Addr:     os.Getenv("REDIS_ADDRESS"),
+		Password: os.Getenv("REDIS_PASSWORD"),
+		DB:       db,
+	})
+}
+
+func main() {
+	fs := flag.NewFlagSet("partybridge-admin", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	output := fs.String("o", "table", "output format, table or json")
+	fs.Parse(os.Args[1:])
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+
+	args := fs.Args()
+	if len(args) < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c := &cli{output: *output, admin: newAdminClient(os.Getenv("PARTYBRIDGE_ADMIN_URL"), os.Getenv("PARTYBRIDGE_ADMIN_TOKEN"))}
+	commands := map[string]func([]string) error{
+		"bridges":  c.bridges,
+		"routes":   c.routes,
+		"pauses":   c.pauses,
+		"pause":    c.pause("pause"),
+		"resume":   c.pause("resume"),
+		"reserves": c.reserves,
+		"audit":    c.audit,
+		"keys":     c.keys,
+		"shim":     c.shim,
+		"migrate":  c.migrate,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := command(args[1:]); err != nil {
+		if err == errUsage {
+			fs.Usage()
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"text/tabwriter"
+
+	be "github.com/TeaPartyCrypto/partybridge/pkg"
+)
+
+// migrate lists and runs the storage migrations.
+func (c *cli) migrate(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		type migration struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		}
+		migrations := make([]migration, len(be.Migrations))
+		for i, m := range be.Migrations {
+			migrations[i] = migration{m.Name, m.Description}
+		}
+		return c.print(migrations, func(w *tabwriter.Writer) {
+			row(w, "NAME", "DESCRIPTION")
+			for _, m := range migrations {
+				row(w, m.Name, m.Description)
+			}
+		})
+
+	case "run":
+		fs := flag.NewFlagSet("migrate run", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "count the records that would change without changing them")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return errUsage
+		}
+
+		names := []string{fs.Arg(0)}
+		if names[0] == "all" {
+			names = names[:0]
+			for _, m := range be.Migrations {
+				names = append(names, m.Name)
+			}
+		}
+
+		migrator := be.NewMigrator(c.redis())
+		var results []be.MigrationResult
+		var err error
+		for _, name := range names {
+			var result be.MigrationResult
+			result, err = migrator.Run(context.Background(), name, *dryRun)
+			results = append(results, result)
+			if err != nil {
+				break
+			}
+		}
+		if perr := c.print(results, func(w *tabwriter.Writer) {
+			row(w, "MIGRATION", "CHANGED", "DRY RUN")
+			for _, r := range results {
+				row(w, r.Name, r.Changed, r.DryRun)
+			}
+		}); perr != nil {
+			return perr
+		}
+		return err
+	}
+	return errUsage
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errUsage is returned by commands called with the wrong arguments.
+var errUsage = errors.New("usage")
+
+// print writes v as JSON, or as the table written by table.
+func (c *cli) print(v interface{}, table func(w *tabwriter.Writer)) error {
+	if c.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// row writes the cells of a table row.
+func row(w *tabwriter.Writer, cells ...interface{}) {
+	s := make([]string, len(cells))
+	for i, cell := range cells {
+		s[i] = cellString(cell)
+	}
+	fmt.Fprintln(w, strings.Join(s, "\t"))
+}
+
+func cellString(cell interface{}) string {
+	switch v := cell.(type) {
+	case nil:
+		return "-"
+	case string:
+		if v == "" {
+			return "-"
+		}
+		return v
+	case *big.Int:
+		if v == nil {
+			return "-"
+		}
+		return v.String()
+	case time.Time:
+		if v.IsZero() {
+			return "-"
+		}
+		return v.Format(time.RFC3339)
+	case *time.Time:
+		if v == nil {
+			return "-"
+		}
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(cell)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// the files the bridge reads from SHIM_CA_CERT on every shim request.
+const (
+	shimClientCert = "client.crt"
+	shimClientKey  = "client.key"
+	shimCACert     = "ca.crt"
+)
+
+// certInfo describes a certificate file.
+type certInfo struct {
+	File      string    `json:"file"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// certRotation is the result of rotating the shim certificates.
+type certRotation struct {
+	Dir    string     `json:"dir"`
+	DryRun bool       `json:"dryRun,omitempty"`
+	Certs  []certInfo `json:"certs"`
+	// Backups are the copies of the replaced files.
+	Backups []string `json:"backups,omitempty"`
+}
+
+func (c *cli) shim(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "certs":
+		fs := flag.NewFlagSet("shim certs", flag.ExitOnError)
+		dir := fs.String("dir", os.Getenv("SHIM_CA_CERT"), "the shim certificate directory")
+		fs.Parse(args[1:])
+
+		var certs []certInfo
+		for _, name := range []string{shimClientCert, shimCACert} {
+			infos, err := readCerts(filepath.Join(*dir, name))
+			if err != nil {
+				return err
+			}
+			certs = append(certs, infos...)
+		}
+		return c.print(certs, func(w *tabwriter.Writer) { certTable(w, certs) })
+
+	case "rotate-certs":
+		fs := flag.NewFlagSet("shim rotate-certs", flag.ExitOnError)
+		dir := fs.String("dir", os.Getenv("SHIM_CA_CERT"), "the shim certificate directory")
+		cert := fs.String("cert", "", "the new client certificate")
+		key := fs.String("key", "", "the key of the new client certificate")
+		ca := fs.String("ca", "", "the new CA certificate of the shims, the current one is kept when empty")
+		dryRun := fs.Bool("dry-run", false, "check the new certificates without installing them")
+		fs.Parse(args[1:])
+		if *dir == "" || *cert == "" || *key == "" {
+			return errUsage
+		}
+
+		rotation, err := rotateShimCerts(*dir, *cert, *key, *ca, *dryRun)
+		if err != nil {
+			return err
+		}
+		return c.print(rotation, func(w *tabwriter.Writer) {
+			if rotation.DryRun {
+				fmt.Fprintf(w, "dry run: the certificates would be installed in %s\n\n", rotation.Dir)
+			} else {
+				fmt.Fprintf(w, "installed the certificates in %s, they are used from the next shim request\n\n", rotation.Dir)
+			}
+			certTable(w, rotation.Certs)
+			for _, backup := range rotation.Backups {
+				fmt.Fprintf(w, "\nbacked up %s", backup)
+			}
+			if len(rotation.Backups) > 0 {
+				fmt.Fprintln(w)
+			}
+		})
+	}
+	return errUsage
+}
+
+// rotateShimCerts checks a new client certificate, and optionally CA, and installs them in
+// dir. The files they replace are kept next to them with a timestamp suffix.
+func rotateShimCerts(dir, cert, key, ca string, dryRun bool) (certRotation, error) {
+	rotation := certRotation{Dir: dir, DryRun: dryRun}
+
+	// the pair must load the way the bridge loads it, which also checks that they match.
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return rotation, fmt.Errorf("loading the new client certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return rotation, err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return rotation, fmt.Errorf("the new client certificate is only valid from %s to %s", leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	rotation.Certs = append(rotation.Certs, describeCert(shimClientCert, leaf))
+
+	install := map[string]string{shimClientCert: cert, shimClientKey: key}
+	if ca != "" {
+		infos, err := readCerts(ca)
+		if err != nil {
+			return rotation, fmt.Errorf("loading the new CA certificate: %w", err)
+		}
+		for i := range infos {
+			infos[i].File = shimCACert
+		}
+		rotation.Certs = append(rotation.Certs, infos...)
+		install[shimCACert] = ca
+	}
+	if dryRun {
+		return rotation, nil
+	}
+
+	// the key goes in last, so that a failure half way leaves the old pair in place.
+	suffix := now.UTC().Format("20060102T150405Z")
+	for _, name := range []string{shimCACert, shimClientCert, shimClientKey} {
+		src, ok := install[name]
+		if !ok {
+			continue
+		}
+		dst := filepath.Join(dir, name)
+		if _, err := os.Stat(dst); err == nil {
+			backup := dst + "." + suffix
+			if err := copyFile(dst, backup); err != nil {
+				return rotation, err
+			}
+			rotation.Backups = append(rotation.Backups, backup)
+		}
+		if err := installFile(src, dst); err != nil {
+			return rotation, err
+		}
+	}
+	return rotation, nil
+}
+
+// installFile replaces dst with src by renaming a copy over it, so that the bridge never
+// reads a partially written file.
+func installFile(src, dst string) error {
+	tmp := dst + ".tmp"
+	if err := copyFile(src, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0600)
+}
+
+// readCerts describes the certificates in a PEM file.
+func readCerts(path string) ([]certInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var infos []certInfo
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		infos = append(infos, describeCert(filepath.Base(path), cert))
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("%s holds no certificates", path)
+	}
+	return infos, nil
+}
+
+func describeCert(file string, cert *x509.Certificate) certInfo {
+	return certInfo{
+		File:      file,
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+}
+
+func certTable(w *tabwriter.Writer, certs []certInfo) {
+	row(w, "FILE", "SUBJECT", "ISSUER", "VALID FROM", "VALID UNTIL", "EXPIRES IN")
+	for _, cert := range certs {
+		expires := "expired"
+		if left := time.Until(cert.NotAfter); left > 0 {
+			expires = fmt.Sprintf("%dd", int(left.Hours()/24))
+		}
+		row(w, cert.File, cert.Subject, cert.Issuer, cert.NotBefore, cert.NotAfter, expires)
+	}
+}
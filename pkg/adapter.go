@@ -3,7 +3,6 @@ package be
 import (
 	"context"
 	"crypto/tls"
-	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"os"
@@ -23,12 +22,13 @@ import (
 
 	uuid "github.com/google/uuid"
 
-	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
-
 	"github.com/go-redis/redis/v9"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // EnvAccessorCtor for configuration parameters
@@ -52,49 +52,59 @@ func NewAdapter(ctx context.Context, envAcc pkgadapter.EnvConfigAccessor, ceClie
 	env := envAcc.(*envAccessor)
 	e := &ExchangeServer{}
 	e.wsClients = make(map[string]*WebSocketClient)
-	e.logger = logging.FromContext(ctx)
-
-	// Initialize the Party Chain nodes.
-	partyclient, err := ethclient.Dial(env.PartyChainRPC1)
-	if err != nil {
-		e.logger.Errorw("Error connecting to PartyChain RPC 1", "rpc", env.PartyChainRPC1)
-		if !env.Development {
-			panic(err)
-		}
+	e.subscriptions = make(map[string]map[string]*WebSocketClient)
+	if env.PodName == "" {
+		e.podName = uuid.New().String()
+	} else {
+		e.podName = env.PodName
 	}
+	e.logger = newLogger(logging.FromContext(ctx), e.podName)
 
-	partyclientTwo, err := ethclient.Dial(env.PartyChainRPC2)
-	if err != nil {
-		e.logger.Errorw("Error connecting to PartyChain RPC 2", "rpc", env.PartyChainRPC2)
-		if !env.Development {
-			panic(err)
-		}
+	// Initialize the RPC endpoint pools of the chains.
+	partyChainRPCs := splitList(env.PartyChainRPCs)
+	if len(partyChainRPCs) == 0 {
+		partyChainRPCs = splitList(env.PartyChainRPC1 + "," + env.PartyChainRPC2)
 	}
-
-	octClient, err := ethclient.Dial(env.OCTARPC1)
-	if err != nil {
-		e.logger.Errorw("Error connecting to OctaSpace RPC 1", "rpc", env.OCTARPC1)
-		if !env.Development {
-			panic(err)
-		}
+	octaRPCs := splitList(env.OCTARPCs)
+	if len(octaRPCs) == 0 {
+		octaRPCs = splitList(env.OCTARPC1 + "," + env.OCTARPC2)
 	}
-
-	octClient2, err := ethclient.Dial(env.OCTARPC2)
-	if err != nil {
-		e.logger.Errorw("Error connecting to OctaSpace RPC 2", "rpc", env.OCTARPC2)
-		if !env.Development {
-			panic(err)
+	bscRPCs := splitList(env.BSCRPCs)
+	if len(bscRPCs) == 0 {
+		bscRPCs = []string{bscRPCEndpoint}
+	}
+	for _, pool := range []struct {
+		node  **EthereumNode
+		chain string
+		urls  []string
+	}{
+		{&e.partyChain, GRAMS, partyChainRPCs},
+		{&e.octNode, OCTA, octaRPCs},
+		{&e.bscNode, BSCUSDT, bscRPCs},
+	} {
+		node, err := newEthereumNode(ctx, pool.chain, pool.urls, env.RPCMaxLag, e.logger)
+		if err != nil {
+			e.logger.Errorw("Error configuring RPC endpoints", "chain", pool.chain, "error", err)
+			if !env.Development {
+				panic(err)
+			}
+			node = &EthereumNode{chain: pool.chain, logger: e.logger}
 		}
+		*pool.node = node
 	}
-
-	e.partyChain.rpcClient = partyclient
-	e.partyChain.rpcClientTwo = partyclientTwo
-	e.octNode.rpcClient = octClient
-	e.octNode.rpcClientTwo = octClient2
+	e.rpcCheckInterval = env.RPCCheckInterval
+	e.receiptPollInterval = env.ReceiptPollInterval
+	e.stuckTxAfter = env.StuckTxAfter
+	e.maxGasBumps = env.MaxGasBumps
+	e.healthCheckInterval = env.HealthCheckInterval
+	e.healthCheckTimeout = env.HealthCheckTimeout
+	e.maxBlockAge = env.MaxBlockAge
 	e.shimCertLocation = env.ShimCertLocation
 	e.watch = env.Watch
 	e.dev = env.Development
 	e.ceClient = ceClient
+	e.ceSinkConfigured = env.GetSink() != ""
+	e.ceReceiverPort = env.CEReceiverPort
 	e.gramsShimServerAddress = env.WGramsShimServerAddress
 	e.octaShimServerAddress = env.WOctaShimServerAddress
 	e.bscUSDTOnOctaSpaceShimServerAddress = env.WBSCUSDTOnOctaSpaceShimServerAddress
@@ -107,11 +117,80 @@ func NewAdapter(ctx context.Context, envAcc pkgadapter.EnvConfigAccessor, ceClie
 	e.fee = env.Fee
 	e.SSLCRTLocation = env.ServerSSLCRTFilePath
 	e.ServerSSLKeyFilePath = env.ServerSSLKeyFilePath
-
-	if env.PodName == "" {
-		e.podName = uuid.New().String()
-	} else {
-		e.podName = env.PodName
+	e.defaultPaymentWindow = env.PaymentWindow
+	var err error
+	e.paymentWindows, err = parseRouteDurations(env.PaymentWindows)
+	if err != nil {
+		e.logger.Errorw("parsing PAYMENT_WINDOWS", "error", err)
+		if !env.Development {
+			panic(err)
+		}
+	}
+	e.gasPriceCeilings, err = parseGasPriceCeilings(env.GasPriceCeilings)
+	if err != nil {
+		e.logger.Errorw("parsing GAS_PRICE_CEILINGS", "error", err)
+		if !env.Development {
+			panic(err)
+		}
+	}
+	e.hotWallet, err = escrowKey(env.SMARTCONTRACTPRIVATEKEY)
+	if err != nil {
+		e.logger.Errorw("parsing PRIVATE_KEY", "error", err)
+		if !env.Development {
+			panic(err)
+		}
+	}
+	if err := e.configureSettlers(env.Settler, env.Settlers); err != nil {
+		e.logger.Errorw("configuring SETTLER and SETTLERS", "error", err)
+		if !env.Development {
+			panic(err)
+		}
+	}
+	e.topUpWindow = env.TopUpWindow
+	e.overpaymentPolicy = env.OverpaymentPolicy
+	e.lateDepositPolicy = env.LateDepositPolicy
+	e.lateDepositGrace = env.LateDepositGrace
+	e.webhookClient = newWebhookClient(env.WebhookTimeout, env.Development)
+	e.webhookMaxAttempts = env.WebhookMaxAttempts
+	e.webhookRetryBackoff = env.WebhookRetryBackoff
+	e.allowedOrigins = splitList(env.AllowedOrigins)
+	e.trustedProxyHeader = env.TrustedProxyHeader
+	if e.trustedProxies, err = parseCIDRs(env.TrustedProxies); err != nil {
+		e.logger.Errorw("parsing TRUSTED_PROXIES", "error", err)
+		if !env.Development {
+			panic(err)
+		}
+	}
+	e.anonymousAccess = env.AnonymousAccess
+	e.anonymousScopes = splitList(env.AnonymousScopes)
+	e.anonymousRateLimit = env.AnonymousRateLimit
+	e.apiKeyRateLimit = env.APIKeyRateLimit
+	e.jwtSecret = []byte(env.JWTSecret)
+	e.apiKeyLimitMultiplier = env.APIKeyLimitMultiplier
+	e.maxPendingPerAddress = env.MaxPendingPerAddress
+	e.maxPendingWatches = env.MaxPendingWatches
+	for _, limit := range []struct {
+		bucket *tokenBucket
+		name   string
+		value  string
+	}{
+		{&e.connectionLimit, "connections", env.ConnectionLimit},
+		{&e.quoteLimit, "quotes", env.QuoteLimit},
+		{&e.bridgeLimit, "bridges", env.BridgeLimit},
+	} {
+		if *limit.bucket, err = parseTokenBucket(limit.name, limit.value); err != nil {
+			e.logger.Errorw("parsing rate limits", "error", err)
+			if !env.Development {
+				panic(err)
+			}
+		}
+	}
+	e.maxPendingWatchesByRoute, err = parseRouteLimits(env.MaxPendingWatchesByRoute)
+	if err != nil {
+		e.logger.Errorw("parsing MAX_PENDING_WATCHES_BY_ROUTE", "error", err)
+		if !env.Development {
+			panic(err)
+		}
 	}
 
 	// Initialize the Redis client.
@@ -120,6 +199,38 @@ func NewAdapter(ctx context.Context, envAcc pkgadapter.EnvConfigAccessor, ceClie
 		Password: env.RedisPassword,
 		DB:       env.RedisDB,
 	})
+	e.redisClient.AddHook(redisMetricsHook{})
+
+	e.keys = NewKeyStore(e.redisClient)
+
+	e.rejectContractAddresses = env.RejectContractAddresses
+	if env.ScreeningFile != "" {
+		screener, err := NewFileScreener(env.ScreeningFile)
+		if err != nil {
+			e.logger.Errorw("loading SCREENING_FILE", "error", err)
+			panic(err)
+		}
+		e.screener = screener
+	}
+
+	e.adminPort = env.AdminPort
+	e.stuckAfter = env.StuckAfter
+	e.adminTokens, err = parseAdminTokens(env.AdminTokens)
+	if err != nil {
+		e.logger.Errorw("parsing ADMIN_TOKENS", "error", err)
+		if !env.Development {
+			panic(err)
+		}
+	}
+
+	e.flushTraces, err = setupTracing(ctx, env, e.podName)
+	if err != nil {
+		e.logger.Errorw("setting up TRACING_EXPORTER", "error", err)
+		if !env.Development {
+			panic(err)
+		}
+		e.flushTraces = func(context.Context) error { return nil }
+	}
 
 	// Test the Redis connection.
 	_, err = e.redisClient.Ping(ctx).Result()
@@ -153,7 +264,22 @@ func (e *ExchangeServer) Start(ctx context.Context) error {
 		cancel()
 	}()
 
+	// set before any goroutine, the WebSocket handlers included, can read it.
+	e.ctx = ctx
+	go e.syncPendingSlots(ctx)
 	go e.StartWarren(ctx)
+	go e.runWebhookDeliveries(ctx)
+	go e.runBurnRetries(ctx)
+	for _, node := range []*EthereumNode{e.partyChain, e.octNode, e.bscNode} {
+		go node.run(ctx, e.rpcCheckInterval, e.healthCheckTimeout)
+	}
+	go e.runHealthChecks(ctx)
+	if e.ceReceiverPort != 0 {
+		go e.startCloudEventsReceiver(ctx, e.ceReceiverPort)
+	}
+	if e.adminPort != 0 {
+		go e.startAdminServer(ctx, e.adminPort)
+	}
 	e.logger.Info("started warren")
 	e.logger.Info("starting http server...")
 	cert, err := tls.LoadX509KeyPair(e.SSLCRTLocation, e.ServerSSLKeyFilePath)
@@ -164,12 +290,18 @@ func (e *ExchangeServer) Start(ctx context.Context) error {
 
 	router := mux.NewRouter()
 	router.HandleFunc("/", e.handleRoot)
+	router.HandleFunc("/healthz", e.handleHealthz).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", e.handleReadyz).Methods(http.MethodGet)
+	router.HandleFunc("/status", e.handleStatus).Methods(http.MethodGet)
 	router.HandleFunc("/wss", e.handleWebSocketConnection)
+	router.HandleFunc("/protocol.schema.json", e.handleProtocolSchema)
+	e.registerAPIRoutes(router)
 	router.Handle("/metrics", promhttp.Handler())
+	handler := e.cors(router)
 
 	// start a http server without TLS on 8081
 	go func() {
-		if err := http.ListenAndServe(":8081", router); err != nil && err != http.ErrServerClosed {
+		if err := http.ListenAndServe(":8081", handler); err != nil && err != http.ErrServerClosed {
 			e.logger.Infof("started on 8081")
 			e.logger.Fatalf("listen: %s\n", err)
 		}
@@ -177,7 +309,7 @@ func (e *ExchangeServer) Start(ctx context.Context) error {
 
 	server := &http.Server{
 		Addr:    ":8080",
-		Handler: router,
+		Handler: handler,
 		TLSConfig: &tls.Config{
 			Certificates: []tls.Certificate{cert},
 		},
@@ -202,6 +334,12 @@ func (e *ExchangeServer) shutdown(ctx context.Context, server *http.Server) {
 	if err := e.updateAccountWatchRequestsOnCrash(); err != nil {
 		e.logger.Errorw("error updating account watch requests on crash", "error", err)
 	}
+	// ctx is done by now, the spans are given a deadline of their own.
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := e.flushTraces(flushCtx); err != nil {
+		e.logger.Errorw("error flushing traces", "error", err)
+	}
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctx); err != nil {
@@ -214,12 +352,20 @@ func (e *ExchangeServer) shutdown(ctx context.Context, server *http.Server) {
 func (e *ExchangeServer) handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
 	e.logger.Debug("handling websocket connection")
 
-	// add the CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	// the upgrade is refused for clients that can not authenticate, so that they get a
+	// status code rather than a socket that is closed right away.
+	principal, perr := e.authenticate(r)
+	if perr == nil {
+		perr = e.takeToken(r.Context(), e.connectionLimit, principal, e.remoteIP(r), RejectConnectionRate)
+	}
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
 
-	conn, err := Upgrader.Upgrade(w, r, nil)
+	upgrader := Upgrader
+	upgrader.CheckOrigin = e.checkOrigin
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		e.logger.Errorw("failed to upgrade connection to WebSocket", "error", err)
 		return
@@ -228,18 +374,43 @@ func (e *ExchangeServer) handleWebSocketConnection(w http.ResponseWriter, r *htt
 	// Create a channel for sending messages to the client
 	messageChan := make(chan []byte)
 
+	// clients that pass the session id of an earlier connection with ?id= and its resume
+	// token resume it, otherwise they start a new session. ?id= may also be the transaction
+	// id of a bridge the client may follow.
+	id := r.URL.Query().Get("id")
+	resumeToken := r.URL.Query().Get("resumeToken")
 	sid := uuid.New().String()
+	if sessionIDPattern.MatchString(id) {
+		resumed, err := e.authorizeSession(r.Context(), id, resumeToken, principal)
+		if err != nil {
+			e.logger.Errorw("failed to check the resume token", "id", id, "error", err)
+		}
+		if resumed {
+			sid = id
+		}
+	}
+	if sid != id {
+		if resumeToken, err = e.startSession(r.Context(), sid, principal); err != nil {
+			// the session works, it just can not be resumed.
+			e.logger.Errorw("failed to store the session resume token", "sid", sid, "error", err)
+			resumeToken = ""
+		}
+	}
 
-	client := &WebSocketClient{conn: conn, sid: sid, send: messageChan}
+	client := &WebSocketClient{conn: conn, sid: sid, connID: uuid.New().String(), send: messageChan, principal: principal, remoteIP: e.remoteIP(r)}
 	e.wsClientsMutex.Lock()
-	e.wsClients[sid] = client
+	e.wsClients[client.connID] = client
 	e.wsClientsMutex.Unlock()
+	WebSocketConnectionsAdd(1)
+	e.subscribe(sid, client)
 
 	e.logger.Infow("new client connected", "sid", sid)
 
 	helloMsg := HelloMsg{
 		Type:          "hello",
+		Version:       ProtocolVersion,
 		SID:           sid,
+		ResumeToken:   resumeToken,
 		MinimumAmount: e.minimumAmount,
 		Fee:           e.fee,
 	}
@@ -251,18 +422,20 @@ func (e *ExchangeServer) handleWebSocketConnection(w http.ResponseWriter, r *htt
 		return
 	}
 
-	e.logger.Infow("helloMsg", "sid", sid, "data", helloMsg)
-	client.conn.WriteMessage(websocket.TextMessage, []byte(data))
+	e.logger.Infow("helloMsg", "sid", sid, "version", helloMsg.Version)
+	client.write(data)
+
+	if id != "" {
+		e.resumeSession(r.Context(), client, id, r.URL.Query().Get("since"))
+	}
 
 	// Start the Goroutine to handle the client's connection
-	go e.handleClientRequests(*client)
+	go e.handleClientRequests(client)
 }
 
-func (e *ExchangeServer) handleClientRequests(client WebSocketClient) {
+func (e *ExchangeServer) handleClientRequests(client *WebSocketClient) {
 	defer func() {
-		e.wsClientsMutex.Lock()
-		delete(e.wsClients, client.sid)
-		e.wsClientsMutex.Unlock()
+		e.unsubscribeAll(client)
 		client.conn.Close()
 	}()
 
@@ -274,94 +447,146 @@ func (e *ExchangeServer) handleClientRequests(client WebSocketClient) {
 			}
 			break
 		}
-		var req RequestBridgeMsg
-		json.Unmarshal([]byte(message), &req)
+
+		// invalid messages are answered with an error, they never close the session.
+		req, perr := decodeClientMessage(message)
+		if perr != nil {
+			e.logger.Infow("rejecting client message", "sid", client.sid, "id", req.ID, "error", perr)
+			e.sendError(client, req.ID, perr)
+			continue
+		}
 
 		e.logger.Infow("handle request", "sid", client.sid, "req", req)
 
-		if req.Type == "requestBridge" {
-			if req.Data.Amount.Cmp(ToWei(e.minimumAmount, 18)) == -1 && !e.dev {
-				e.sendStatusMsg(client.sid, "error", "amount value is less than minimum")
-				return
-			}
+		ctx, span := tracer.Start(e.ctx, "websocket message", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("bridge.sid", client.sid), attribute.String("message.type", req.Type)))
+		if perr := e.handleClientMessage(ctx, client, req); perr != nil {
+			e.logger.Infow("rejecting client message", "sid", client.sid, "id", req.ID, "type", req.Type, "error", perr)
+			e.sendError(client, req.ID, perr)
+			span.SetStatus(codes.Error, perr.Error())
+		}
+		span.End()
+	}
+}
 
-			if client.acc == nil {
-				acc := e.generateEVMAccount(req.Data.Currency)
-				client.acc = acc
-			}
-			client.request = req.Data
+// handleClientMessage authorizes a client message and handles it.
+func (e *ExchangeServer) handleClientMessage(ctx context.Context, client *WebSocketClient, req RequestBridgeMsg) *ProtocolError {
+	if perr := e.authorizeClientMessage(client, req.Type); perr != nil {
+		return perr
+	}
 
-			resp := RequestBridgeResponseMsg{
-				Type:    "requestBridgeResponse",
-				Amount:  req.Data.Amount.Add(req.Data.Amount, ToWei(e.fee, 18)),
-				Address: crypto.PubkeyToAddress(client.acc.PublicKey).String(),
-			}
-			data, err := json.Marshal(resp)
+	switch req.Type {
+	case MsgTypeQuote:
+		return e.handleQuote(ctx, client, req)
+	case MsgTypeSubscribe:
+		return e.handleSubscribe(ctx, client, req)
+	case MsgTypeRequestBridge:
+		return e.handleRequestBridge(ctx, client, req)
+	case MsgTypeConfirmBridge:
+		return e.handleConfirmBridge(ctx, client, req)
+	}
+	return protocolErrorf(ErrCodeUnknownType, "type", "unknown message type %q", req.Type)
+}
 
-			if err != nil {
-				e.logger.Errorw("failed encode RequestBridgeResponseMsg", "sid", client.sid, "error", err)
-				return
-			}
+// messageScopes are the scopes each client message type requires.
+var messageScopes = map[string]string{
+	MsgTypeQuote:         ScopeQuote,
+	MsgTypeSubscribe:     ScopeRead,
+	MsgTypeRequestBridge: ScopeBridge,
+	MsgTypeConfirmBridge: ScopeBridge,
+}
 
-			e.logger.Infow("requestBridgeResponse", "sid", client.sid, "data", resp)
-			client.conn.WriteMessage(websocket.TextMessage, []byte(data))
-		}
+// authorizeClientMessage checks that the client may send a message of msgType and counts it
+// against its rate limit. Unknown types are left to the message switch.
+func (e *ExchangeServer) authorizeClientMessage(client *WebSocketClient, msgType string) *ProtocolError {
+	scope, ok := messageScopes[msgType]
+	if !ok {
+		return nil
+	}
+	if !client.principal.can(scope) {
+		return protocolErrorf(ErrCodeForbidden, "type", "the %s scope is required", scope)
+	}
+	if perr := e.allowRequest(e.ctx, client.principal, client.principal.rateLimitKey(client.remoteIP)); perr != nil {
+		return perr
+	}
+	// quotes and bridge requests, which issue an escrow, share a bucket.
+	switch msgType {
+	case MsgTypeQuote, MsgTypeRequestBridge:
+		return e.takeToken(e.ctx, e.quoteLimit, client.principal, client.remoteIP, RejectQuoteRate)
+	case MsgTypeConfirmBridge:
+		return e.takeToken(e.ctx, e.bridgeLimit, client.principal, client.remoteIP, RejectBridgeRate)
+	}
+	return nil
+}
 
-		if req.Type == "confirmBridge" {
-			depositAccountWatchRequest := AccountWatchRequest{
-				TransactionID: uuid.New().String(),
-				AWRID:         uuid.New().String(),
-				Account:       crypto.PubkeyToAddress(client.acc.PublicKey).String(),
-				Chain:         client.request.FromChain,
-				Amount:        client.request.Amount,
-				TimeOut:       time.Now().Add(time.Minute * 30).Unix(),
-				LockedBy:      e.podName,
-				WSClientID:    client.sid,
-				CreatedTime:   time.Now(),
-				AssistedSellOrderInformation: AssistedTradeOrderInformation{
-					BridgeTo:              client.request.BridgeTo,
-					Currency:              client.request.Currency,
-					SellerShippingAddress: client.request.ShippingAddress,
-					Amount:                client.request.Amount,
-					SellersEscrowWallet: EscrowWallet{
-						PublicAddress: crypto.PubkeyToAddress(client.acc.PublicKey).String(),
-						PrivateKey:    hex.EncodeToString(client.acc.D.Bytes()),
-						Chain:         client.request.FromChain,
-					},
-					TradeAsset: client.request.BridgeTo,
-					BridgeFrom: client.request.FromChain,
-				},
-			}
-			if err := e.updateAccountWatchRequestInDB(depositAccountWatchRequest); err != nil {
-				e.logger.Errorw("error updating account watch request in db", "sid", client.sid, "error", err.Error(), "data", depositAccountWatchRequest)
-				return
-			}
-		}
+func (e *ExchangeServer) handleQuote(ctx context.Context, client *WebSocketClient, req RequestBridgeMsg) *ProtocolError {
+	if perr := client.principal.authorizeRoute(req.Data); perr != nil {
+		return perr
 	}
+	resp, perr := e.quoteBridge(ctx, req.Data)
+	if perr != nil {
+		return perr
+	}
+	resp.ID = req.ID
+	e.reply(client, resp)
+	return nil
 }
 
-func (e *ExchangeServer) sendStatusMsg(SID string, msgType string, message string) {
-	client, ok := e.wsClients[SID]
-	if !ok {
-		e.logger.Errorw("client session not found", "sid", SID)
-		return
+func (e *ExchangeServer) handleSubscribe(ctx context.Context, client *WebSocketClient, req RequestBridgeMsg) *ProtocolError {
+	// follow a bridge of the session, or one the API client created elsewhere.
+	allowed, err := e.canFollowBridge(ctx, client, req.Data.TxId)
+	if err != nil {
+		e.logger.Errorw("failed to look up bridge", "sid", client.sid, "txid", req.Data.TxId, "error", err)
+		return protocolErrorf(ErrCodeInternal, "", "unable to look up the bridge")
 	}
+	if !allowed {
+		return protocolErrorf(ErrCodeBridgeNotFound, "data.TxId", "bridge not found")
+	}
+	e.followBridge(client, req.Data.TxId, 0)
+	return nil
+}
 
-	statusMsg := StatusMsg{
-		Type:    msgType,
-		Message: message,
+func (e *ExchangeServer) handleRequestBridge(ctx context.Context, client *WebSocketClient, req RequestBridgeMsg) *ProtocolError {
+	if perr := client.principal.authorizeRoute(req.Data); perr != nil {
+		return perr
+	}
+	if client.acc == nil {
+		acc := e.generateEVMAccount(req.Data.Currency)
+		client.acc = acc
 	}
 
-	data, err := json.Marshal(statusMsg)
+	resp, perr := e.prepareBridge(ctx, &req.Data, client.acc)
+	if perr != nil {
+		return perr
+	}
+	client.request = req.Data
+	resp.ID = req.ID
 
-	if err != nil {
-		e.logger.Errorw("failed encode statusMsg", "sid", SID, "error", err)
-		return
+	e.logger.Infow("requestBridgeResponse", "sid", client.sid, "data", resp)
+	e.reply(client, resp)
+	return nil
+}
+
+func (e *ExchangeServer) handleConfirmBridge(ctx context.Context, client *WebSocketClient, req RequestBridgeMsg) *ProtocolError {
+	if client.acc == nil || client.request.Amount == nil {
+		return protocolErrorf(ErrCodeNoPendingBridge, "", "no bridge has been requested")
 	}
 
-	e.logger.Infow("sendStatusMsg", "sid", SID, "data", statusMsg)
+	awr, perr := e.startBridge(ctx, client.request, client.acc, client.sid, client.principal.ClientID)
+	if perr != nil {
+		return perr
+	}
+
+	resp := confirmBridgeResponse(awr)
+	resp.ID = req.ID
+	e.reply(client, resp)
 
-	client.conn.WriteMessage(websocket.TextMessage, []byte(data))
+	// the next bridge of this session gets a new escrow.
+	client.acc = nil
+	client.request = BridgeRequest{}
+	e.subscribe(awr.TransactionID, client)
+	e.publishStatus(awr, BridgeStatePending, "Waiting for the deposit")
+	return nil
 }
 
 // StartWarren starts the warren account watching service
@@ -369,7 +594,6 @@ func (e *ExchangeServer) StartWarren(ctx context.Context) error {
 	// log the pod name
 	e.logger.Infof("starting warren on pod %s", os.Getenv("POD_NAME"))
 	// start the account watch service.
-	e.ctx = ctx
 	e.warrenWG = &sync.WaitGroup{}
 	numWorkers := runtime.NumCPU()
 	e.warrenWG.Add(numWorkers)
@@ -402,6 +626,7 @@ func (e *ExchangeServer) StartWarren(ctx context.Context) error {
 				// do not return the error, continue running the loop
 				continue
 			}
+			WatchRequestsSet(awr)
 			if awr != nil {
 				if len(awr) > 0 {
 					cawr = append(cawr, awr...)
@@ -409,6 +634,10 @@ func (e *ExchangeServer) StartWarren(ctx context.Context) error {
 			}
 			// send the account watch requests to the warren service.
 			e.Warren(cawr)
+			// look for deposits that arrived after their request expired.
+			e.sweepExpiredAccountWatchRequests(ctx)
+			// settle the deposits held while their route was paused.
+			e.releaseHeldSettlements(ctx)
 		case <-ctx.Done():
 			// context is canceled, stop the loop
 			e.logger.Info("context is canceled, stopping the warren loop")
@@ -452,7 +681,7 @@ func (e *ExchangeServer) warrenWorker() {
 		select {
 		case request := <-e.warrenChan:
 			if !request.Locked {
-				e.logger.Infow("starting watch for account", "sid", request.WSClientID, "account", request.Account, "chain", request.Chain)
+				e.bridgeLogger(request).Infow("starting watch for account", "account", request.Account, "chain", request.Chain)
 				// start the watch.
 				go e.watchAccount(&request)
 			}
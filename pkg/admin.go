@@ -0,0 +1,742 @@
+package be
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// adminAuditLog is a list of AuditEntry, newest first.
+	adminAuditLog = "adminaudit"
+	// maxAdminAuditLog is how many entries the audit log keeps.
+	maxAdminAuditLog = 100000
+)
+
+// admin actions recorded in the audit log.
+const (
+	AdminActionRetry   = "retry"
+	AdminActionRefund  = "refund"
+	AdminActionResolve = "resolve"
+	AdminActionUnlock  = "unlock"
+	AdminActionPause   = "pause"
+	AdminActionResume  = "resume"
+)
+
+// AuditEntry records an admin action and its outcome.
+type AuditEntry struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	// Target is the transaction id or pause key the action was taken on.
+	Target     string `json:"target"`
+	Note       string `json:"note,omitempty"`
+	DryRun     bool   `json:"dryRun,omitempty"`
+	Error      string `json:"error,omitempty"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// AdminBridgeView is the view of a bridge operators get. Like BridgeView it never includes
+// the escrow key.
+type AdminBridgeView struct {
+	BridgeView
+	// List is the account watch request list the bridge is in.
+	List           string     `json:"list"`
+	SessionID      string     `json:"sessionID,omitempty"`
+	ClientID       string     `json:"clientID,omitempty"`
+	Locked         bool       `json:"locked"`
+	LockedBy       string     `json:"lockedBy,omitempty"`
+	LockedTime     *time.Time `json:"lockedTime,omitempty"`
+	GraceUntil     *time.Time `json:"graceUntil,omitempty"`
+	ResolutionNote string     `json:"resolutionNote,omitempty"`
+	ResolvedBy     string     `json:"resolvedBy,omitempty"`
+}
+
+func adminBridgeView(awr AccountWatchRequest, list string) AdminBridgeView {
+	return AdminBridgeView{
+		BridgeView:     bridgeView(awr),
+		List:           list,
+		SessionID:      awr.WSClientID,
+		ClientID:       awr.ClientID,
+		Locked:         awr.Locked,
+		LockedBy:       awr.LockedBy,
+		LockedTime:     optionalTime(awr.LockedTime),
+		GraceUntil:     optionalTime(awr.GraceUntil),
+		ResolutionNote: awr.ResolutionNote,
+		ResolvedBy:     awr.ResolvedBy,
+	}
+}
+
+// adminLists are the account watch request lists operators can act on, by the name they go
+// by in the admin API.
+var adminLists = []struct {
+	name, key string
+}{
+	{"active", "accountwatchrequests"},
+	{"held", heldAccountWatchRequests},
+	{"unconfirmed", unconfirmedAccountWatchRequests},
+	{"burns", burnAccountWatchRequests},
+	{"failed", "failedaccountwatchrequests"},
+	{"expired", "expiredaccountwatchrequests"},
+}
+
+// startAdminServer serves the admin API on port until ctx is done. It is meant to be reachable
+// only from inside the cluster and is not started without ADMIN_TOKENS.
+func (e *ExchangeServer) startAdminServer(ctx context.Context, port int) {
+	if len(e.adminTokens) == 0 {
+		e.logger.Info("ADMIN_TOKENS is not set, the admin api is disabled")
+		return
+	}
+
+	router := mux.NewRouter()
+	admin := router.PathPrefix("/admin/v1").Subrouter()
+	admin.Use(e.adminAuth)
+	admin.HandleFunc("/bridges", e.handleAdminListBridges).Methods(http.MethodGet)
+	admin.HandleFunc("/bridges/{id}", e.handleAdminGetBridge).Methods(http.MethodGet)
+	admin.HandleFunc("/bridges/{id}/retry", e.handleAdminRetry).Methods(http.MethodPost)
+	admin.HandleFunc("/bridges/{id}/refund", e.handleAdminRefund).Methods(http.MethodPost)
+	admin.HandleFunc("/bridges/{id}/resolve", e.handleAdminResolve).Methods(http.MethodPost)
+	admin.HandleFunc("/bridges/{id}/unlock", e.handleAdminUnlock).Methods(http.MethodPost)
+	admin.HandleFunc("/routes", e.handleAdminListRoutes).Methods(http.MethodGet)
+	admin.HandleFunc("/pauses", e.handleAdminListPauses).Methods(http.MethodGet)
+	admin.HandleFunc("/pauses/{scope}/pause", e.handleAdminPause).Methods(http.MethodPost)
+	admin.HandleFunc("/pauses/{scope}/resume", e.handleAdminResume).Methods(http.MethodPost)
+	admin.HandleFunc("/reserves", e.handleAdminReserves).Methods(http.MethodGet)
+	admin.HandleFunc("/audit", e.handleAdminAudit).Methods(http.MethodGet)
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: router}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	e.logger.Infof("serving the admin api on %d", port)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		e.logger.Errorw("admin api stopped", "error", err)
+	}
+}
+
+type adminActorKey struct{}
+
+// adminAuth checks the bearer token of admin requests against ADMIN_TOKENS and records the
+// operator it belongs to for the audit log.
+func (e *ExchangeServer) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var actor string
+		for name, t := range e.adminTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				actor = name
+			}
+		}
+		if token == "" || actor == "" {
+			e.writeAPIError(w, protocolErrorf(ErrCodeUnauthorized, "", "an admin token is required"))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor)))
+	})
+}
+
+// parseAdminTokens parses ADMIN_TOKENS, a comma separated list of "operator=token" pairs.
+func parseAdminTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || len(kv[1]) < 16 {
+			return nil, fmt.Errorf("invalid admin token for %q, expected operator=token with a token of at least 16 characters", kv[0])
+		}
+		tokens[kv[0]] = kv[1]
+	}
+	return tokens, nil
+}
+
+// audit records an admin action. Failures to write the log are logged, the log itself is
+// also mirrored to the application log.
+func (e *ExchangeServer) audit(r *http.Request, action, target, note string, dryRun bool, actionErr error) {
+	entry := AuditEntry{
+		ID:         uuid.New().String(),
+		Time:       time.Now(),
+		Actor:      r.Context().Value(adminActorKey{}).(string),
+		Action:     action,
+		Target:     target,
+		Note:       note,
+		DryRun:     dryRun,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if actionErr != nil {
+		entry.Error = actionErr.Error()
+	}
+	e.logger.Infow("admin action", "actor", entry.Actor, "action", action, "target", target, "note", note, "dryRun", dryRun, "error", entry.Error)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		e.logger.Errorw("failed to encode audit entry", "error", err)
+		return
+	}
+	pipe := e.redisClient.TxPipeline()
+	pipe.LPush(context.Background(), adminAuditLog, data)
+	pipe.LTrim(context.Background(), adminAuditLog, 0, maxAdminAuditLog-1)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		e.logger.Errorw("failed to write audit entry", "action", action, "target", target, "error", err)
+	}
+}
+
+// findAdminBridge looks a bridge up in the lists operators can act on. It returns the list it
+// is in, or nil if it is in none of them.
+func (e *ExchangeServer) findAdminBridge(txid string) (*AccountWatchRequest, string, error) {
+	for _, list := range adminLists {
+		requests, err := e.retrieveAccountWatchRequestList(list.key)
+		if err != nil {
+			return nil, "", err
+		}
+		for i := range requests {
+			if requests[i].TransactionID == txid {
+				return &requests[i], list.name, nil
+			}
+		}
+	}
+	return nil, "", nil
+}
+
+// closedAs returns "refunded" or "resolved" if the bridge with txid was refunded or resolved,
+// and "" otherwise.
+func (e *ExchangeServer) closedAs(txid string) (string, error) {
+	for _, list := range []struct{ name, key string }{{"refunded", "refundedaccountwatchrequests"}, {"resolved", "resolvedaccountwatchrequests"}} {
+		requests, err := e.retrieveAccountWatchRequestList(list.key)
+		if err != nil {
+			return "", err
+		}
+		for _, awr := range requests {
+			if awr.TransactionID == txid {
+				return list.name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// adminBridge looks up the bridge of an admin request and writes an error if it can not be
+// acted on. lists limits the lists it may be in.
+func (e *ExchangeServer) adminBridge(w http.ResponseWriter, r *http.Request, lists ...string) (*AccountWatchRequest, string, bool) {
+	txid := mux.Vars(r)["id"]
+	awr, list, err := e.findAdminBridge(txid)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve bridge", "txid", txid, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the bridge"))
+		return nil, "", false
+	}
+	if awr == nil {
+		e.writeAPIError(w, protocolErrorf(ErrCodeBridgeNotFound, "id", "no active, held, unconfirmed, failed or expired bridge with id %s", txid))
+		return nil, "", false
+	}
+	if len(lists) > 0 && !containsString(lists, list) {
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "id", "the bridge is %s, this action applies to %s bridges", list, strings.Join(lists, " or ")))
+		return nil, "", false
+	}
+	return awr, list, true
+}
+
+// adminRequest is the body of admin actions.
+type adminRequest struct {
+	Note string `json:"note,omitempty"`
+	// RefundAddress overrides the refund address of a forced refund.
+	RefundAddress string `json:"refundAddress,omitempty"`
+	// Target is the route key, chain or currency of a pause.
+	Target string `json:"target,omitempty"`
+	// Force retries a settlement even if the escrow does not hold the deposit, and retries or
+	// refunds an unconfirmed bridge.
+	Force bool `json:"force,omitempty"`
+}
+
+// decodeAdminRequest decodes the optional body of an admin action. ?dryRun=true validates the
+// action and reports what it would do without doing it.
+func decodeAdminRequest(r *http.Request) (adminRequest, bool, *ProtocolError) {
+	var req adminRequest
+	if r.ContentLength != 0 {
+		if perr := decodeAPIRequest(r, &req); perr != nil {
+			return req, false, perr
+		}
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return req, dryRun, nil
+}
+
+// AdminActionResult is the reply to an admin action.
+type AdminActionResult struct {
+	Action string `json:"action"`
+	DryRun bool   `json:"dryRun,omitempty"`
+	// Message describes what was, or would be, done.
+	Message string           `json:"message"`
+	Bridge  *AdminBridgeView `json:"bridge,omitempty"`
+	Pause   *Pause           `json:"pause,omitempty"`
+}
+
+// handleAdminListBridges lists the bridges of ?list=failed (the default), active, held,
+// unconfirmed, expired or stuck. Stuck bridges are active ones whose deadline passed more than STUCK_AFTER ago.
+func (e *ExchangeServer) handleAdminListBridges(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("list")
+	if name == "" {
+		name = "failed"
+	}
+
+	key := ""
+	for _, list := range adminLists {
+		if list.name == name || (name == "stuck" && list.name == "active") {
+			key = list.key
+		}
+	}
+	if key == "" {
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "list", "list must be one of active, held, unconfirmed, burns, failed, expired or stuck"))
+		return
+	}
+
+	requests, err := e.retrieveAccountWatchRequestList(key)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve bridges", "list", name, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the bridges"))
+		return
+	}
+
+	views := make([]AdminBridgeView, 0, len(requests))
+	for _, awr := range requests {
+		if name == "stuck" && !e.isStuck(awr) {
+			continue
+		}
+		list := name
+		if name == "stuck" {
+			list = "active"
+		}
+		views = append(views, adminBridgeView(awr, list))
+	}
+	e.writeJSON(w, http.StatusOK, views)
+}
+
+// isStuck reports whether an active request is past its deadline by more than STUCK_AFTER,
+// which a watch that is still running would have handled. Requests stored without a deadline
+// use the payment window from their creation, like the watch does.
+func (e *ExchangeServer) isStuck(awr AccountWatchRequest) bool {
+	if awr.TimeOut == 0 && awr.CreatedTime.IsZero() {
+		return false
+	}
+	return time.Since(e.deadline(awr)) > e.stuckAfter
+}
+
+func (e *ExchangeServer) handleAdminGetBridge(w http.ResponseWriter, r *http.Request) {
+	awr, list, ok := e.adminBridge(w, r)
+	if !ok {
+		return
+	}
+	view := adminBridgeView(*awr, list)
+	e.writeJSON(w, http.StatusOK, view)
+}
+
+// handleAdminRetry settles a failed or unconfirmed bridge again. Unless forced, the escrow
+// must still hold the deposit, so that a bridge that was in fact settled is not minted twice.
+// Unconfirmed bridges are only retried when forced, once the operator checked that their
+// settlement was not delivered.
+func (e *ExchangeServer) handleAdminRetry(w http.ResponseWriter, r *http.Request) {
+	req, dryRun, perr := decodeAdminRequest(r)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	awr, list, ok := e.adminBridge(w, r, "failed", "unconfirmed")
+	if !ok {
+		return
+	}
+	if list == "unconfirmed" && !req.Force {
+		err := fmt.Errorf("the settlement of the bridge may have been delivered, check it and use force to retry")
+		e.audit(r, AdminActionRetry, awr.TransactionID, req.Note, dryRun, err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "force", err.Error()))
+		return
+	}
+	listKey := "failedaccountwatchrequests"
+	if list == "unconfirmed" {
+		listKey = unconfirmedAccountWatchRequests
+	}
+
+	if !req.Force {
+		balance, err := e.depositBalance(r.Context(), *awr)
+		if err != nil {
+			e.audit(r, AdminActionRetry, awr.TransactionID, req.Note, dryRun, err)
+			e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to read the escrow balance: %s", err.Error()))
+			return
+		}
+		if balance.Cmp(awr.Amount) < 0 {
+			err := fmt.Errorf("the escrow holds %s of %s, use force to retry anyway", balance.String(), awr.Amount.String())
+			e.audit(r, AdminActionRetry, awr.TransactionID, req.Note, dryRun, err)
+			e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "force", err.Error()))
+			return
+		}
+	}
+
+	result := AdminActionResult{Action: AdminActionRetry, DryRun: dryRun, Message: "the settlement would be retried"}
+	if !dryRun {
+		if err := e.removeAccountWatchRequestFromList(listKey, awr.TransactionID); err != nil {
+			e.audit(r, AdminActionRetry, awr.TransactionID, req.Note, dryRun, err)
+			e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to update the %s bridges", list))
+			return
+		}
+		awr.State = BridgeStatePending
+		awr.FailureReason = ""
+		awr.SettlementTxHash = ""
+		// Dispatch fails the bridge again, and stores it as failed, if the settlement fails.
+		err := e.Dispatch(&AccountWatchRequestResult{AccountWatchRequest: *awr, Result: "success"})
+		e.audit(r, AdminActionRetry, awr.TransactionID, req.Note, dryRun, err)
+		if err != nil {
+			e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "the settlement failed again: %s", err.Error()))
+			return
+		}
+		awr.State = BridgeStateSettled
+		result.Message = "the bridge has been settled"
+	} else {
+		e.audit(r, AdminActionRetry, awr.TransactionID, req.Note, dryRun, nil)
+	}
+	view := adminBridgeView(*awr, list)
+	result.Bridge = &view
+	e.writeJSON(w, http.StatusOK, result)
+}
+
+// handleAdminRefund refunds the escrow of a bridge to its refund address, or the refundAddress
+// of the request. Like retries, unconfirmed bridges are only refunded when forced.
+func (e *ExchangeServer) handleAdminRefund(w http.ResponseWriter, r *http.Request) {
+	req, dryRun, perr := decodeAdminRequest(r)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	awr, list, ok := e.adminBridge(w, r)
+	if !ok {
+		return
+	}
+	if list == "burns" {
+		// the bridge was settled, the escrow holds the deposit it owes to the burn.
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "id", "the bridge is settled and its deposit is waiting to be burned, it can not be refunded"))
+		return
+	}
+	// a bridge can be left in another list when removing it failed after it was refunded or
+	// resolved, refunding it again would pay its deposit twice.
+	closed, err := e.closedAs(awr.TransactionID)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve bridge", "txid", awr.TransactionID, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the bridge"))
+		return
+	}
+	if closed != "" {
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "id", "the bridge has already been %s, it can not be refunded", closed))
+		return
+	}
+	if list == "unconfirmed" && !req.Force {
+		// the settlement may have been delivered while the escrow still holds the deposit.
+		err := fmt.Errorf("the settlement of the bridge may have been delivered, check it and use force to refund")
+		e.audit(r, AdminActionRefund, awr.TransactionID, req.Note, dryRun, err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "force", err.Error()))
+		return
+	}
+
+	if req.RefundAddress != "" {
+		if err := validateAddress(awr.Chain, req.RefundAddress); err != nil {
+			e.writeAPIError(w, protocolErrorf(ErrCodeInvalidAddress, "refundAddress", "refund address %s", err.Error()))
+			return
+		}
+		awr.AssistedSellOrderInformation.SellerRefundAddress = req.RefundAddress
+	}
+	if awr.AssistedSellOrderInformation.SellerRefundAddress == "" {
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidAddress, "refundAddress", "the bridge has no refund address, pass one"))
+		return
+	}
+
+	result := AdminActionResult{
+		Action:  AdminActionRefund,
+		DryRun:  dryRun,
+		Message: "the escrow would be refunded to " + awr.AssistedSellOrderInformation.SellerRefundAddress,
+	}
+	if !dryRun {
+		err := e.refundAccountWatchRequest(awr)
+		e.audit(r, AdminActionRefund, awr.TransactionID, req.Note, dryRun, err)
+		if err != nil {
+			e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "the refund failed: %s", err.Error()))
+			return
+		}
+		// refundAccountWatchRequest only removes the request from the active list.
+		for _, key := range []string{heldAccountWatchRequests, unconfirmedAccountWatchRequests, "failedaccountwatchrequests", "expiredaccountwatchrequests"} {
+			if err := e.removeAccountWatchRequestFromList(key, awr.TransactionID); err != nil {
+				e.bridgeLogger(*awr).Errorw("failed to remove refunded bridge", "list", key, "error", err)
+			}
+		}
+		result.Message = "the escrow has been refunded to " + awr.AssistedSellOrderInformation.SellerRefundAddress
+		list = "refunded"
+	} else {
+		e.audit(r, AdminActionRefund, awr.TransactionID, req.Note, dryRun, nil)
+	}
+	view := adminBridgeView(*awr, list)
+	result.Bridge = &view
+	e.writeJSON(w, http.StatusOK, result)
+}
+
+// handleAdminResolve marks a bridge that was dealt with outside of the bridge as resolved and
+// stops tracking it. A note saying how it was resolved is required.
+func (e *ExchangeServer) handleAdminResolve(w http.ResponseWriter, r *http.Request) {
+	req, dryRun, perr := decodeAdminRequest(r)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	if strings.TrimSpace(req.Note) == "" {
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "note", "a note saying how the bridge was resolved is required"))
+		return
+	}
+	awr, list, ok := e.adminBridge(w, r)
+	if !ok {
+		return
+	}
+
+	awr.State = BridgeStateResolved
+	awr.ResolutionNote = req.Note
+	awr.ResolvedBy = r.Context().Value(adminActorKey{}).(string)
+	awr.ResolvedTime = time.Now()
+	result := AdminActionResult{Action: AdminActionResolve, DryRun: dryRun, Message: "the bridge would be marked resolved"}
+	if !dryRun {
+		err := e.storeResolvedAccountWatchRequest(*awr)
+		if err == nil {
+			for _, l := range adminLists {
+				if err = e.removeAccountWatchRequestFromList(l.key, awr.TransactionID); err != nil {
+					break
+				}
+			}
+		}
+		e.audit(r, AdminActionResolve, awr.TransactionID, req.Note, dryRun, err)
+		if err != nil {
+			e.bridgeLogger(*awr).Errorw("failed to resolve bridge", "error", err)
+			e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to resolve the bridge"))
+			return
+		}
+		e.publishStatus(*awr, BridgeStateResolved, "The bridge has been resolved by support")
+		result.Message = "the bridge has been marked resolved"
+		list = "resolved"
+	} else {
+		e.audit(r, AdminActionResolve, awr.TransactionID, req.Note, dryRun, nil)
+	}
+	view := adminBridgeView(*awr, list)
+	result.Bridge = &view
+	e.writeJSON(w, http.StatusOK, result)
+}
+
+// handleAdminUnlock releases the lease a pod holds on an active bridge so that the next pod
+// to poll picks its watch up. Only unlock bridges whose pod is gone, or they are watched twice.
+func (e *ExchangeServer) handleAdminUnlock(w http.ResponseWriter, r *http.Request) {
+	req, dryRun, perr := decodeAdminRequest(r)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	awr, list, ok := e.adminBridge(w, r, "active")
+	if !ok {
+		return
+	}
+	if !awr.Locked {
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "id", "the bridge is not locked"))
+		return
+	}
+
+	result := AdminActionResult{Action: AdminActionUnlock, DryRun: dryRun, Message: "the lease of " + awr.LockedBy + " would be released"}
+	if !dryRun {
+		lockedBy := awr.LockedBy
+		awr.Locked = false
+		awr.LockedBy = ""
+		awr.LockedTime = time.Time{}
+		err := e.updateAccountWatchRequestInDB(*awr)
+		e.audit(r, AdminActionUnlock, awr.TransactionID, req.Note, dryRun, err)
+		if err != nil {
+			e.bridgeLogger(*awr).Errorw("failed to unlock bridge", "error", err)
+			e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to unlock the bridge"))
+			return
+		}
+		result.Message = "the lease of " + lockedBy + " has been released"
+	} else {
+		e.audit(r, AdminActionUnlock, awr.TransactionID, req.Note, dryRun, nil)
+	}
+	view := adminBridgeView(*awr, list)
+	result.Bridge = &view
+	e.writeJSON(w, http.StatusOK, result)
+}
+
+// AdminRouteView is a supported route and the kill switch that pauses it, if any.
+type AdminRouteView struct {
+	Route
+	Paused *Pause `json:"paused,omitempty"`
+}
+
+func (e *ExchangeServer) handleAdminListRoutes(w http.ResponseWriter, r *http.Request) {
+	views := make([]AdminRouteView, 0, len(supportedRoutes))
+	for _, route := range supportedRoutes {
+		pause, err := e.pauseOf(r.Context(), route)
+		if err != nil {
+			e.logger.Errorw("failed to check whether the route is paused", "route", route.Key(), "error", err)
+			e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the routes"))
+			return
+		}
+		views = append(views, AdminRouteView{Route: route, Paused: pause})
+	}
+	e.writeJSON(w, http.StatusOK, views)
+}
+
+func (e *ExchangeServer) handleAdminListPauses(w http.ResponseWriter, r *http.Request) {
+	pauses, err := e.pauses(r.Context())
+	if err != nil {
+		e.logger.Errorw("failed to retrieve pauses", "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the pauses"))
+		return
+	}
+	e.writeJSON(w, http.StatusOK, pauses)
+}
+
+// handleAdminPause turns on the kill switch of a scope and target. Quotes and bridges over the
+// routes it covers are refused, and the deposits of their pending bridges are held until it
+// is turned off. Refunds and status updates carry on.
+func (e *ExchangeServer) handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	req, dryRun, perr := decodeAdminRequest(r)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	scope := mux.Vars(r)["scope"]
+	if err := validatePause(scope, req.Target); err != nil {
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "target", err.Error()))
+		return
+	}
+
+	pause := Pause{Scope: scope, Target: req.Target, Note: req.Note, PausedBy: r.Context().Value(adminActorKey{}).(string), PausedTime: time.Now()}
+	result := AdminActionResult{Action: AdminActionPause, DryRun: dryRun, Message: pause.Key() + " would be paused", Pause: &pause}
+	var err error
+	if !dryRun {
+		var data []byte
+		if data, err = json.Marshal(pause); err == nil {
+			err = e.redisClient.HSet(r.Context(), pausesKey, pause.Key(), data).Err()
+		}
+		result.Message = pause.Key() + " has been paused"
+	}
+	e.audit(r, AdminActionPause, pause.Key(), req.Note, dryRun, err)
+	if err != nil {
+		e.logger.Errorw("failed to pause", "pause", pause.Key(), "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to pause %s", pause.Key()))
+		return
+	}
+	e.writeJSON(w, http.StatusOK, result)
+}
+
+// handleAdminResume turns off the kill switch of a scope and target. Held deposits of routes
+// no other switch pauses are settled on the next tick of the scheduler.
+func (e *ExchangeServer) handleAdminResume(w http.ResponseWriter, r *http.Request) {
+	req, dryRun, perr := decodeAdminRequest(r)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	scope := mux.Vars(r)["scope"]
+	if err := validatePause(scope, req.Target); err != nil {
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "target", err.Error()))
+		return
+	}
+
+	key := pauseKey(scope, req.Target)
+	result := AdminActionResult{Action: AdminActionResume, DryRun: dryRun, Message: key + " would be resumed"}
+	var err error
+	if !dryRun {
+		err = e.redisClient.HDel(r.Context(), pausesKey, key).Err()
+		result.Message = key + " has been resumed"
+	}
+	e.audit(r, AdminActionResume, key, req.Note, dryRun, err)
+	if err != nil {
+		e.logger.Errorw("failed to resume", "pause", key, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to resume %s", key))
+		return
+	}
+	e.writeJSON(w, http.StatusOK, result)
+}
+
+// Reserve is what a route is holding in escrow and how much more it can mint.
+type Reserve struct {
+	Route
+	// Pending is the amount of the bridges of the route waiting for their deposit.
+	Pending      *big.Int `json:"pending"`
+	PendingCount int      `json:"pendingCount"`
+	// Capacity is nil for routes that release native assets rather than mint.
+	Capacity *MintCapacity `json:"capacity,omitempty"`
+	// Error is why the capacity could not be read.
+	Error string `json:"error,omitempty"`
+}
+
+// handleAdminReserves returns the reserves of every supported route.
+func (e *ExchangeServer) handleAdminReserves(w http.ResponseWriter, r *http.Request) {
+	watching, err := e.retrieveAccountWatchRequestsFromDB()
+	if err != nil {
+		e.logger.Errorw("failed to retrieve account watch requests", "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the bridges"))
+		return
+	}
+
+	reserves := make([]Reserve, 0, len(supportedRoutes))
+	for _, route := range supportedRoutes {
+		reserve := Reserve{Route: route, Pending: big.NewInt(0)}
+		for _, awr := range watching {
+			if routeOf(awr) == route && awr.Amount != nil {
+				reserve.Pending.Add(reserve.Pending, awr.Amount)
+				reserve.PendingCount++
+			}
+		}
+		if reserve.Capacity, err = e.mintCapacity(r.Context(), route.Currency, route.BridgeTo); err != nil {
+			reserve.Error = err.Error()
+		}
+		reserves = append(reserves, reserve)
+	}
+	e.writeJSON(w, http.StatusOK, reserves)
+}
+
+// handleAdminAudit returns the audit log, newest first, ?limit= entries at a time from ?offset=.
+func (e *ExchangeServer) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	limit, offset := 100, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "limit", "limit must be between 1 and 1000"))
+			return
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "offset", "offset must be a positive number"))
+			return
+		}
+		offset = n
+	}
+
+	entries, err := e.redisClient.LRange(r.Context(), adminAuditLog, int64(offset), int64(offset+limit-1)).Result()
+	if err != nil && err != redis.Nil {
+		e.logger.Errorw("failed to retrieve the audit log", "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the audit log"))
+		return
+	}
+	log := make([]AuditEntry, 0, len(entries))
+	for _, data := range entries {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			e.logger.Errorw("failed to decode audit entry", "error", err)
+			continue
+		}
+		log = append(log, entry)
+	}
+	e.writeJSON(w, http.StatusOK, log)
+}
@@ -0,0 +1,87 @@
+package be
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAdminRefund(t *testing.T) {
+	e, _ := newTestServer(t)
+	ctx := context.Background()
+	lists := map[string][]string{
+		"failedaccountwatchrequests":    {"failed", "refunded", "resolved"},
+		unconfirmedAccountWatchRequests: {"unconfirmed"},
+		"refundedaccountwatchrequests":  {"refunded"},
+		"resolvedaccountwatchrequests":  {"resolved"},
+	}
+	for key, txids := range lists {
+		var requests []AccountWatchRequest
+		for _, txid := range txids {
+			requests = append(requests, testBridge(txid))
+		}
+		if err := e.storeAccountWatchRequestList(ctx, key, requests); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.queueBurn(testBridge("burn"), errors.New("insufficient funds"))
+
+	tests := []struct {
+		name   string
+		txid   string
+		body   string
+		dryRun bool
+		want   int
+	}{
+		{"failed", "failed", "", true, http.StatusOK},
+		{"refunded", "refunded", "", true, http.StatusBadRequest},
+		{"resolved", "resolved", `{"force":true}`, true, http.StatusBadRequest},
+		{"waiting to be burned", "burn", "", true, http.StatusBadRequest},
+		{"unconfirmed", "unconfirmed", "", true, http.StatusBadRequest},
+		{"unconfirmed with force", "unconfirmed", `{"force":true}`, true, http.StatusOK},
+		// no node is connected, so the refund is attempted and fails.
+		{"unconfirmed with force for real", "unconfirmed", `{"force":true}`, false, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/bridges/" + tt.txid + "/refund"
+			if tt.dryRun {
+				target += "?dryRun=true"
+			}
+			r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"id": tt.txid})
+			r = r.WithContext(context.WithValue(r.Context(), adminActorKey{}, "ops"))
+			w := httptest.NewRecorder()
+			e.handleAdminRefund(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// refusing to refund an unconfirmed bridge without force is audited.
+	entries, err := e.redisClient.LRange(ctx, adminAuditLog, 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := false
+	for _, data := range entries {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Target == "unconfirmed" && strings.Contains(entry.Error, "use force") {
+			refused = true
+		}
+	}
+	if !refused {
+		t.Errorf("the refused refund of the unconfirmed bridge was not audited: %v", entries)
+	}
+	assertList(t, e, unconfirmedAccountWatchRequests, "unconfirmed")
+}
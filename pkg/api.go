@@ -0,0 +1,227 @@
+package be
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxRequestBodySize limits the size of HTTP API request bodies.
+const maxRequestBodySize = 64 * 1024
+
+// RouteInfo describes a supported route and the terms of bridging over it.
+type RouteInfo struct {
+	Route
+	// PaymentWindow is how many seconds the client has to make the deposit.
+	PaymentWindow int64 `json:"paymentWindow"`
+	Fee           int   `json:"fee"`
+	MinimumAmount int   `json:"minimumAmount"`
+}
+
+// registerAPIRoutes adds the HTTP API to the router. It mirrors the WebSocket flow: quote,
+// create a bridge, confirm it and follow it, and returns the same payloads.
+func (e *ExchangeServer) registerAPIRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.Use(traced)
+	api.HandleFunc("/routes", e.withAuth(ScopeRead, e.handleAPIRoutes)).Methods(http.MethodGet)
+	api.HandleFunc("/quote", e.withAuth(ScopeQuote, e.withLimit(&e.quoteLimit, RejectQuoteRate, e.handleAPIQuote))).Methods(http.MethodPost)
+	api.HandleFunc("/bridges", e.withAuth(ScopeRead, e.handleAPIListBridges)).Methods(http.MethodGet)
+	api.HandleFunc("/bridges", e.withAuth(ScopeBridge, e.withLimit(&e.quoteLimit, RejectQuoteRate, e.handleAPICreateBridge))).Methods(http.MethodPost)
+	api.HandleFunc("/bridges/{id}/confirm", e.withAuth(ScopeBridge, e.withLimit(&e.bridgeLimit, RejectBridgeRate, e.handleAPIConfirmBridge))).Methods(http.MethodPost)
+	api.HandleFunc("/bridges/{id}", e.withAuth(ScopeRead, e.handleAPIGetBridge)).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks", e.withAuth(ScopeWebhooks, e.handleAPICreateWebhook)).Methods(http.MethodPost)
+	api.HandleFunc("/webhooks", e.withAuth(ScopeWebhooks, e.handleAPIListWebhooks)).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks/deliveries", e.withAuth(ScopeWebhooks, e.handleAPIListWebhookDeliveries)).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks/deliveries/{id}/redeliver", e.withAuth(ScopeWebhooks, e.handleAPIRedeliverWebhook)).Methods(http.MethodPost)
+	api.HandleFunc("/webhooks/{id}", e.withAuth(ScopeWebhooks, e.handleAPIDeleteWebhook)).Methods(http.MethodDelete)
+}
+
+func (e *ExchangeServer) handleAPIRoutes(w http.ResponseWriter, r *http.Request) {
+	routes := make([]RouteInfo, 0, len(supportedRoutes))
+	for _, route := range supportedRoutes {
+		routes = append(routes, RouteInfo{
+			Route:         route,
+			PaymentWindow: int64(e.paymentWindow(route) / time.Second),
+			Fee:           e.fee,
+			MinimumAmount: e.minimumAmount,
+		})
+	}
+	e.writeJSON(w, http.StatusOK, routes)
+}
+
+func (e *ExchangeServer) handleAPIQuote(w http.ResponseWriter, r *http.Request) {
+	var req BridgeRequest
+	if perr := decodeAPIRequest(r, &req); perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	if perr := principalFrom(r.Context()).authorizeRoute(req); perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	resp, perr := e.quoteBridge(r.Context(), req)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	e.writeJSON(w, http.StatusOK, resp)
+}
+
+func (e *ExchangeServer) handleAPICreateBridge(w http.ResponseWriter, r *http.Request) {
+	principal := principalFrom(r.Context())
+	var req BridgeRequest
+	if perr := decodeAPIRequest(r, &req); perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	if perr := principal.authorizeRoute(req); perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+
+	acc := e.generateEVMAccount(req.Currency)
+	resp, perr := e.prepareBridge(r.Context(), &req, acc)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+
+	pb := PendingBridge{
+		ID:          uuid.New().String(),
+		ClientID:    principal.ClientID,
+		Request:     req,
+		PrivateKey:  hexKey(acc),
+		CreatedTime: time.Now(),
+	}
+	if err := e.storePendingBridge(pb); err != nil {
+		e.logger.Errorw("failed to store pending bridge", "sid", pb.ID, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to store the bridge, please try again"))
+		return
+	}
+
+	resp.BridgeID = pb.ID
+	e.logger.Infow("requestBridgeResponse", "sid", pb.ID, "data", resp)
+	e.writeJSON(w, http.StatusCreated, resp)
+}
+
+func (e *ExchangeServer) handleAPIConfirmBridge(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	pb, err := e.takePendingBridge(id, principalFrom(r.Context()).ClientID)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve pending bridge", "sid", id, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the bridge"))
+		return
+	}
+	if pb == nil {
+		e.writeAPIError(w, protocolErrorf(ErrCodeNoPendingBridge, "id", "no unconfirmed bridge with id %s, it may have expired or been confirmed already", id))
+		return
+	}
+
+	acc, err := escrowKey(pb.PrivateKey)
+	if err != nil {
+		e.logger.Errorw("failed to parse escrow key of pending bridge", "sid", id, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to confirm the bridge"))
+		return
+	}
+
+	// the pending bridge id doubles as the session id, so status updates can be followed
+	// over a WebSocket with ?id=<bridgeID>.
+	awr, perr := e.startBridge(r.Context(), pb.Request, acc, pb.ID, pb.ClientID)
+	if perr != nil {
+		// put the bridge back so that the client can retry the confirmation.
+		if err := e.storePendingBridge(*pb); err != nil {
+			e.logger.Errorw("failed to restore pending bridge", "sid", id, "error", err)
+		}
+		e.writeAPIError(w, perr)
+		return
+	}
+	e.publishStatus(awr, BridgeStatePending, "Waiting for the deposit")
+	e.writeJSON(w, http.StatusOK, confirmBridgeResponse(awr))
+}
+
+func (e *ExchangeServer) handleAPIGetBridge(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	// the id may be the transaction id or the id the bridge was created with.
+	txid := id
+	if txids, err := e.sessionBridges(id); err == nil && len(txids) == 1 {
+		txid = txids[0]
+	}
+
+	// bridges of other clients are not found.
+	owner, err := e.bridgeClient(r.Context(), txid)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve the client of the bridge", "txid", txid, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the bridge"))
+		return
+	}
+	if owner != principalFrom(r.Context()).ClientID {
+		e.writeAPIError(w, protocolErrorf(ErrCodeBridgeNotFound, "id", "bridge not found"))
+		return
+	}
+
+	view, err := e.getBridge(r.Context(), txid)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve bridge", "txid", txid, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the bridge"))
+		return
+	}
+	if view == nil {
+		e.writeAPIError(w, protocolErrorf(ErrCodeBridgeNotFound, "id", "bridge not found"))
+		return
+	}
+	e.writeJSON(w, http.StatusOK, view)
+}
+
+// decodeAPIRequest strictly decodes a JSON request body into v.
+func decodeAPIRequest(r *http.Request, v interface{}) *ProtocolError {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return protocolErrorf(ErrCodeInvalidMessage, "", "request body is not valid: %s", err.Error())
+	}
+	return nil
+}
+
+// apiStatus maps an error code to the HTTP status it is returned with.
+func apiStatus(code string) int {
+	switch code {
+	case ErrCodeUnauthorized:
+		return http.StatusUnauthorized
+	case ErrCodeForbidden, ErrCodeAddressRejected:
+		return http.StatusForbidden
+	case ErrCodeRateLimited, ErrCodePendingLimit:
+		return http.StatusTooManyRequests
+	case ErrCodeBridgeNotFound, ErrCodeNoPendingBridge, ErrCodeNotFound:
+		return http.StatusNotFound
+	case ErrCodeCapacityExceeded:
+		return http.StatusConflict
+	case ErrCodeRoutePaused:
+		return http.StatusServiceUnavailable
+	case ErrCodeInternal:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// writeAPIError writes an ErrorMsg, the same payload the WebSocket flow replies with.
+func (e *ExchangeServer) writeAPIError(w http.ResponseWriter, perr *ProtocolError) {
+	e.writeJSON(w, apiStatus(perr.Code), ErrorMsg{
+		Type:    "error",
+		Version: ProtocolVersion,
+		Code:    perr.Code,
+		Message: perr.Message,
+		Field:   perr.Field,
+	})
+}
+
+func (e *ExchangeServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		e.logger.Errorw("failed to write response", "error", err)
+	}
+}
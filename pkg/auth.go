@@ -0,0 +1,547 @@
+package be
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/gorilla/websocket"
+)
+
+// Scopes an API key or token can be granted.
+const (
+	// ScopeQuote allows quotes.
+	ScopeQuote = "quote"
+	// ScopeBridge allows creating and confirming bridges.
+	ScopeBridge = "bridge"
+	// ScopeRead allows reading bridges and routes and following bridges.
+	ScopeRead = "read"
+	// ScopeWebhooks allows managing webhooks. It needs a client id.
+	ScopeWebhooks = "webhooks"
+)
+
+// Scopes are all the scopes that can be granted.
+var Scopes = []string{ScopeQuote, ScopeBridge, ScopeRead, ScopeWebhooks}
+
+// apiKeyPrefix starts every API key, so that keys can be told apart from JWTs and found by
+// secret scanners.
+const apiKeyPrefix = "pbk_"
+
+// rateLimitWindow is the window rate limits are counted in.
+const rateLimitWindow = time.Minute
+
+// APIKey is an integrator key. Only a hash of its secret is stored.
+type APIKey struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ClientID string `json:"clientID"`
+	// Scopes the key is granted.
+	Scopes []string `json:"scopes"`
+	// Routes the key may bridge over, as route keys. All routes when empty.
+	Routes []string `json:"routes,omitempty"`
+	// RateLimit is the number of requests per minute, the API_KEY_RATE_LIMIT when 0.
+	RateLimit  int    `json:"rateLimit,omitempty"`
+	SecretHash string `json:"secretHash"`
+	// PreviousSecretHash keeps the secret a key had before it was rotated valid until
+	// PreviousValidUntil, so that clients can roll over.
+	PreviousSecretHash string    `json:"previousSecretHash,omitempty"`
+	PreviousValidUntil time.Time `json:"previousValidUntil,omitempty"`
+	CreatedTime        time.Time `json:"createdTime"`
+	RotatedTime        time.Time `json:"rotatedTime,omitempty"`
+	RevokedTime        time.Time `json:"revokedTime,omitempty"`
+}
+
+// Revoked reports whether the key has been revoked.
+func (k APIKey) Revoked() bool {
+	return !k.RevokedTime.IsZero()
+}
+
+// KeyStore manages API keys in Redis. It is shared by the server and the key management command.
+type KeyStore struct {
+	redisClient *redis.Client
+}
+
+// NewKeyStore returns a KeyStore backed by redisClient.
+func NewKeyStore(redisClient *redis.Client) *KeyStore {
+	return &KeyStore{redisClient: redisClient}
+}
+
+// ValidateKey checks the client id, scopes and routes of a key.
+func ValidateKey(clientID string, scopes, routes []string) error {
+	if !sessionIDPattern.MatchString(clientID) {
+		return fmt.Errorf("client id must be 1 to 64 letters, digits, dashes or underscores")
+	}
+	for _, scope := range scopes {
+		if !containsString(Scopes, scope) {
+			return fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	for _, route := range routes {
+		if !isSupportedRouteKey(route) {
+			return fmt.Errorf("unknown route %q, expected currency:fromChain:bridgeTo", route)
+		}
+	}
+	return nil
+}
+
+// Create adds a key and returns it with its token. The token is not stored and can not be
+// shown again.
+func (s *KeyStore) Create(ctx context.Context, name, clientID string, scopes, routes []string, rateLimit int) (APIKey, string, error) {
+	if err := ValidateKey(clientID, scopes, routes); err != nil {
+		return APIKey{}, "", err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := APIKey{
+		ID:          id,
+		Name:        name,
+		ClientID:    clientID,
+		Scopes:      scopes,
+		Routes:      routes,
+		RateLimit:   rateLimit,
+		SecretHash:  hashSecret(secret),
+		CreatedTime: time.Now(),
+	}
+	if err := s.put(ctx, key); err != nil {
+		return APIKey{}, "", err
+	}
+	return key, apiKeyPrefix + id + "_" + secret, nil
+}
+
+// Revoke disables a key.
+func (s *KeyStore) Revoke(ctx context.Context, id string) (APIKey, error) {
+	key, err := s.Get(ctx, id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.RevokedTime = time.Now()
+	return key, s.put(ctx, key)
+}
+
+// Rotate gives a key a new secret. The old secret keeps working for grace.
+func (s *KeyStore) Rotate(ctx context.Context, id string, grace time.Duration) (APIKey, string, error) {
+	key, err := s.Get(ctx, id)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	if key.Revoked() {
+		return APIKey{}, "", fmt.Errorf("key %s has been revoked", id)
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key.PreviousSecretHash = ""
+	key.PreviousValidUntil = time.Time{}
+	if grace > 0 {
+		key.PreviousSecretHash = key.SecretHash
+		key.PreviousValidUntil = time.Now().Add(grace)
+	}
+	key.SecretHash = hashSecret(secret)
+	key.RotatedTime = time.Now()
+	if err := s.put(ctx, key); err != nil {
+		return APIKey{}, "", err
+	}
+	return key, apiKeyPrefix + id + "_" + secret, nil
+}
+
+// Get returns a key by id.
+func (s *KeyStore) Get(ctx context.Context, id string) (APIKey, error) {
+	data, err := s.redisClient.HGet(ctx, "apikeys", id).Result()
+	if err == redis.Nil {
+		return APIKey{}, fmt.Errorf("key %s not found", id)
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	var key APIKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// List returns every key, including revoked ones.
+func (s *KeyStore) List(ctx context.Context) ([]APIKey, error) {
+	entries, err := s.redisClient.HGetAll(ctx, "apikeys").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	keys := make([]APIKey, 0, len(entries))
+	for _, entry := range entries {
+		var key APIKey
+		if err := json.Unmarshal([]byte(entry), &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Verify returns the key a token belongs to if the token is valid.
+func (s *KeyStore) Verify(ctx context.Context, token string) (*APIKey, error) {
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed api key")
+	}
+	key, err := s.Get(ctx, parts[0])
+	if err != nil {
+		return nil, errors.New("invalid api key")
+	}
+	if key.Revoked() {
+		return nil, errors.New("the api key has been revoked")
+	}
+
+	hash := hashSecret(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(key.SecretHash)) == 1 {
+		return &key, nil
+	}
+	if key.PreviousSecretHash != "" && time.Now().Before(key.PreviousValidUntil) &&
+		subtle.ConstantTimeCompare([]byte(hash), []byte(key.PreviousSecretHash)) == 1 {
+		return &key, nil
+	}
+	return nil, errors.New("invalid api key")
+}
+
+func (s *KeyStore) put(ctx context.Context, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.HSet(ctx, "apikeys", key.ID, data).Err()
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Principal is who a request is made by.
+type Principal struct {
+	// ClientID is the API client, empty for anonymous requests.
+	ClientID string
+	// KeyID is the API key the request was made with, if any.
+	KeyID     string
+	Scopes    []string
+	Routes    []string
+	RateLimit int
+	Anonymous bool
+}
+
+// can reports whether the principal was granted scope.
+func (p *Principal) can(scope string) bool {
+	return containsString(p.Scopes, scope)
+}
+
+// authorizeRoute checks that the principal may bridge over the route of req.
+func (p *Principal) authorizeRoute(req BridgeRequest) *ProtocolError {
+	if len(p.Routes) == 0 || containsString(p.Routes, routeOfRequest(req).Key()) {
+		return nil
+	}
+	return protocolErrorf(ErrCodeForbidden, "data", "bridging %s from %s to %s is not allowed for this client", req.Currency, req.FromChain, req.BridgeTo)
+}
+
+// rateLimitKey identifies the principal in rate limits. Anonymous requests are limited per
+// address, ip being the address the request came from.
+func (p *Principal) rateLimitKey(ip string) string {
+	if p.KeyID != "" {
+		return "key:" + p.KeyID
+	}
+	if p.ClientID != "" {
+		return "client:" + p.ClientID
+	}
+	return "ip:" + ip
+}
+
+type principalKey struct{}
+
+// principalFrom returns the principal authenticated by withAuth.
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// authenticate returns the principal of a request. Tokens are read from the Authorization
+// header as a bearer token, or the X-API-Key header. Browsers can not set headers on
+// WebSocket connections, so those may pass it as ?access_token= instead.
+func (e *ExchangeServer) authenticate(r *http.Request) (*Principal, *ProtocolError) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.Header.Get("X-API-Key")
+	}
+	if token == "" && websocket.IsWebSocketUpgrade(r) {
+		token = r.URL.Query().Get("access_token")
+	}
+
+	if token == "" {
+		if !e.anonymousAccess {
+			return nil, protocolErrorf(ErrCodeUnauthorized, "", "an api key or token is required")
+		}
+		return &Principal{Scopes: e.anonymousScopes, RateLimit: e.anonymousRateLimit, Anonymous: true}, nil
+	}
+
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		key, err := e.keys.Verify(r.Context(), token)
+		if err != nil {
+			return nil, protocolErrorf(ErrCodeUnauthorized, "", err.Error())
+		}
+		rateLimit := key.RateLimit
+		if rateLimit == 0 {
+			rateLimit = e.apiKeyRateLimit
+		}
+		return &Principal{ClientID: key.ClientID, KeyID: key.ID, Scopes: key.Scopes, Routes: key.Routes, RateLimit: rateLimit}, nil
+	}
+
+	p, err := e.verifyJWT(token)
+	if err != nil {
+		return nil, protocolErrorf(ErrCodeUnauthorized, "", err.Error())
+	}
+	return p, nil
+}
+
+// jwtClaims are the claims read from HS256 tokens issued by our back office.
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Routes    []string `json:"routes"`
+	RateLimit int      `json:"rate_limit"`
+}
+
+// verifyJWT verifies an HS256 JWT signed with JWT_SECRET. sub is the client id, scope a
+// space separated list of scopes and exp is required.
+func (e *ExchangeServer) verifyJWT(token string) (*Principal, error) {
+	if len(e.jwtSecret) == 0 {
+		return nil, errors.New("invalid api key")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errors.New("unsupported token, only HS256 is accepted")
+	}
+
+	mac := hmac.New(sha256.New, e.jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return nil, errors.New("the token has expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("the token is not valid yet")
+	}
+	if !sessionIDPattern.MatchString(claims.Subject) {
+		return nil, errors.New("the token subject must be a client id")
+	}
+
+	rateLimit := claims.RateLimit
+	if rateLimit == 0 {
+		rateLimit = e.apiKeyRateLimit
+	}
+	return &Principal{
+		ClientID:  claims.Subject,
+		Scopes:    strings.Fields(claims.Scope),
+		Routes:    claims.Routes,
+		RateLimit: rateLimit,
+	}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// allowRequest counts a request against the rate limit of the principal. The count is kept
+// in Redis so that the limit holds across pods.
+func (e *ExchangeServer) allowRequest(ctx context.Context, p *Principal, key string) *ProtocolError {
+	if p.RateLimit <= 0 {
+		return nil
+	}
+	window := time.Now().Unix() / int64(rateLimitWindow/time.Second)
+	redisKey := "ratelimit:" + key + ":" + strconv.FormatInt(window, 10)
+
+	pipe := e.redisClient.TxPipeline()
+	count := pipe.Incr(ctx, redisKey)
+	pipe.Expire(ctx, redisKey, 2*rateLimitWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// fail open, Redis being down should not take the API down with it.
+		e.logger.Errorw("failed to count request against the rate limit", "key", key, "error", err)
+		return nil
+	}
+	if count.Val() > int64(p.RateLimit) {
+		RejectionsInc(RejectRequestRate)
+		return protocolErrorf(ErrCodeRateLimited, "", "rate limit of %d requests per minute exceeded", p.RateLimit)
+	}
+	return nil
+}
+
+// withAuth authenticates a request, checks that it was granted scope and counts it against
+// the rate limit before calling next.
+func (e *ExchangeServer) withAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, perr := e.authenticate(r)
+		if perr == nil && !p.can(scope) {
+			perr = protocolErrorf(ErrCodeForbidden, "", "the %s scope is required", scope)
+		}
+		if perr == nil {
+			perr = e.allowRequest(r.Context(), p, p.rateLimitKey(e.remoteIP(r)))
+		}
+		if perr != nil {
+			e.writeAPIError(w, perr)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// checkOrigin enforces ALLOWED_ORIGINS on WebSocket upgrades. Requests without an Origin
+// header do not come from a browser and are allowed.
+func (e *ExchangeServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || e.originAllowed(origin)
+}
+
+func (e *ExchangeServer) originAllowed(origin string) bool {
+	return containsString(e.allowedOrigins, "*") || containsString(e.allowedOrigins, origin)
+}
+
+// cors adds the CORS headers for allowed origins and answers preflight requests.
+func (e *ExchangeServer) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && e.originAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remoteIP returns the address a request came from, without the port. Requests relayed by a
+// TRUSTED_PROXIES proxy, e.g. the ingress, come from the last address in TRUSTED_PROXY_HEADER
+// that is not a trusted proxy itself.
+func (e *ExchangeServer) remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !e.trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values(e.trustedProxyHeader), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// the header was mangled, anything left of here can not be trusted.
+			break
+		}
+		host = hop
+		if !e.trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedProxy reports whether ip is in TRUSTED_PROXIES.
+func (e *ExchangeServer) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range e.trustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a comma separated list of networks. Bare addresses are taken as networks
+// of one address.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range splitList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", item, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// splitList splits a comma separated configuration value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
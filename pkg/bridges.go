@@ -0,0 +1,318 @@
+package be
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+// pendingBridgeTTL is how long a bridge created over the HTTP API can wait to be confirmed.
+const pendingBridgeTTL = time.Hour
+
+// PendingBridge is a bridge that has been issued an escrow but not confirmed yet. The
+// WebSocket flow keeps it on the connection, the HTTP API stores it in Redis.
+type PendingBridge struct {
+	ID          string        `json:"id"`
+	ClientID    string        `json:"clientID,omitempty"`
+	Request     BridgeRequest `json:"request"`
+	PrivateKey  string        `json:"privateKey"`
+	CreatedTime time.Time     `json:"createdTime"`
+}
+
+// quoteBridge returns what a bridge would cost and the mint capacity of its route.
+func (e *ExchangeServer) quoteBridge(ctx context.Context, req BridgeRequest) (QuoteResponseMsg, *ProtocolError) {
+	if perr := validateQuote(req); perr != nil {
+		return QuoteResponseMsg{}, perr
+	}
+	if perr := e.checkRoutePaused(ctx, req); perr != nil {
+		return QuoteResponseMsg{}, perr
+	}
+	total := new(big.Int).Add(req.Amount, ToWei(e.fee, 18))
+	capacity, err := e.checkMintCapacity(ctx, req, total)
+	resp := QuoteResponseMsg{
+		Type:     "quoteResponse",
+		Version:  ProtocolVersion,
+		Amount:   total,
+		Fee:      ToWei(e.fee, 18),
+		Capacity: capacity,
+	}
+	if err != nil {
+		resp.Error = e.capacityError(req, "", err).Message
+	}
+	return resp, nil
+}
+
+// prepareBridge validates a bridge request and checks that its route can mint it. On success
+// req.Amount includes the fee, which is the amount the client has to deposit to acc.
+func (e *ExchangeServer) prepareBridge(ctx context.Context, req *BridgeRequest, acc *ecdsa.PrivateKey) (RequestBridgeResponseMsg, *ProtocolError) {
+	if perr := e.validateBridgeRequest(*req); perr != nil {
+		return RequestBridgeResponseMsg{}, perr
+	}
+	if perr := e.checkRoutePaused(ctx, *req); perr != nil {
+		return RequestBridgeResponseMsg{}, perr
+	}
+	if perr := e.screenBridgeRequest(ctx, *req); perr != nil {
+		return RequestBridgeResponseMsg{}, perr
+	}
+	if perr := e.checkPendingLimits(ctx, *req, ""); perr != nil {
+		return RequestBridgeResponseMsg{}, perr
+	}
+
+	// refuse to issue an escrow for an amount the destination contract will not mint.
+	total := new(big.Int).Add(req.Amount, ToWei(e.fee, 18))
+	capacity, err := e.checkMintCapacity(ctx, *req, total)
+	if err != nil {
+		return RequestBridgeResponseMsg{}, e.capacityError(*req, "data.amount", err)
+	}
+	req.Amount = total
+
+	return RequestBridgeResponseMsg{
+		Type:     "requestBridgeResponse",
+		Version:  ProtocolVersion,
+		Amount:   total,
+		Address:  crypto.PubkeyToAddress(acc.PublicKey).String(),
+		Capacity: capacity,
+	}, nil
+}
+
+// startBridge confirms a prepared bridge and starts watching its escrow for the deposit.
+// sid is the session the status updates of the bridge are published to and clientID the
+// API client whose webhooks are notified, if any.
+func (e *ExchangeServer) startBridge(ctx context.Context, req BridgeRequest, acc *ecdsa.PrivateKey, sid, clientID string) (AccountWatchRequest, *ProtocolError) {
+	ctx, span := tracer.Start(ctx, "start bridge")
+	defer span.End()
+
+	// the route may have been paused since the request was quoted.
+	if perr := e.checkRoutePaused(ctx, req); perr != nil {
+		return AccountWatchRequest{}, perr
+	}
+	// the capacity may have been used up by other bridges since the request was quoted.
+	if _, err := e.checkMintCapacity(ctx, req, req.Amount); err != nil {
+		return AccountWatchRequest{}, e.capacityError(req, "", err)
+	}
+	txid := uuid.New().String()
+	if perr := e.checkPendingLimits(ctx, req, txid); perr != nil {
+		return AccountWatchRequest{}, perr
+	}
+
+	// deposits are searched for from the block the escrow is issued at.
+	var watchFrom uint64
+	if rpc := e.chainClient(req.FromChain); rpc != nil {
+		block, err := rpc.BlockNumber(ctx)
+		if err != nil {
+			e.logger.Errorw("failed to read the block number", "sid", sid, "chain", req.FromChain, "error", err)
+		}
+		watchFrom = block
+	}
+
+	deadline := time.Now().Add(e.paymentWindow(routeOfRequest(req)))
+	awr := AccountWatchRequest{
+		TransactionID:  txid,
+		AWRID:          uuid.New().String(),
+		Account:        crypto.PubkeyToAddress(acc.PublicKey).String(),
+		Chain:          req.FromChain,
+		Amount:         req.Amount,
+		TimeOut:        deadline.Unix(),
+		LockedBy:       e.podName,
+		WSClientID:     sid,
+		CreatedTime:    time.Now(),
+		State:          BridgeStatePending,
+		ClientID:       clientID,
+		WatchFromBlock: watchFrom,
+		AssistedSellOrderInformation: AssistedTradeOrderInformation{
+			BridgeTo:              req.BridgeTo,
+			Currency:              req.Currency,
+			SellerShippingAddress: req.ShippingAddress,
+			SellerRefundAddress:   req.RefundAddress,
+			Amount:                req.Amount,
+			SellersEscrowWallet: EscrowWallet{
+				PublicAddress: crypto.PubkeyToAddress(acc.PublicKey).String(),
+				PrivateKey:    hex.EncodeToString(acc.D.Bytes()),
+				Chain:         req.FromChain,
+			},
+			TradeAsset: req.BridgeTo,
+			BridgeFrom: req.FromChain,
+		},
+	}
+	span.SetAttributes(bridgeAttributes(awr)...)
+	saveTraceContext(ctx, &awr)
+
+	_, store := tracer.Start(ctx, "store bridge")
+	err := e.updateAccountWatchRequestInDB(awr)
+	endSpan(store, err)
+	if err != nil {
+		e.bridgeLogger(awr).Errorw("error updating account watch request in db", "error", err)
+		if err := e.releasePendingSlots(ctx, awr); err != nil {
+			e.bridgeLogger(awr).Errorw("failed to release the pending slots", "error", err)
+		}
+		return AccountWatchRequest{}, protocolErrorf(ErrCodeInternal, "", "unable to store the bridge, please try again")
+	}
+
+	if err := e.addSessionBridge(sid, awr.TransactionID); err != nil {
+		e.logger.Errorw("failed to store session bridge", "sid", sid, "error", err)
+	}
+	if err := e.setBridgeClient(ctx, awr.TransactionID, clientID); err != nil {
+		e.logger.Errorw("failed to store the client of the bridge", "sid", sid, "error", err)
+	}
+	e.emitBridgeEvent(EventBridgeRequested, awr)
+	return awr, nil
+}
+
+// confirmBridgeResponse is the reply to a confirmed bridge.
+func confirmBridgeResponse(awr AccountWatchRequest) ConfirmBridgeResponseMsg {
+	return ConfirmBridgeResponseMsg{
+		Type:          "confirmBridgeResponse",
+		Version:       ProtocolVersion,
+		TransactionID: awr.TransactionID,
+		Address:       awr.Account,
+		Amount:        awr.Amount,
+		Deadline:      awr.TimeOut,
+	}
+}
+
+// storePendingBridge keeps a bridge created over the HTTP API until it is confirmed.
+func (e *ExchangeServer) storePendingBridge(pb PendingBridge) error {
+	data, err := json.Marshal(pb)
+	if err != nil {
+		return err
+	}
+	return e.redisClient.Set(context.Background(), "pendingbridges:"+pb.ID, data, pendingBridgeTTL).Err()
+}
+
+// takePendingBridge removes and returns a pending bridge of clientID, so that it can only be
+// confirmed once. It returns nil if the bridge does not exist, has expired or was created by
+// another client.
+func (e *ExchangeServer) takePendingBridge(id, clientID string) (*PendingBridge, error) {
+	key := "pendingbridges:" + id
+	data, err := e.redisClient.Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pb PendingBridge
+	if err := json.Unmarshal([]byte(data), &pb); err != nil {
+		return nil, err
+	}
+	if pb.ClientID != clientID {
+		return nil, nil
+	}
+	// whoever deletes the bridge confirms it.
+	if err := e.redisClient.GetDel(context.Background(), key).Err(); err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &pb, nil
+}
+
+// BridgeView is the public view of a bridge. It never includes the escrow key.
+type BridgeView struct {
+	TransactionID    string      `json:"transactionID"`
+	State            string      `json:"state"`
+	Route            Route       `json:"route"`
+	Address          string      `json:"address,omitempty"`
+	Amount           *big.Int    `json:"amount,omitempty"`
+	ShippingAddress  string      `json:"shippingAddress,omitempty"`
+	RefundAddress    string      `json:"refundAddress,omitempty"`
+	Deadline         int64       `json:"deadline,omitempty"`
+	ReceivedAmount   *big.Int    `json:"receivedAmount,omitempty"`
+	PaymentStatus    string      `json:"paymentStatus,omitempty"`
+	DepositTxHash    string      `json:"depositTxHash,omitempty"`
+	SettlementTxHash string      `json:"settlementTxHash,omitempty"`
+	FailureReason    string      `json:"failureReason,omitempty"`
+	RefundTxHash     string      `json:"refundTxHash,omitempty"`
+	RefundAmount     *big.Int    `json:"refundAmount,omitempty"`
+	RefundTxStatus   string      `json:"refundTxStatus,omitempty"`
+	CreatedTime      time.Time   `json:"createdTime,omitempty"`
+	DepositedTime    *time.Time  `json:"depositedTime,omitempty"`
+	SettledTime      *time.Time  `json:"settledTime,omitempty"`
+	RefundedTime     *time.Time  `json:"refundedTime,omitempty"`
+	Events           []StatusMsg `json:"events,omitempty"`
+}
+
+// bridgeView returns the public view of an account watch request.
+func bridgeView(awr AccountWatchRequest) BridgeView {
+	return BridgeView{
+		TransactionID:    awr.TransactionID,
+		State:            awr.State,
+		Route:            routeOf(awr),
+		Address:          awr.Account,
+		Amount:           awr.Amount,
+		ShippingAddress:  awr.AssistedSellOrderInformation.SellerShippingAddress,
+		RefundAddress:    awr.AssistedSellOrderInformation.SellerRefundAddress,
+		Deadline:         awr.TimeOut,
+		ReceivedAmount:   awr.ReceivedAmount,
+		PaymentStatus:    awr.PaymentStatus,
+		DepositTxHash:    awr.DepositTxHash,
+		SettlementTxHash: awr.SettlementTxHash,
+		FailureReason:    awr.FailureReason,
+		RefundTxHash:     awr.RefundTxHash,
+		RefundAmount:     awr.RefundAmount,
+		RefundTxStatus:   awr.RefundTxStatus,
+		CreatedTime:      awr.CreatedTime,
+		DepositedTime:    optionalTime(awr.DepositedTime),
+		SettledTime:      optionalTime(awr.SettledTime),
+		RefundedTime:     optionalTime(awr.RefundedTime),
+	}
+}
+
+// optionalTime returns nil for the zero time, so that it is left out of JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// getBridge looks a bridge up by transaction id in the history. Bridges created before the
+// history was kept are looked up in the account watch request lists, and as settled bridges
+// are no longer stored there, their state is taken from their status events. It returns nil
+// if the bridge is unknown.
+func (e *ExchangeServer) getBridge(ctx context.Context, txid string) (*BridgeView, error) {
+	events, err := e.retrieveBridgeEvents(txid, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := e.historyRecord(ctx, txid)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		record.Events = events
+		return record, nil
+	}
+
+	awr, err := e.findAccountWatchRequest(txid)
+	if err != nil {
+		return nil, err
+	}
+
+	var view BridgeView
+	switch {
+	case awr != nil:
+		view = bridgeView(*awr)
+	case len(events) > 0:
+		view = BridgeView{TransactionID: txid}
+	default:
+		return nil, nil
+	}
+
+	// the events are newer than a stored request that has since been settled.
+	for _, event := range events {
+		if event.State != "" {
+			view.State = event.State
+		}
+	}
+	view.Events = events
+	return &view, nil
+}
@@ -0,0 +1,167 @@
+package be
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	bridge "github.com/TeaPartyCrypto/partybridge/pkg/contract/bridge"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// mintWindow is the period the wrapped token contracts use to reset dailyMintedAmount.
+const mintWindow = time.Hour * 24
+
+// MintCapacity describes how much more of a wrapped asset the destination
+// contract will accept before a mint reverts.
+type MintCapacity struct {
+	// Token is the address of the wrapped token contract on the destination chain.
+	Token string `json:"token"`
+	// Cap is the maximum total supply of the wrapped token.
+	Cap *big.Int `json:"cap"`
+	// TotalSupply is the current total supply of the wrapped token.
+	TotalSupply *big.Int `json:"totalSupply"`
+	// DailyMintCap is the maximum amount the bridge may mint per day.
+	DailyMintCap *big.Int `json:"dailyMintCap"`
+	// DailyMinted is the amount minted since the daily window was last reset.
+	DailyMinted *big.Int `json:"dailyMinted"`
+	// RemainingDaily is the amount that can still be minted before the daily window resets.
+	RemainingDaily *big.Int `json:"remainingDaily"`
+	// Remaining is the largest amount a single bridge request can currently mint.
+	Remaining *big.Int `json:"remaining"`
+	// ResetsAt is when the daily window resets, if anything has been minted in it.
+	ResetsAt time.Time `json:"resetsAt,omitempty"`
+}
+
+// mintContractForRoute returns the wrapped token contract and the rpc client of the
+// chain it lives on for a route that mints. Routes that unwrap (release native assets)
+// return an empty address as they are not limited by the token caps.
+func (e *ExchangeServer) mintContractForRoute(currency, bridgeTo string) (string, *ethclient.Client) {
+	switch currency {
+	case GRAMS:
+		if bridgeTo == OCTA {
+			return e.wGRAMSOnOCTAContractAddress, e.octNode.client()
+		}
+	case OCTA:
+		if bridgeTo == GRAMS {
+			return e.wOCTAOnPartyChainContractAddress, e.partyChain.client()
+		}
+	case BSCUSDT:
+		switch bridgeTo {
+		case GRAMS:
+			return e.wBSCUSDTOnPartyChainContractAddress, e.partyChain.client()
+		case OCTA:
+			return e.wBSCUSDTOnOctaSpaceContractAddress, e.octNode.client()
+		}
+	}
+	return "", nil
+}
+
+// mintCapacity reads the current cap headroom of the wrapped token that the route
+// mints. A nil capacity is returned for routes that do not mint.
+func (e *ExchangeServer) mintCapacity(ctx context.Context, currency, bridgeTo string) (*MintCapacity, error) {
+	address, rpc := e.mintContractForRoute(currency, bridgeTo)
+	if address == "" {
+		return nil, nil
+	}
+	if rpc == nil {
+		return nil, fmt.Errorf("no rpc client configured for %s", bridgeTo)
+	}
+
+	contract, err := bridge.NewPartyBridgeCaller(common.HexToAddress(address), rpc)
+	if err != nil {
+		return nil, err
+	}
+	opts := &bind.CallOpts{Context: ctx}
+
+	capacity := &MintCapacity{Token: address}
+	if capacity.Cap, err = contract.Cap(opts); err != nil {
+		return nil, fmt.Errorf("reading cap of %s: %w", address, err)
+	}
+	if capacity.TotalSupply, err = contract.TotalSupply(opts); err != nil {
+		return nil, fmt.Errorf("reading total supply of %s: %w", address, err)
+	}
+	if capacity.DailyMintCap, err = contract.DailyMintCap(opts); err != nil {
+		return nil, fmt.Errorf("reading daily mint cap of %s: %w", address, err)
+	}
+
+	// the daily minted amount is tracked against the minter, which is the contract owner (the shim).
+	minter, err := contract.Owner(opts)
+	if err != nil {
+		return nil, fmt.Errorf("reading owner of %s: %w", address, err)
+	}
+	if capacity.DailyMinted, err = contract.DailyMintedAmount(opts, minter); err != nil {
+		return nil, fmt.Errorf("reading daily minted amount of %s: %w", address, err)
+	}
+	lastMint, err := contract.LastMintTimestamp(opts)
+	if err != nil {
+		return nil, fmt.Errorf("reading last mint timestamp of %s: %w", address, err)
+	}
+
+	// the contract only resets the daily amount on the next mint, so a stale window counts as empty.
+	if lastMint.Sign() > 0 {
+		capacity.ResetsAt = time.Unix(lastMint.Int64(), 0).Add(mintWindow)
+		if time.Now().After(capacity.ResetsAt) {
+			capacity.DailyMinted = big.NewInt(0)
+			capacity.ResetsAt = time.Time{}
+		}
+	}
+
+	capacity.RemainingDaily = nonNegative(new(big.Int).Sub(capacity.DailyMintCap, capacity.DailyMinted))
+	capacity.Remaining = nonNegative(new(big.Int).Sub(capacity.Cap, capacity.TotalSupply))
+	if capacity.RemainingDaily.Cmp(capacity.Remaining) < 0 {
+		capacity.Remaining = capacity.RemainingDaily
+	}
+
+	return capacity, nil
+}
+
+// CapacityExceededError is returned by checkMintCapacity when the amount exceeds what the
+// route can currently mint.
+type CapacityExceededError struct {
+	Remaining *big.Int
+}
+
+func (e *CapacityExceededError) Error() string {
+	return fmt.Sprintf("amount exceeds the remaining mint capacity of %s", e.Remaining.String())
+}
+
+// checkMintCapacity verifies that the route can mint the amount. It returns the capacity
+// so that it can be shown to the client, along with a *CapacityExceededError if the amount
+// exceeds it. Any other error means the capacity could not be read.
+func (e *ExchangeServer) checkMintCapacity(ctx context.Context, req BridgeRequest, amount *big.Int) (*MintCapacity, error) {
+	capacity, err := e.mintCapacity(ctx, req.Currency, req.BridgeTo)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine mint capacity: %w", err)
+	}
+	if capacity == nil {
+		return nil, nil
+	}
+	if amount.Cmp(capacity.Remaining) > 0 {
+		return capacity, &CapacityExceededError{Remaining: capacity.Remaining}
+	}
+	return capacity, nil
+}
+
+// capacityError maps an error of checkMintCapacity to the protocol error returned to clients.
+// Lookup failures are logged and not shown.
+func (e *ExchangeServer) capacityError(req BridgeRequest, field string, err error) *ProtocolError {
+	var exceeded *CapacityExceededError
+	if errors.As(err, &exceeded) {
+		return protocolErrorf(ErrCodeCapacityExceeded, field, exceeded.Error())
+	}
+	e.logger.Errorw("failed to check the mint capacity", "currency", req.Currency, "bridgeTo", req.BridgeTo, "error", err)
+	return protocolErrorf(ErrCodeInternal, "", "unable to check the mint capacity, please try again")
+}
+
+func nonNegative(i *big.Int) *big.Int {
+	if i.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return i
+}
@@ -0,0 +1,55 @@
+package be
+
+import (
+	"context"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+)
+
+// CloudEvent types emitted over the lifecycle of a bridge. They are part of the public
+// interface of the bridge and must not change.
+const (
+	EventBridgeRequested           = "tea.party.bridge.requested"
+	EventBridgeDepositDetected     = "tea.party.bridge.deposit.detected"
+	EventBridgeSettlementSubmitted = "tea.party.bridge.settlement.submitted"
+	EventBridgeSettled             = "tea.party.bridge.settled"
+	EventBridgeExpired             = "tea.party.bridge.expired"
+	EventBridgeFailed              = "tea.party.bridge.failed"
+	EventBridgeRefunded            = "tea.party.bridge.refunded"
+)
+
+// eventSource is the source attribute of every event we emit.
+const eventSource = "tea.party/partybridge"
+
+// ceSendTimeout bounds how long emitting an event can take.
+const ceSendTimeout = 10 * time.Second
+
+// emitBridgeEvent sends a CloudEvent of eventType about a bridge to the sink. The subject is
+// the transaction id of the bridge and the data its public view. Events are sent in the
+// background and dropped with an error log if the sink does not acknowledge them.
+func (e *ExchangeServer) emitBridgeEvent(eventType string, awr AccountWatchRequest) {
+	if e.ceClient == nil || !e.ceSinkConfigured {
+		return
+	}
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.New().String())
+	event.SetType(eventType)
+	event.SetSource(eventSource)
+	event.SetSubject(awr.TransactionID)
+	event.SetTime(time.Now())
+	if err := event.SetData(cloudevents.ApplicationJSON, bridgeView(awr)); err != nil {
+		e.bridgeLogger(awr).Errorw("failed encode cloudevent", "type", eventType, "error", err)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ceSendTimeout)
+		defer cancel()
+		if result := e.ceClient.Send(ctx, event); !cloudevents.IsACK(result) {
+			e.bridgeLogger(awr).Errorw("failed to send cloudevent", "type", eventType, "error", result)
+		}
+	}()
+}
@@ -0,0 +1,403 @@
+package be
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"go.uber.org/zap"
+)
+
+// Receipt statuses of the transactions we send.
+const (
+	// TxStatusConfirmed was mined and succeeded.
+	TxStatusConfirmed = "confirmed"
+	// TxStatusReverted was mined and failed.
+	TxStatusReverted = "reverted"
+	// TxStatusPending was not mined before we gave up waiting for it.
+	TxStatusPending = "pending"
+)
+
+// gasBumpPercent is how much the fees of a stuck transaction are raised when it is replaced.
+// Nodes refuse replacements that raise them by less than 10%.
+const gasBumpPercent = 20
+
+// txFees are the gas and fees of a transaction. GasTipCap and GasFeeCap are set on chains with
+// EIP-1559, GasPrice on the others.
+type txFees struct {
+	Gas       uint64
+	GasPrice  *big.Int
+	GasTipCap *big.Int
+	GasFeeCap *big.Int
+}
+
+// maxCost returns the most the transaction can spend on gas.
+func (f txFees) maxCost() *big.Int {
+	price := f.GasPrice
+	if f.GasFeeCap != nil {
+		price = f.GasFeeCap
+	}
+	return new(big.Int).Mul(price, new(big.Int).SetUint64(f.Gas))
+}
+
+// txResult is the outcome of a transaction we sent, and of its replacements.
+type txResult struct {
+	// TxHash is the transaction that was mined, or the last one sent if none was.
+	TxHash string
+	// Value is what TxHash sends.
+	Value  *big.Int
+	Status string
+	Block  uint64
+}
+
+// parseGasPriceCeilings parses a comma separated list of "chain=gwei" pairs, e.g.
+// "grams=200,octa=2.5".
+func parseGasPriceCeilings(s string) (map[string]*big.Int, error) {
+	ceilings := make(map[string]*big.Int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid gas price ceiling %q, expected chain=gwei", pair)
+		}
+		gwei, ok := new(big.Float).SetString(kv[1])
+		if !ok || gwei.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid gas price ceiling for chain %s: %q", kv[0], kv[1])
+		}
+		wei, _ := new(big.Float).Mul(gwei, big.NewFloat(1e9)).Int(nil)
+		ceilings[strings.ToLower(kv[0])] = wei
+	}
+	return ceilings, nil
+}
+
+// suggestFees returns the fees the node suggests for a transaction on chain using gas, capped
+// at the gas price ceiling of the chain. EIP-1559 fees are used when the latest block has a
+// base fee.
+func (e *ExchangeServer) suggestFees(ctx context.Context, chain string, rpc *ethclient.Client, gas uint64) (txFees, error) {
+	ceiling := e.gasPriceCeilings[chain]
+	head, err := rpc.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return txFees{}, err
+	}
+
+	if head.BaseFee == nil {
+		price, err := rpc.SuggestGasPrice(ctx)
+		if err != nil {
+			return txFees{}, err
+		}
+		if ceiling != nil && price.Cmp(ceiling) > 0 {
+			return txFees{}, fmt.Errorf("the gas price of %s is above the ceiling of %s for %s", price, ceiling, chain)
+		}
+		return txFees{Gas: gas, GasPrice: price}, nil
+	}
+
+	tip, err := rpc.SuggestGasTipCap(ctx)
+	if err != nil {
+		return txFees{}, err
+	}
+	// leave room for the base fee to double before the transaction is mined.
+	feeCap := new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip)
+	if ceiling != nil {
+		if head.BaseFee.Cmp(ceiling) > 0 {
+			return txFees{}, fmt.Errorf("the base fee of %s is above the ceiling of %s for %s", head.BaseFee, ceiling, chain)
+		}
+		if feeCap.Cmp(ceiling) > 0 {
+			feeCap = new(big.Int).Set(ceiling)
+		}
+		if tip.Cmp(feeCap) > 0 {
+			tip = new(big.Int).Set(feeCap)
+		}
+	}
+	return txFees{Gas: gas, GasTipCap: tip, GasFeeCap: feeCap}, nil
+}
+
+// bumpFees returns fees raised by gasBumpPercent to replace a stuck transaction. It returns
+// false when that would go above the gas price ceiling of the chain.
+func (e *ExchangeServer) bumpFees(chain string, fees txFees) (txFees, bool) {
+	bump := func(v *big.Int) *big.Int {
+		bumped := new(big.Int).Mul(v, big.NewInt(100+gasBumpPercent))
+		return bumped.Div(bumped, big.NewInt(100))
+	}
+	ceiling := e.gasPriceCeilings[chain]
+	if fees.GasFeeCap == nil {
+		price := bump(fees.GasPrice)
+		if ceiling != nil && price.Cmp(ceiling) > 0 {
+			return fees, false
+		}
+		return txFees{Gas: fees.Gas, GasPrice: price}, true
+	}
+	feeCap := bump(fees.GasFeeCap)
+	if ceiling != nil && feeCap.Cmp(ceiling) > 0 {
+		return fees, false
+	}
+	return txFees{Gas: fees.Gas, GasTipCap: bump(fees.GasTipCap), GasFeeCap: feeCap}, true
+}
+
+// replaceTx returns the resend function of waitForReceipt. It signs a replacement with nonce
+// and the raised fees, and sends it through the nonce manager while waiter is still ours.
+func (e *ExchangeServer) replaceTx(ctx context.Context, chain string, rpc *ethclient.Client, from common.Address, nonce uint64, waiter *redisLock, sign func(nonce uint64, fees txFees) (*types.Transaction, error)) func(txFees) (*types.Transaction, error) {
+	return func(fees txFees) (*types.Transaction, error) {
+		return e.replaceNonce(ctx, chain, from, nonce, waiter, func(ctx context.Context) (*types.Transaction, error) {
+			tx, err := sign(nonce, fees)
+			if err != nil {
+				return nil, err
+			}
+			return tx, rpc.SendTransaction(ctx, tx)
+		})
+	}
+}
+
+// sendTx sends the transaction sign signs with a nonce from the nonce manager and fees, and
+// waits for it to be mined, replacing it while it is stuck. It returns the mined transaction,
+// which is set on errors too once one has been sent. The nonce stays reserved while it waits,
+// and it stops waiting if it loses the reservation.
+func (e *ExchangeServer) sendTx(ctx context.Context, chain string, rpc *ethclient.Client, key *ecdsa.PrivateKey, fees txFees, sign func(nonce uint64, fees txFees) (*types.Transaction, error), log *zap.SugaredLogger) (txResult, error) {
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	var signed *types.Transaction
+	tx, waiter, err := e.sendWithNonce(ctx, chain, rpc, from, func(ctx context.Context, nonce uint64) (*types.Transaction, error) {
+		tx, err := sign(nonce, fees)
+		if err != nil {
+			return nil, err
+		}
+		signed = tx
+		return tx, rpc.SendTransaction(ctx, tx)
+	})
+	if err != nil {
+		log.Errorw("error sending transaction", "from", from.Hex(), "error", err)
+		// a node that refused the transaction answered, without an answer it may have been sent.
+		var rejected rpcError
+		if signed != nil && !errors.As(err, &rejected) {
+			return txResult{TxHash: signed.Hash().Hex(), Value: signed.Value(), Status: TxStatusPending}, err
+		}
+		return txResult{}, err
+	}
+	log.Infow("tx sent", "tx", tx.Hash().Hex(), "nonce", tx.Nonce())
+	defer func() {
+		if err := waiter.release(); err != nil {
+			log.Errorw("failed to release the waiter of a nonce", "nonce", tx.Nonce(), "error", err)
+		}
+	}()
+	waitCtx, stop := waiter.keep(ctx)
+	defer stop()
+
+	resend := e.replaceTx(waitCtx, chain, rpc, from, tx.Nonce(), waiter, sign)
+	mined, receipt, err := e.waitForReceipt(waitCtx, chain, rpc, tx, fees, resend, log)
+	result := receiptResult(mined, receipt)
+	if err != nil {
+		if ctx.Err() == nil && waitCtx.Err() != nil {
+			err = fmt.Errorf("lost the nonce %d, it may have been given to another transaction: %w", tx.Nonce(), err)
+		}
+		log.Errorw("tx was not mined", "tx", result.TxHash, "error", err)
+		return result, err
+	}
+	log.Infow("tx mined", "tx", result.TxHash, "status", result.Status, "block", result.Block)
+	if result.Status == TxStatusReverted {
+		return result, fmt.Errorf("transaction %s reverted", result.TxHash)
+	}
+	return result, nil
+}
+
+// sendNative sends exactly amount of the native asset of chain from key to to, like sendTx.
+// The fees are paid on top.
+func (e *ExchangeServer) sendNative(ctx context.Context, chain string, rpc *ethclient.Client, key *ecdsa.PrivateKey, to common.Address, amount *big.Int, log *zap.SugaredLogger) (txResult, error) {
+	if rpc == nil {
+		return txResult{}, fmt.Errorf("no rpc client configured for chain %s", chain)
+	}
+	chainID, err := rpc.ChainID(ctx)
+	if err != nil {
+		return txResult{}, err
+	}
+	gas, err := rpc.EstimateGas(ctx, ethereum.CallMsg{From: crypto.PubkeyToAddress(key.PublicKey), To: &to, Value: amount})
+	if err != nil {
+		return txResult{}, fmt.Errorf("estimating the gas of sending %s: %w", amount.String(), err)
+	}
+	fees, err := e.suggestFees(ctx, chain, rpc, gas)
+	if err != nil {
+		return txResult{}, err
+	}
+	sign := func(nonce uint64, fees txFees) (*types.Transaction, error) {
+		return signTx(key, chainID, nonce, to, amount, nil, fees)
+	}
+	return e.sendTx(ctx, chain, rpc, key, fees, sign, log)
+}
+
+// gasBudget returns the most a transaction paying fees can spend on gas, replacements included.
+func (e *ExchangeServer) gasBudget(chain string, fees txFees) *big.Int {
+	for i := 0; i < e.maxGasBumps; i++ {
+		next, ok := e.bumpFees(chain, fees)
+		if !ok {
+			break
+		}
+		fees = next
+	}
+	return fees.maxCost()
+}
+
+// fundGas tops the native balance of account up to cost from the hot wallet, so that it can
+// pay for a transaction, and waits for the top up to be mined.
+func (e *ExchangeServer) fundGas(ctx context.Context, chain string, rpc *ethclient.Client, account common.Address, cost *big.Int, log *zap.SugaredLogger) error {
+	if e.hotWallet == nil {
+		return fmt.Errorf("there is no hot wallet to pay the gas from, PRIVATE_KEY is not a valid key")
+	}
+	balance, err := rpc.BalanceAt(ctx, account, nil)
+	if err != nil {
+		return err
+	}
+	if balance.Cmp(cost) >= 0 {
+		return nil
+	}
+	topUp := new(big.Int).Sub(cost, balance)
+	hotWallet := crypto.PubkeyToAddress(e.hotWallet.PublicKey)
+	log.Infow("funding gas", "from", hotWallet.Hex(), "to", account.Hex(), "amount", topUp)
+	if _, err := e.sendNative(ctx, chain, rpc, e.hotWallet, account, topUp, log); err != nil {
+		return fmt.Errorf("sending %s from the hot wallet %s: %w", topUp.String(), hotWallet.Hex(), err)
+	}
+	return nil
+}
+
+// rpcError is the error of a JSON-RPC call the node answered with an error.
+type rpcError interface {
+	error
+	ErrorCode() int
+}
+
+// sendContractTx sends the contract call call makes as key, like sendTx. The call is only
+// used to pack the call data and estimate its gas, it is signed with our own nonce and fees.
+func (e *ExchangeServer) sendContractTx(ctx context.Context, chain string, rpc *ethclient.Client, key *ecdsa.PrivateKey, call func(opts *bind.TransactOpts) (*types.Transaction, error), log *zap.SugaredLogger) (txResult, error) {
+	chainID, err := rpc.ChainID(ctx)
+	if err != nil {
+		return txResult{}, err
+	}
+	opts, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		return txResult{}, err
+	}
+	// a zero legacy price keeps bind from reading fees and the node from checking the balance
+	// for gas when estimating it. The nonce and fees are replaced below.
+	opts.Context = ctx
+	opts.NoSend = true
+	opts.Nonce = new(big.Int)
+	opts.GasPrice = new(big.Int)
+	tx, err := call(opts)
+	if err != nil {
+		return txResult{}, err
+	}
+
+	fees, err := e.suggestFees(ctx, chain, rpc, tx.Gas())
+	if err != nil {
+		return txResult{}, err
+	}
+	sign := func(nonce uint64, fees txFees) (*types.Transaction, error) {
+		return signTx(key, chainID, nonce, *tx.To(), tx.Value(), tx.Data(), fees)
+	}
+	return e.sendTx(ctx, chain, rpc, key, fees, sign, log)
+}
+
+// signTx builds and signs a transaction paying fees. The transaction is an EIP-1559 one when
+// fees has a fee cap.
+func signTx(key *ecdsa.PrivateKey, chainID *big.Int, nonce uint64, to common.Address, value *big.Int, data []byte, fees txFees) (*types.Transaction, error) {
+	var tx *types.Transaction
+	if fees.GasFeeCap != nil {
+		tx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     nonce,
+			GasTipCap: fees.GasTipCap,
+			GasFeeCap: fees.GasFeeCap,
+			Gas:       fees.Gas,
+			To:        &to,
+			Value:     value,
+			Data:      data,
+		})
+	} else {
+		tx = types.NewTx(&types.LegacyTx{
+			Nonce:    nonce,
+			GasPrice: fees.GasPrice,
+			Gas:      fees.Gas,
+			To:       &to,
+			Value:    value,
+			Data:     data,
+		})
+	}
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), key)
+}
+
+// waitForReceipt polls for the receipt of tx. Whenever it has been pending for stuckTxAfter
+// it is replaced by the transaction resend sends with higher fees, at most maxGasBumps times.
+// Any of the transactions sent may be the one that is mined. It returns the mined transaction
+// and its receipt, or the last transaction sent and an error if none was mined.
+func (e *ExchangeServer) waitForReceipt(ctx context.Context, chain string, rpc *ethclient.Client, tx *types.Transaction, fees txFees, resend func(txFees) (*types.Transaction, error), log *zap.SugaredLogger) (*types.Transaction, *types.Receipt, error) {
+	ticker := time.NewTicker(e.receiptPollInterval)
+	defer ticker.Stop()
+
+	sent := []*types.Transaction{tx}
+	lastSent := time.Now()
+	bumps := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return sent[len(sent)-1], nil, ctx.Err()
+		}
+
+		for i := len(sent) - 1; i >= 0; i-- {
+			receipt, err := rpc.TransactionReceipt(ctx, sent[i].Hash())
+			if err == nil {
+				return sent[i], receipt, nil
+			}
+			if !errors.Is(err, ethereum.NotFound) {
+				log.Errorw("error getting transaction receipt", "tx", sent[i].Hash().Hex(), "error", err)
+			}
+		}
+
+		if time.Since(lastSent) < e.stuckTxAfter {
+			continue
+		}
+		if bumps >= e.maxGasBumps {
+			return sent[len(sent)-1], nil, fmt.Errorf("transaction %s was not mined after %d replacements", sent[len(sent)-1].Hash().Hex(), bumps)
+		}
+		bumps++
+		lastSent = time.Now()
+
+		next, ok := e.bumpFees(chain, fees)
+		if !ok {
+			log.Infow("not replacing stuck transaction, its fees are at the gas price ceiling", "tx", sent[len(sent)-1].Hash().Hex())
+			continue
+		}
+		replacement, err := resend(next)
+		if err != nil {
+			// the transaction may have been mined since the last poll.
+			log.Errorw("error replacing stuck transaction", "tx", sent[len(sent)-1].Hash().Hex(), "error", err)
+			continue
+		}
+		log.Infow("replaced stuck transaction", "tx", sent[len(sent)-1].Hash().Hex(), "replacement", replacement.Hash().Hex())
+		sent = append(sent, replacement)
+		fees = next
+	}
+}
+
+// receiptResult returns the outcome of tx given its receipt, nil if it was not mined.
+func receiptResult(tx *types.Transaction, receipt *types.Receipt) txResult {
+	result := txResult{TxHash: tx.Hash().Hex(), Value: tx.Value(), Status: TxStatusPending}
+	if receipt == nil {
+		return result
+	}
+	result.Block = receipt.BlockNumber.Uint64()
+	result.Status = TxStatusConfirmed
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		result.Status = TxStatusReverted
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package be
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestBumpFees(t *testing.T) {
+	gwei := func(n int64) *big.Int { return new(big.Int).Mul(big.NewInt(n), big.NewInt(1e9)) }
+	e := &ExchangeServer{gasPriceCeilings: map[string]*big.Int{GRAMS: gwei(120), OCTA: gwei(12)}}
+
+	tests := []struct {
+		name  string
+		chain string
+		fees  txFees
+		want  txFees
+		ok    bool
+	}{
+		{"legacy", GRAMS, txFees{Gas: 21000, GasPrice: gwei(50)}, txFees{Gas: 21000, GasPrice: gwei(60)}, true},
+		{"legacy at ceiling", GRAMS, txFees{Gas: 21000, GasPrice: gwei(100)}, txFees{Gas: 21000, GasPrice: gwei(120)}, true},
+		{"legacy over ceiling", GRAMS, txFees{Gas: 21000, GasPrice: gwei(101)}, txFees{Gas: 21000, GasPrice: gwei(101)}, false},
+		{"legacy without ceiling", BSCUSDT, txFees{Gas: 21000, GasPrice: gwei(1000)}, txFees{Gas: 21000, GasPrice: gwei(1200)}, true},
+		{"rounds down", BSCUSDT, txFees{Gas: 21000, GasPrice: big.NewInt(7)}, txFees{Gas: 21000, GasPrice: big.NewInt(8)}, true},
+		{"eip-1559", OCTA, txFees{Gas: 60000, GasTipCap: gwei(1), GasFeeCap: gwei(10)}, txFees{Gas: 60000, GasTipCap: big.NewInt(1.2e9), GasFeeCap: gwei(12)}, true},
+		{"eip-1559 over ceiling", OCTA, txFees{Gas: 60000, GasTipCap: gwei(1), GasFeeCap: gwei(11)}, txFees{Gas: 60000, GasTipCap: gwei(1), GasFeeCap: gwei(11)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := e.bumpFees(tt.chain, tt.fees)
+			if ok != tt.ok {
+				t.Fatalf("bumpFees() ok = %v, want %v", ok, tt.ok)
+			}
+			if got.Gas != tt.want.Gas || !equalBig(got.GasPrice, tt.want.GasPrice) || !equalBig(got.GasTipCap, tt.want.GasTipCap) || !equalBig(got.GasFeeCap, tt.want.GasFeeCap) {
+				t.Errorf("bumpFees() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// equalBig reports whether a and b are equal, treating nil as unset.
+func equalBig(a, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Cmp(b) == 0
+}
@@ -0,0 +1,283 @@
+package be
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Kinds of dependency the readiness checks cover.
+const (
+	DependencyRedis = "redis"
+	DependencyRPC   = "rpc"
+	DependencyShim  = "shim"
+)
+
+// DependencyStatus is the result of the last check of a dependency. Pods are not ready while
+// a critical dependency is unhealthy.
+type DependencyStatus struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Critical bool   `json:"critical"`
+	Healthy  bool   `json:"healthy"`
+	// LatencyMs is how long the check took.
+	LatencyMs int64 `json:"latencyMs"`
+	// LatestBlock and BlockTime are the head of the chain its healthiest endpoint is synced to.
+	LatestBlock uint64     `json:"latestBlock,omitempty"`
+	BlockTime   *time.Time `json:"blockTime,omitempty"`
+	// Endpoints is the state of every endpoint of a chain.
+	Endpoints   []EndpointStatus `json:"endpoints,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	CheckedTime time.Time        `json:"checkedTime"`
+}
+
+// RouteStatus tells whether a route is paused, and by which kill switch.
+type RouteStatus struct {
+	Route
+	Paused bool `json:"paused"`
+	// Pause is the key of the switch that pauses the route, e.g. chain:octa.
+	Pause string `json:"pause,omitempty"`
+}
+
+// StatusReport is the reply of /status.
+type StatusReport struct {
+	Ready        bool               `json:"ready"`
+	Pod          string             `json:"pod"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+	Routes       []RouteStatus      `json:"routes,omitempty"`
+	// RoutesError is set when the pause state of the routes could not be read.
+	RoutesError string `json:"routesError,omitempty"`
+}
+
+// healthState holds the results of the last dependency checks.
+type healthState struct {
+	mu     sync.RWMutex
+	checks []DependencyStatus
+}
+
+func (h *healthState) set(checks []DependencyStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = checks
+}
+
+// get returns the results of the last checks and whether the pod is ready. It is not before
+// the checks first ran.
+func (h *healthState) get() ([]DependencyStatus, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ready := h.checks != nil
+	for _, check := range h.checks {
+		if check.Critical && !check.Healthy {
+			ready = false
+		}
+	}
+	return append([]DependencyStatus(nil), h.checks...), ready
+}
+
+// dependencyCheck checks a single dependency.
+type dependencyCheck struct {
+	name     string
+	kind     string
+	critical bool
+	check    func(ctx context.Context, status *DependencyStatus) error
+}
+
+// dependencyChecks returns the checks of the dependencies of the bridge: Redis, the RPC
+// endpoints of every chain and every shim a route is settled by.
+func (e *ExchangeServer) dependencyChecks() []dependencyCheck {
+	checks := []dependencyCheck{{
+		name:     "redis",
+		kind:     DependencyRedis,
+		critical: true,
+		check: func(ctx context.Context, _ *DependencyStatus) error {
+			return e.redisClient.Ping(ctx).Err()
+		},
+	}}
+
+	// a chain is healthy as long as one of its endpoints is, the others are failed over.
+	for _, node := range []*EthereumNode{e.partyChain, e.octNode, e.bscNode} {
+		node := node
+		checks = append(checks, dependencyCheck{
+			name:     node.chain,
+			kind:     DependencyRPC,
+			critical: true,
+			check: func(ctx context.Context, status *DependencyStatus) error {
+				return e.checkBlockFreshness(ctx, node, status)
+			},
+		})
+	}
+
+	for _, shim := range []struct {
+		name    string
+		address string
+	}{
+		{"wgrams", e.gramsShimServerAddress},
+		{"wocta", e.octaShimServerAddress},
+		{"wbscusdt-octa", e.bscUSDTOnOctaSpaceShimServerAddress},
+		{"wbscusdt-grams", e.bscUSDTOnPartyChainShimServerAddress},
+	} {
+		// shims no route is settled by are not configured.
+		if !e.usesShim(shim.address) {
+			continue
+		}
+		address := shim.address
+		checks = append(checks, dependencyCheck{
+			name:     shim.name,
+			kind:     DependencyShim,
+			critical: true,
+			check: func(ctx context.Context, _ *DependencyStatus) error {
+				return dialShim(ctx, address)
+			},
+		})
+	}
+	return checks
+}
+
+// checkBlockFreshness checks that the latest block the healthiest endpoint of node knows of is
+// younger than maxBlockAge, so that deposits are not checked against a chain that stopped
+// syncing.
+func (e *ExchangeServer) checkBlockFreshness(ctx context.Context, node *EthereumNode, status *DependencyStatus) error {
+	var header *types.Header
+	err := node.do(ctx, func(client *ethclient.Client) (err error) {
+		header, err = client.HeaderByNumber(ctx, nil)
+		return err
+	})
+	status.Endpoints = node.status()
+	if err != nil {
+		return err
+	}
+	blockTime := time.Unix(int64(header.Time), 0)
+	status.LatestBlock = header.Number.Uint64()
+	status.BlockTime = &blockTime
+	if age := time.Since(blockTime); age > e.maxBlockAge {
+		return fmt.Errorf("the latest block is %s old", age.Round(time.Second))
+	}
+	return nil
+}
+
+// usesShim tells whether a supported route is settled by the shim at address.
+func (e *ExchangeServer) usesShim(address string) bool {
+	for _, route := range supportedRoutes {
+		if _, ok := e.settlers[route.Key()].(shimSettler); ok && e.shimAddressOf(route) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// dialShim checks that a shim accepts connections. Shims are addressed as host or host:port
+// and served over https.
+func dialShim(ctx context.Context, address string) error {
+	if address == "" {
+		return fmt.Errorf("no address configured")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkDependencies runs every dependency check in parallel.
+func (e *ExchangeServer) checkDependencies(ctx context.Context) []DependencyStatus {
+	checks := e.dependencyChecks()
+	results := make([]DependencyStatus, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check dependencyCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, e.healthCheckTimeout)
+			defer cancel()
+
+			status := DependencyStatus{Name: check.name, Kind: check.kind, Critical: check.critical}
+			start := time.Now()
+			err := check.check(ctx, &status)
+			status.LatencyMs = time.Since(start).Milliseconds()
+			status.CheckedTime = time.Now()
+			status.Healthy = err == nil
+			if err != nil {
+				status.Error = err.Error()
+			}
+			results[i] = status
+		}(i, check)
+	}
+	wg.Wait()
+	return results
+}
+
+// runHealthChecks checks the dependencies every healthCheckInterval until ctx is done, so
+// that probes are answered without waiting on them.
+func (e *ExchangeServer) runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(e.healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		results := e.checkDependencies(ctx)
+		for _, status := range results {
+			if !status.Healthy {
+				e.logger.Errorw("dependency check failed", "dependency", status.Name, "kind", status.Kind, "critical", status.Critical, "error", status.Error)
+			}
+		}
+		e.health.set(results)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleHealthz answers liveness probes. The process is alive as long as it serves them.
+func (e *ExchangeServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleReadyz answers readiness probes. The pod is ready when every critical dependency
+// passed its last check.
+func (e *ExchangeServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if _, ready := e.health.get(); !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleStatus reports the last check of every dependency and which routes are paused.
+func (e *ExchangeServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	checks, ready := e.health.get()
+	report := StatusReport{Ready: ready, Pod: e.podName, Dependencies: checks}
+	for _, route := range supportedRoutes {
+		pause, err := e.pauseOf(r.Context(), route)
+		if err != nil {
+			report.Routes = nil
+			report.RoutesError = "unable to read the kill switches"
+			break
+		}
+		status := RouteStatus{Route: route, Paused: pause != nil}
+		if pause != nil {
+			status.Pause = pause.Key()
+		}
+		report.Routes = append(report.Routes, status)
+	}
+
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	e.writeJSON(w, code, report)
+}
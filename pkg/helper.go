@@ -2,44 +2,84 @@ package be
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func (e *ExchangeServer) Dispatch(awrr *AccountWatchRequestResult) error {
-	e.logger.Infof("dispatching awr %+v", awrr)
-	if awrr.Result == "success" {
-		// store the bridge account in the db
-		if awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency == "grams" || awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency == "octa" || awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency == "bscusdt" {
-			e.logger.Infof("storing the bridge account in the db...")
-			if err := e.storeBridgeAccount(*awrr); err != nil {
-				e.logger.Errorw("failed to store bridge account in db", err)
-				data := "There was a bridge failure. Please provide this id to support: " + awrr.AccountWatchRequest.TransactionID
-				e.sendStatusMsg(awrr.AccountWatchRequest.WSClientID, "error", data)
-				return err
-			}
+func (e *ExchangeServer) Dispatch(awrr *AccountWatchRequestResult) (err error) {
+	ctx, span := startBridgeSpan(context.Background(), "dispatch", awrr.AccountWatchRequest)
+	span.SetAttributes(attribute.String("bridge.result", awrr.Result))
+	defer func() { endSpan(span, err) }()
+
+	log := e.bridgeLogger(awrr.AccountWatchRequest)
+	log.Infow("dispatching account watch request", "result", awrr.Result)
+	if awrr.Result != "success" {
+		// the watch timed out before the deposit arrived. the bridge is never settled.
+		return e.expireAccountWatchRequest(awrr.AccountWatchRequest)
+	}
+
+	// deposits over a paused route stay in the escrow until it resumes.
+	pause, err := e.pauseOf(ctx, routeOf(awrr.AccountWatchRequest))
+	if err != nil {
+		// fail closed, the request is left as it is and shows up as stuck to operators.
+		log.Errorw("failed to check whether the route is paused", "error", err)
+		return err
+	}
+	if pause != nil {
+		return e.holdSettlement(awrr.AccountWatchRequest, pause)
+	}
+
+	// store the bridge account in the db
+	if awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency == "grams" || awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency == "octa" || awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency == "bscusdt" {
+		log.Info("storing the bridge account in the db")
+		if err := e.storeBridgeAccount(*awrr); err != nil {
+			log.Errorw("failed to store bridge account in db", "error", err)
+			e.failBridge(awrr.AccountWatchRequest, err)
+			return err
 		}
 	}
 
-	e.logger.Infof("creating a new bridge request")
-	if err := e.createBridgeRequest(*awrr); err != nil {
-		// if the bridge request fails we should refund the buyer
+	log.Info("creating a new bridge request")
+	e.emitBridgeEvent(EventBridgeSettlementSubmitted, awrr.AccountWatchRequest)
+	start := time.Now()
+	txHash, err := e.createBridgeRequest(ctx, *awrr)
+	BridgeStageObserve(StageSettlement, awrr.AccountWatchRequest, time.Since(start))
+	if err != nil {
+		// if the bridge request fails we refund the buyer
 		BridgeRequestsInc("failed", *awrr)
-		e.logger.Errorw("failed to create bridge request", err)
-		data := "There was a bridge failure. Please provide this id to support: " + awrr.AccountWatchRequest.TransactionID
-		e.sendStatusMsg(awrr.AccountWatchRequest.WSClientID, "error", data)
+		BridgeDurationObserve("failed", awrr.AccountWatchRequest)
+		log.Errorw("failed to create bridge request", "error", err)
+		var unconfirmed *UnconfirmedSettlementError
+		if errors.As(err, &unconfirmed) {
+			// the asset may have been delivered, refunding could pay the user twice.
+			e.holdUnconfirmedSettlement(awrr.AccountWatchRequest, unconfirmed)
+			return err
+		}
+		e.failBridge(awrr.AccountWatchRequest, err)
 		return err
 	}
+	awrr.AccountWatchRequest.State = BridgeStateSettled
+	awrr.AccountWatchRequest.SettlementTxHash = txHash
+	awrr.AccountWatchRequest.SettledTime = time.Now()
+	e.emitBridgeEvent(EventBridgeSettled, awrr.AccountWatchRequest)
+
+	if awrr.AccountWatchRequest.ExcessAmount != nil {
+		e.refundExcess(awrr.AccountWatchRequest)
+	}
 
 	BridgeRequestsDurationSet(*awrr)
+	BridgeDurationObserve("success", awrr.AccountWatchRequest)
 	BridgeRequestsInc("success", *awrr)
 
 	data := "The bridge reported a success"
-	e.sendStatusMsg(awrr.AccountWatchRequest.WSClientID, "success", data)
+	e.publishStatus(awrr.AccountWatchRequest, "success", data)
 
 	// remove the account watch request from the db
 	if err := e.removeAccountWatchRequestFromDB(awrr.AccountWatchRequest.TransactionID); err != nil {
-		e.logger.Errorw("failed to remove account watch request from db", err)
+		log.Errorw("failed to remove account watch request from db", "error", err)
 		// data := "There was a bridge failure. Please provide this id to support: " + awrr.AccountWatchRequest.TransactionID
 		// e.broadcastToWebSocketClient(awrr.AccountWatchRequest.WSClientID, websocket.TextMessage, []byte(data))
 		return err
@@ -48,8 +88,15 @@ func (e *ExchangeServer) Dispatch(awrr *AccountWatchRequestResult) error {
 	return nil
 }
 
-func (e *ExchangeServer) createBridgeRequest(awrr AccountWatchRequestResult) error {
-	fmt.Printf("creating bridge request for order: %+v", awrr)
+// createBridgeRequest mints or releases the bridged asset to the shipping address. It returns
+// the settlement transaction if the settler of the route reports it.
+func (e *ExchangeServer) createBridgeRequest(ctx context.Context, awrr AccountWatchRequestResult) (string, error) {
+	log := e.bridgeLogger(awrr.AccountWatchRequest)
+	settler, err := e.settlerOf(routeOf(awrr.AccountWatchRequest))
+	if err != nil {
+		log.Errorw("no settler for the route", "error", err)
+		return "", err
+	}
 	// try to mint the Wrapped asset
 	switch awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo {
 	case OCTA:
@@ -57,23 +104,23 @@ func (e *ExchangeServer) createBridgeRequest(awrr AccountWatchRequestResult) err
 			switch awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency {
 			case GRAMS:
 				{
-					e.logger.Infof("Creating a bridge request for order: %s for WGRAMS onto %s chain", awrr.AccountWatchRequest.TransactionID, awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo)
-					return e.requestToMintWrappedCurrency(awrr)
+					log.Info("creating a bridge request to mint WGRAMS on OctaSpace")
+					return settler.Mint(ctx, awrr)
 				}
 			case WOCTA:
 				{
-					e.logger.Infof("Creating a bridge request to unwrap WOCTA on OctaSpace for order: %+v", awrr)
-					return e.requestToTransferCoinOnChainFromShim(awrr)
+					log.Info("creating a bridge request to unwrap WOCTA on OctaSpace")
+					return settler.Release(ctx, awrr)
 				}
 			case BSCUSDT:
 				{
-					e.logger.Infof("Creating a bridge request to wrap BSCUSDT onto OctaSpace for order: %+v", awrr)
-					return e.requestToMintWrappedCurrency(awrr)
+					log.Info("creating a bridge request to wrap BSCUSDT onto OctaSpace")
+					return settler.Mint(ctx, awrr)
 				}
 			default:
 				{
-					e.logger.Errorf("unsupported currency: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency)
-					return fmt.Errorf("unsupported currency: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency)
+					log.Errorw("unsupported currency", "currency", awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency)
+					return "", fmt.Errorf("unsupported currency: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency)
 				}
 			}
 		}
@@ -83,66 +130,71 @@ func (e *ExchangeServer) createBridgeRequest(awrr AccountWatchRequestResult) err
 			case OCTA:
 				{
 					// if we are briding OCTA to GRAMS, we need to mint WOCTA
-					e.logger.Infof("Creating a bridge request for order: %s for WOCTA onto %s chain", awrr.AccountWatchRequest.TransactionID, awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo)
-					return e.requestToMintWrappedCurrency(awrr)
+					log.Info("creating a bridge request to mint WOCTA on PartyChain")
+					return settler.Mint(ctx, awrr)
 				}
 			case WGRAMS:
 				{
-					e.logger.Infof("Creating a bridge request to unwrap WGRAMS on PartyChain for order: %s", awrr.AccountWatchRequest.TransactionID)
-					return e.requestToTransferCoinOnChainFromShim(awrr)
+					log.Info("creating a bridge request to unwrap WGRAMS on PartyChain")
+					return settler.Release(ctx, awrr)
 				}
 			case BSCUSDT:
 				{
-					e.logger.Infof("Creating a bridge request to wrap BSCUSDT onto PartyChain for order: %s", awrr.AccountWatchRequest.TransactionID)
-					return e.requestToMintWrappedCurrency(awrr)
+					log.Info("creating a bridge request to wrap BSCUSDT onto PartyChain")
+					return settler.Mint(ctx, awrr)
 				}
 			default:
 				{
-					e.logger.Errorf("unsupported currency: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency)
-					return fmt.Errorf("unsupported currency: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency)
+					log.Errorw("unsupported currency", "currency", awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency)
+					return "", fmt.Errorf("unsupported currency: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.Currency)
 				}
 			}
 		}
 	case BSCUSDT:
 		{
-			fmt.Printf("creating bridge request for order: %+v", awrr)
 			switch awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeFrom {
 			case OCTA:
 				{
 					// if we are trying to bridge WBSCUSDT from OCTA to BSC, we need to unwrap the WBSCTUSDT on OCTA and then transfer the stored bridge asset to the user on bsc
-					e.logger.Infof("Creating a bridge request to unwrap WBSCUSDT from OCTA and transfer to user on BSC for order: %s", awrr.AccountWatchRequest.TransactionID)
-					return e.requestToTransferCoinOnChainFromShim(awrr)
+					log.Info("creating a bridge request to unwrap WBSCUSDT from OCTA and transfer to user on BSC")
+					return settler.Release(ctx, awrr)
 				}
 			case GRAMS:
 				{
 					// if we are trying to bridge WBSCUSDT from GRAMS to BSC, we need to unwrap the WBSCTUSDT on GRAMS and then transfer the stored bridge asset to the user on bsc
-					e.logger.Infof("Creating a bridge request to unwrap WBSCUSDT from GRAMS and transfer to user on BSC for order: %s", awrr.AccountWatchRequest.TransactionID)
-					return e.requestToTransferCoinOnChainFromShim(awrr)
+					log.Info("creating a bridge request to unwrap WBSCUSDT from GRAMS and transfer to user on BSC")
+					return settler.Release(ctx, awrr)
 				}
 			default:
 				{
-					e.logger.Errorf("unsupported bridge from: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeFrom)
-					return fmt.Errorf("unsupported bridge from: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeFrom)
+					log.Errorw("unsupported bridge from", "bridgeFrom", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeFrom)
+					return "", fmt.Errorf("unsupported bridge from: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeFrom)
 				}
 			}
 		}
 
 	default:
 		{
-			e.logger.Errorf("unsupported bridge to: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo)
-			return fmt.Errorf("unsupported bridge to: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo)
+			log.Errorw("unsupported bridge to", "bridgeTo", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo)
+			return "", fmt.Errorf("unsupported bridge to: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo)
 		}
 	}
 }
 
 func (e *ExchangeServer) watchAccount(awr *AccountWatchRequest) {
-	e.logger.Infow("watching account", "sid", awr.WSClientID, "account", awr.Account)
+	log := e.bridgeLogger(*awr)
+	log.Infow("watching account", "account", awr.Account)
+	// a watch resumed by another pod continues the trace the bridge was created in.
+	ctx, span := startBridgeSpan(context.Background(), "watch deposit", *awr)
+	span.SetAttributes(attribute.String("pod", e.podName))
+	defer span.End()
+
 	awr.Locked = true
 	awr.LockedBy = e.podName
 	awr.LockedTime = time.Now()
 	// tell the database that this instance of the exchange is watching this account
 	if err := e.updateAccountWatchRequestInDB(*awr); err != nil {
-		e.logger.Errorw("updating account watch request in db", "sid", awr.WSClientID, "error", err.Error())
+		log.Errorw("updating account watch request in db", "error", err)
 	}
 
 	if awr.AssistedSellOrderInformation.BridgeTo != "" {
@@ -154,24 +206,24 @@ func (e *ExchangeServer) watchAccount(awr *AccountWatchRequest) {
 				case OCTA:
 					// if our chain is Octa and we are bridging Octa to PartyChain.
 					// then we need to watch for native Octa on OctaChain.
-					e.logger.Infow("watching account for bridge order from OCTA to GRAMS", "sid", awr.WSClientID)
-					e.waitAndVerifyEVMChain(context.Background(), e.octNode.rpcClient, e.octNode.rpcClientTwo, *awr)
+					log.Info("watching account for bridge order from OCTA to GRAMS")
+					e.waitAndVerifyEVMChain(ctx, e.octNode, *awr)
 					return
 				case "wgrams":
 					// if our chain is Octa and we are briding wgrams to Partychain
-					e.logger.Infow("watching account for bridge order from OCTA to GRAMS to unwrap WGRAMS into GRAMS", "sid", awr.WSClientID)
-					e.waitAndVerifyWGRAMSBridgeTokenOnOctaSpace(context.Background(), e.octNode.rpcClient, e.octNode.rpcClientTwo, *awr)
+					log.Info("watching account for bridge order from OCTA to GRAMS to unwrap WGRAMS into GRAMS")
+					e.waitAndVerifyWGRAMSBridgeTokenOnOctaSpace(ctx, e.octNode, *awr)
 				default:
-					e.logger.Error("unknown currency: " + awr.AssistedSellOrderInformation.Currency)
+					log.Errorw("unknown currency", "currency", awr.AssistedSellOrderInformation.Currency)
 					return
 				}
 			case BSCUSDT: // if our chain is Octa and we are briding BSCUSDT
 				switch awr.AssistedSellOrderInformation.Currency {
 				case WBSCUSDT: // if we are briding WBSCUSDT
-					e.logger.Infow("watching account for bridge order from OCTA to BSC to unwrap WBSCUSDT into BSCUSDT", "sid", awr.WSClientID)
-					e.waitAndVerifyWBSCUSDTBridgeTokenOnOctaSpace(context.Background(), e.octNode.rpcClient, e.octNode.rpcClientTwo, *awr)
+					log.Info("watching account for bridge order from OCTA to BSC to unwrap WBSCUSDT into BSCUSDT")
+					e.waitAndVerifyWBSCUSDTBridgeTokenOnOctaSpace(ctx, e.octNode, *awr)
 				default:
-					e.logger.Error("unknown currency: " + awr.AssistedSellOrderInformation.Currency)
+					log.Errorw("unknown currency", "currency", awr.AssistedSellOrderInformation.Currency)
 					return
 				}
 			}
@@ -181,46 +233,46 @@ func (e *ExchangeServer) watchAccount(awr *AccountWatchRequest) {
 				switch awr.AssistedSellOrderInformation.Currency {
 				case "wocta":
 					// if our chain is PartyChain and we are bridging wocta to octaspace
-					e.logger.Infow("watching account for bridge order from GRAMS to OCTA to unwrap WOCTA into OCTA", "sid", awr.WSClientID)
+					log.Info("watching account for bridge order from GRAMS to OCTA to unwrap WOCTA into OCTA")
 					// TODO: error handling
-					e.waitAndVerifyWOCTABridgeTokenOnPartychain(context.Background(), e.partyChain.rpcClient, e.partyChain.rpcClientTwo, *awr)
+					e.waitAndVerifyWOCTABridgeTokenOnPartychain(ctx, e.partyChain, *awr)
 					return
 				case GRAMS:
-					e.logger.Infow("watching account for bridge order from GRAMS to OCTA", "sid", awr.WSClientID)
+					log.Info("watching account for bridge order from GRAMS to OCTA")
 					// TODO: error handling
-					e.waitAndVerifyEVMChain(context.Background(), e.partyChain.rpcClient, e.partyChain.rpcClientTwo, *awr)
+					e.waitAndVerifyEVMChain(ctx, e.partyChain, *awr)
 					return
 				default:
-					e.logger.Error("unknown currency: " + awr.AssistedSellOrderInformation.Currency)
+					log.Errorw("unknown currency", "currency", awr.AssistedSellOrderInformation.Currency)
 				}
 			case BSCUSDT: // if our chain is PartyChain and we are bridging BSCUSDT
 				switch awr.AssistedSellOrderInformation.Currency {
 				case WBSCUSDT:
-					e.logger.Infow("watching account to unwrap WBSCUSDT from GRAMS and transfer to user on BSC", "sid", awr.WSClientID)
-					e.waitAndVerifyWBSCUSDTBridgeTokenOnPartychain(context.Background(), e.partyChain.rpcClient, e.partyChain.rpcClientTwo, *awr)
+					log.Info("watching account to unwrap WBSCUSDT from GRAMS and transfer to user on BSC")
+					e.waitAndVerifyWBSCUSDTBridgeTokenOnPartychain(ctx, e.partyChain, *awr)
 					return
 				}
 			default:
-				e.logger.Error("unknown chain: " + awr.Chain)
+				log.Errorw("unknown chain", "chain", awr.Chain)
 			}
 		case BSCUSDT:
 			switch awr.AssistedSellOrderInformation.BridgeTo {
 			case OCTA:
 				switch awr.AssistedSellOrderInformation.Currency {
 				case BSCUSDT:
-					e.logger.Infow("watching account for bridge order from BSCUSDT to OCTA", "sid", awr.WSClientID)
-					e.waitAndVerifyBSCUSDT(*awr)
+					log.Info("watching account for bridge order from BSCUSDT to OCTA")
+					e.waitAndVerifyBSCUSDT(ctx, *awr)
 				}
 			case GRAMS:
 				switch awr.AssistedSellOrderInformation.Currency {
 				case BSCUSDT:
-					e.logger.Infow("watching account for bridge order from BSCUSDT to GRAMS", "sid", awr.WSClientID)
-					e.waitAndVerifyBSCUSDT(*awr)
+					log.Info("watching account for bridge order from BSCUSDT to GRAMS")
+					e.waitAndVerifyBSCUSDT(ctx, *awr)
 				}
 			}
 
 		default:
-			e.logger.Error("unknown chain: " + awr.Chain)
+			log.Errorw("unknown chain", "chain", awr.Chain)
 		}
 	}
 }
@@ -0,0 +1,326 @@
+package be
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	// historyKey is a hash of the public views of every bridge by transaction id. Unlike the
+	// account watch request lists, entries are never removed.
+	historyKey = "bridgehistory"
+	// historyByTime is a sorted set of transaction ids scored by their creation time in
+	// microseconds. historyByShipping and historyByDeposit prefix the same per address.
+	historyByTime     = "bridgehistory:time"
+	historyByShipping = "bridgehistory:shipping:"
+	historyByDeposit  = "bridgehistory:deposit:"
+
+	defaultHistoryPage = 50
+	maxHistoryPage     = 200
+
+	// maxDepositScanBlocks bounds how many blocks are searched for a deposit transaction.
+	maxDepositScanBlocks = 2000
+)
+
+// transferTopic is the topic of the ERC-20 Transfer event.
+var transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+// BridgePage is a page of the bridge history, newest first. Next is the cursor of the
+// following page, empty on the last one.
+type BridgePage struct {
+	Bridges []BridgeView `json:"bridges"`
+	Next    string       `json:"next,omitempty"`
+}
+
+// recordBridge writes the public view of a bridge to the history. The view never includes
+// the escrow key.
+func (e *ExchangeServer) recordBridge(awr AccountWatchRequest) {
+	ctx := context.Background()
+	view := bridgeView(awr)
+
+	// status updates are published from copies of the request that may not carry what was
+	// recorded before, e.g. the refund of an excess deposit, so earlier facts are kept.
+	prev, err := e.historyRecord(ctx, awr.TransactionID)
+	if err != nil {
+		e.bridgeLogger(awr).Errorw("failed to retrieve bridge history", "error", err)
+	}
+	if prev != nil {
+		view = mergeBridgeViews(*prev, view)
+	}
+	if err := e.storeHistoryRecord(ctx, view); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to store bridge history", "error", err)
+	}
+}
+
+// mergeBridgeViews returns next with the facts it is missing taken from prev.
+func mergeBridgeViews(prev, next BridgeView) BridgeView {
+	keep := func(s *string, p string) {
+		if *s == "" {
+			*s = p
+		}
+	}
+	keep(&next.DepositTxHash, prev.DepositTxHash)
+	keep(&next.SettlementTxHash, prev.SettlementTxHash)
+	keep(&next.RefundTxHash, prev.RefundTxHash)
+	keep(&next.RefundTxStatus, prev.RefundTxStatus)
+	keep(&next.PaymentStatus, prev.PaymentStatus)
+	keep(&next.FailureReason, prev.FailureReason)
+	if next.ReceivedAmount == nil {
+		next.ReceivedAmount = prev.ReceivedAmount
+	}
+	if next.RefundAmount == nil {
+		next.RefundAmount = prev.RefundAmount
+	}
+	if next.DepositedTime == nil {
+		next.DepositedTime = prev.DepositedTime
+	}
+	if next.SettledTime == nil {
+		next.SettledTime = prev.SettledTime
+	}
+	if next.RefundedTime == nil {
+		next.RefundedTime = prev.RefundedTime
+	}
+	return next
+}
+
+// storeHistoryRecord writes a view to the history and its indexes.
+func (e *ExchangeServer) storeHistoryRecord(ctx context.Context, view BridgeView) error {
+	view.Events = nil
+	data, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+	member := redis.Z{Score: float64(view.CreatedTime.UnixMicro()), Member: view.TransactionID}
+
+	pipe := e.redisClient.TxPipeline()
+	pipe.HSet(ctx, historyKey, view.TransactionID, data)
+	pipe.ZAdd(ctx, historyByTime, member)
+	if view.ShippingAddress != "" {
+		pipe.ZAdd(ctx, historyByShipping+strings.ToLower(view.ShippingAddress), member)
+	}
+	if view.Address != "" {
+		pipe.ZAdd(ctx, historyByDeposit+strings.ToLower(view.Address), member)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// historyRecord returns the recorded view of a bridge, or nil if it has none.
+func (e *ExchangeServer) historyRecord(ctx context.Context, txid string) (*BridgeView, error) {
+	data, err := e.redisClient.HGet(ctx, historyKey, txid).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var view BridgeView
+	if err := json.Unmarshal([]byte(data), &view); err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
+
+// historyPage returns up to limit bridges of the index in key created in [since, until),
+// newest first. cursor continues from the Next of a previous page.
+func (e *ExchangeServer) historyPage(ctx context.Context, key string, since, until time.Time, cursor string, limit int) (BridgePage, error) {
+	max := "+inf"
+	if !until.IsZero() {
+		max = "(" + strconv.FormatInt(until.UnixMicro(), 10)
+	}
+	if cursor != "" {
+		max = "(" + cursor
+	}
+	min := "-inf"
+	if !since.IsZero() {
+		min = strconv.FormatInt(since.UnixMicro(), 10)
+	}
+
+	entries, err := e.redisClient.ZRevRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{Min: min, Max: max, Count: int64(limit) + 1}).Result()
+	if err != nil {
+		return BridgePage{}, err
+	}
+
+	page := BridgePage{Bridges: make([]BridgeView, 0, len(entries))}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		page.Next = strconv.FormatInt(int64(entries[limit-1].Score), 10)
+	}
+	if len(entries) == 0 {
+		return page, nil
+	}
+
+	txids := make([]string, len(entries))
+	for i, entry := range entries {
+		txids[i], _ = entry.Member.(string)
+	}
+	records, err := e.redisClient.HMGet(ctx, historyKey, txids...).Result()
+	if err != nil {
+		return BridgePage{}, err
+	}
+	for _, record := range records {
+		data, ok := record.(string)
+		if !ok {
+			continue
+		}
+		var view BridgeView
+		if err := json.Unmarshal([]byte(data), &view); err != nil {
+			return BridgePage{}, err
+		}
+		page.Bridges = append(page.Bridges, view)
+	}
+	return page, nil
+}
+
+// recordDepositTx looks up the transaction a deposit was made in and adds it to the history.
+// It is best effort and runs in the background so that it never holds up a bridge.
+func (e *ExchangeServer) recordDepositTx(awr AccountWatchRequest) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		txHash, err := e.findDepositTx(ctx, awr)
+		if err != nil {
+			e.bridgeLogger(awr).Errorw("failed to find deposit transaction", "error", err)
+			return
+		}
+		if txHash == "" {
+			return
+		}
+
+		// the bridge has likely moved on since, so only the transaction is added.
+		view, err := e.historyRecord(ctx, awr.TransactionID)
+		if err != nil || view == nil {
+			e.bridgeLogger(awr).Errorw("failed to retrieve bridge history", "error", err)
+			return
+		}
+		view.DepositTxHash = txHash
+		if err := e.storeHistoryRecord(ctx, *view); err != nil {
+			e.bridgeLogger(awr).Errorw("failed to store bridge history", "error", err)
+		}
+	}()
+}
+
+// findDepositTx returns the first transaction that paid into the escrow of awr since it was
+// issued. Token deposits are found by their Transfer event, native ones by scanning blocks.
+// Deposits on chains we have no rpc client for are not looked up.
+func (e *ExchangeServer) findDepositTx(ctx context.Context, awr AccountWatchRequest) (string, error) {
+	rpc := e.chainClient(awr.Chain)
+	if rpc == nil {
+		return "", nil
+	}
+	latest, err := rpc.BlockNumber(ctx)
+	if err != nil {
+		return "", err
+	}
+	from := awr.WatchFromBlock
+	if from == 0 || from > latest {
+		from = 0
+		if latest > maxDepositScanBlocks {
+			from = latest - maxDepositScanBlocks
+		}
+	}
+	to := latest
+	if to-from > maxDepositScanBlocks {
+		to = from + maxDepositScanBlocks
+	}
+	escrow := common.HexToAddress(awr.Account)
+
+	if token := e.depositTokenContract(awr.Chain, awr.AssistedSellOrderInformation.Currency); token != "" {
+		logs, err := rpc.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{common.HexToAddress(token)},
+			Topics:    [][]common.Hash{{transferTopic}, nil, {common.BytesToHash(escrow.Bytes())}},
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(logs) == 0 {
+			return "", nil
+		}
+		return logs[0].TxHash.Hex(), nil
+	}
+
+	for n := from; n <= to; n++ {
+		block, err := rpc.BlockByNumber(ctx, new(big.Int).SetUint64(n))
+		if err != nil {
+			return "", fmt.Errorf("block %d: %w", n, err)
+		}
+		for _, tx := range block.Transactions() {
+			if tx.To() != nil && *tx.To() == escrow {
+				return tx.Hash().Hex(), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// handleAPIListBridges pages through the bridges of a shipping or deposit address, newest
+// first. since and until are RFC 3339 times.
+func (e *ExchangeServer) handleAPIListBridges(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var key string
+	switch {
+	case q.Get("shippingAddress") != "":
+		key = historyByShipping + strings.ToLower(q.Get("shippingAddress"))
+	case q.Get("depositAddress") != "":
+		key = historyByDeposit + strings.ToLower(q.Get("depositAddress"))
+	default:
+		e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "shippingAddress", "shippingAddress or depositAddress is required"))
+		return
+	}
+
+	var since, until time.Time
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := q.Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, param.name, "%s must be an RFC 3339 time", param.name))
+				return
+			}
+			*param.t = t
+		}
+	}
+
+	cursor := q.Get("cursor")
+	if cursor != "" {
+		if _, err := strconv.ParseInt(cursor, 10, 64); err != nil {
+			e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "cursor", "cursor is not valid"))
+			return
+		}
+	}
+
+	limit := defaultHistoryPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryPage {
+			e.writeAPIError(w, protocolErrorf(ErrCodeInvalidMessage, "limit", "limit must be between 1 and %d", maxHistoryPage))
+			return
+		}
+		limit = n
+	}
+
+	page, err := e.historyPage(r.Context(), key, since, until, cursor, limit)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve bridge history", "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the bridges"))
+		return
+	}
+	e.writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,145 @@
+package be
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/go-redis/redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// rpcTransport records the latency and errors of the JSON-RPC requests made to a chain.
+// Endpoints are labelled by host only, as providers put API keys in the path.
+type rpcTransport struct {
+	chain string
+	next  http.RoundTripper
+}
+
+func (t *rpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := "unknown"
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		method = rpcMethod(body)
+	}
+
+	// calls made for a bridge, such as its deposit checks, are part of its trace. the trace
+	// context is not sent to the RPC providers.
+	if trace.SpanContextFromContext(req.Context()).IsValid() {
+		ctx, span := tracer.Start(req.Context(), "rpc "+method, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("rpc.chain", t.chain), attribute.String("rpc.method", method), attribute.String("net.peer.name", req.URL.Host)))
+		defer span.End()
+		req = req.WithContext(ctx)
+	}
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	failed := err != nil || res.StatusCode/100 != 2
+	RPCRequestObserve(t.chain, req.URL.Host, method, time.Since(start), failed)
+	if failed {
+		trace.SpanFromContext(req.Context()).SetStatus(codes.Error, "rpc request failed")
+	}
+	return res, err
+}
+
+// rpcMethod returns the method of a JSON-RPC request, or batch for a batch of them.
+func rpcMethod(body []byte) string {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		return "batch"
+	}
+	var msg struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil || msg.Method == "" {
+		return "unknown"
+	}
+	return msg.Method
+}
+
+// dialChain connects to the RPC endpoint of chain. Requests over HTTP are instrumented,
+// WebSocket and IPC endpoints are not.
+func dialChain(ctx context.Context, chain, endpoint string) (*ethclient.Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ethclient.DialContext(ctx, endpoint)
+	}
+	client, err := rpc.DialOptions(ctx, endpoint, rpc.WithHTTPClient(&http.Client{
+		Transport: &rpcTransport{chain: chain, next: http.DefaultTransport},
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ethclient.NewClient(client), nil
+}
+
+// shimTransport records the outcome and latency of shim requests by endpoint, and passes the
+// trace context on to the shims in the traceparent header.
+type shimTransport struct {
+	next http.RoundTripper
+}
+
+func (t *shimTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "shim "+req.URL.Path, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", req.Method), attribute.String("net.peer.name", req.URL.Host)))
+	defer span.End()
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode/100) + "xx"
+		span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+	}
+	ShimRequestObserve(req.URL.Path, status, time.Since(start))
+	if err != nil || res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, "shim request failed")
+	}
+	return res, err
+}
+
+// redisMetricsHook records the latency and errors of Redis operations. A missing key is not
+// an error.
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		RedisOperationObserve(cmd.Name(), time.Since(start), err != nil && err != redis.Nil)
+		return err
+	}
+}
+
+func (redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		RedisOperationObserve("pipeline", time.Since(start), err != nil && err != redis.Nil)
+		return err
+	}
+}
@@ -0,0 +1,265 @@
+package be
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// rejection reasons counted in bridge_rejections_total.
+const (
+	RejectRequestRate     = "request_rate"
+	RejectConnectionRate  = "connection_rate"
+	RejectQuoteRate       = "quote_rate"
+	RejectBridgeRate      = "bridge_rate"
+	RejectAddressPending  = "address_pending"
+	RejectRoutePending    = "route_pending"
+	RejectAddressContract = "address_contract"
+	RejectAddressScreened = "address_screened"
+	RejectRoutePaused     = "route_paused"
+)
+
+// tokenBucket is a rate limit that allows bursts of burst requests and refills at rate
+// tokens per second. A zero bucket allows everything.
+type tokenBucket struct {
+	name  string
+	rate  float64
+	burst int
+}
+
+// parseTokenBucket parses a limit of the form "<count>/<duration>", e.g. "30/1m", into a bucket
+// that allows count requests at once and refills count tokens every duration. An empty limit
+// or a count of 0 disables it.
+func parseTokenBucket(name, s string) (tokenBucket, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return tokenBucket{name: name}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return tokenBucket{}, fmt.Errorf("invalid limit %q, expected <count>/<duration>", s)
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count < 0 {
+		return tokenBucket{}, fmt.Errorf("invalid count in limit %q", s)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return tokenBucket{}, fmt.Errorf("invalid duration in limit %q", s)
+	}
+	if count == 0 {
+		return tokenBucket{name: name}, nil
+	}
+	return tokenBucket{name: name, rate: float64(count) / per.Seconds(), burst: count}, nil
+}
+
+// scaled returns the bucket with its rate and burst multiplied by n.
+func (b tokenBucket) scaled(n int) tokenBucket {
+	if n <= 1 {
+		return b
+	}
+	return tokenBucket{name: b.name, rate: b.rate * float64(n), burst: b.burst * n}
+}
+
+// takeTokenScript takes a token from the bucket in KEYS[1], refilled at ARGV[1] tokens per
+// second up to ARGV[2] since it was last used at ARGV[3]. It returns 1 if a token was taken.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("EXPIRE", KEYS[1], math.ceil(burst / rate) + 1)
+return allowed
+`)
+
+// takeToken takes a token from the bucket of the principal. Anonymous principals share a
+// bucket per address, others get one per key or client, API_KEY_LIMIT_MULTIPLIER times as
+// large. Buckets are kept in Redis so that the limits hold across pods.
+func (e *ExchangeServer) takeToken(ctx context.Context, bucket tokenBucket, p *Principal, ip, reason string) *ProtocolError {
+	if bucket.rate == 0 {
+		return nil
+	}
+	if !p.Anonymous {
+		bucket = bucket.scaled(e.apiKeyLimitMultiplier)
+	}
+
+	key := "buckets:" + bucket.name + ":" + p.rateLimitKey(ip)
+	now := strconv.FormatFloat(float64(time.Now().UnixMilli())/1000, 'f', 3, 64)
+	allowed, err := takeTokenScript.Run(ctx, e.redisClient, []string{key}, bucket.rate, bucket.burst, now).Int()
+	if err != nil {
+		// fail open, Redis being down should not take the API down with it.
+		e.logger.Errorw("failed to take a token from the rate limit", "key", key, "error", err)
+		return nil
+	}
+	if allowed == 0 {
+		RejectionsInc(reason)
+		return protocolErrorf(ErrCodeRateLimited, "", "too many %s, please slow down", bucket.name)
+	}
+	return nil
+}
+
+// withLimit takes a token from bucket before calling next. It must be wrapped in withAuth.
+func (e *ExchangeServer) withLimit(bucket *tokenBucket, reason string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if perr := e.takeToken(r.Context(), *bucket, principalFrom(r.Context()), e.remoteIP(r), reason); perr != nil {
+			e.writeAPIError(w, perr)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// pendingSlotTTL bounds how long a pending slot is held. Bridges leave the watch list long
+// before it, it only frees the slots of bridges a crashed pod never stored.
+const pendingSlotTTL = time.Hour * 24
+
+// Pending slots are kept in sorted sets of transaction ids, scored by when they were taken, so
+// that releasing a bridge twice or one that never took a slot does not skew the count.
+const (
+	pendingByAddress = "pendingslots:address:"
+	pendingByRoute   = "pendingslots:route:"
+)
+
+// takePendingSlotScript counts the slots in KEYS[1] (the shipping address) and KEYS[2] (the
+// route) taken since ARGV[5], and takes one in both for ARGV[1] at ARGV[4] unless that reaches
+// the limits in ARGV[2] and ARGV[3]. An empty ARGV[1] only checks. It returns 1 when the
+// address is at its limit, 2 when the route is, and 0 otherwise, with the count.
+var takePendingSlotScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[5])
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[5])
+local byAddress = redis.call("ZCARD", KEYS[1])
+local byRoute = redis.call("ZCARD", KEYS[2])
+local addressLimit = tonumber(ARGV[2])
+local routeLimit = tonumber(ARGV[3])
+if addressLimit > 0 and byAddress >= addressLimit then
+	return {1, byAddress}
+end
+if routeLimit > 0 and byRoute >= routeLimit then
+	return {2, byRoute}
+end
+if ARGV[1] ~= "" then
+	redis.call("ZADD", KEYS[1], ARGV[4], ARGV[1])
+	redis.call("ZADD", KEYS[2], ARGV[4], ARGV[1])
+end
+return {0, 0}
+`)
+
+// checkPendingLimits refuses bridges to shipping addresses that already have
+// MAX_PENDING_PER_ADDRESS bridges being watched, and over routes that are watching as many
+// bridges as their MAX_PENDING_WATCHES allows. With a txid, the bridge takes a slot in both
+// in the same step, which releasePendingSlots gives back once it is no longer watched.
+func (e *ExchangeServer) checkPendingLimits(ctx context.Context, req BridgeRequest, txid string) *ProtocolError {
+	route := routeOfRequest(req)
+	addressLimit, routeLimit := e.maxPendingPerAddress, e.maxPendingWatchesOf(route)
+	if addressLimit == 0 && routeLimit == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	keys := []string{pendingByAddress + strings.ToLower(req.ShippingAddress), pendingByRoute + route.Key()}
+	res, err := takePendingSlotScript.Run(ctx, e.redisClient, keys, txid, addressLimit, routeLimit, now.UnixMilli(), now.Add(-pendingSlotTTL).UnixMilli()).Int64Slice()
+	if err != nil || len(res) != 2 {
+		e.logger.Errorw("failed to take a pending slot", "txid", txid, "error", err)
+		return protocolErrorf(ErrCodeInternal, "", "unable to check pending bridges, please try again")
+	}
+
+	switch res[0] {
+	case 1:
+		RejectionsInc(RejectAddressPending)
+		return protocolErrorf(ErrCodePendingLimit, "data.shippingAddress", "the shipping address already has %d bridges pending, wait for them to complete", res[1])
+	case 2:
+		RejectionsInc(RejectRoutePending)
+		return protocolErrorf(ErrCodePendingLimit, "data", "bridging %s from %s to %s is busy, please try again later", req.Currency, req.FromChain, req.BridgeTo)
+	}
+	return nil
+}
+
+// addPendingSlots takes the slots of a bridge that is watched again, e.g. after a retry,
+// without checking the limits.
+func (e *ExchangeServer) addPendingSlots(ctx context.Context, awr AccountWatchRequest) error {
+	score := float64(time.Now().UnixMilli())
+	_, err := e.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range pendingSlotKeys(awr) {
+			pipe.ZAdd(ctx, key, redis.Z{Score: score, Member: awr.TransactionID})
+		}
+		return nil
+	})
+	return err
+}
+
+// releasePendingSlots gives back the slots of a bridge that is no longer watched.
+func (e *ExchangeServer) releasePendingSlots(ctx context.Context, awr AccountWatchRequest) error {
+	_, err := e.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range pendingSlotKeys(awr) {
+			pipe.ZRem(ctx, key, awr.TransactionID)
+		}
+		return nil
+	})
+	return err
+}
+
+// syncPendingSlots takes the slots of every bridge being watched, e.g. those started before
+// the slots were kept.
+func (e *ExchangeServer) syncPendingSlots(ctx context.Context) {
+	watching, err := e.retrieveAccountWatchRequestsFromDB()
+	if err != nil {
+		e.logger.Errorw("failed to retrieve account watch requests", "error", err)
+		return
+	}
+	for _, awr := range watching {
+		if err := e.addPendingSlots(ctx, awr); err != nil {
+			e.bridgeLogger(awr).Errorw("failed to take the pending slots", "error", err)
+		}
+	}
+}
+
+func pendingSlotKeys(awr AccountWatchRequest) []string {
+	return []string{
+		pendingByAddress + strings.ToLower(awr.AssistedSellOrderInformation.SellerShippingAddress),
+		pendingByRoute + routeOf(awr).Key(),
+	}
+}
+
+// maxPendingWatchesOf returns how many bridges a route can watch at once, 0 for no limit.
+func (e *ExchangeServer) maxPendingWatchesOf(r Route) int {
+	if n, ok := e.maxPendingWatchesByRoute[r.Key()]; ok {
+		return n
+	}
+	return e.maxPendingWatches
+}
+
+// parseRouteLimits parses a comma separated list of "currency:fromChain:bridgeTo=count" pairs,
+// e.g. "octa:octa:grams=100,bscusdt:bscusdt:grams=20". The routes must be supported.
+func parseRouteLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.Count(kv[0], ":") != 2 {
+			return nil, fmt.Errorf("invalid route limit %q, expected currency:fromChain:bridgeTo=count", pair)
+		}
+		key := strings.ToLower(kv[0])
+		if !isSupportedRouteKey(key) {
+			return nil, fmt.Errorf("unsupported route %s", kv[0])
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit for route %s: %q", kv[0], kv[1])
+		}
+		limits[key] = n
+	}
+	return limits, nil
+}
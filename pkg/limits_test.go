@@ -0,0 +1,89 @@
+package be
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCheckPendingLimits(t *testing.T) {
+	e, _ := newTestServer(t)
+	ctx := context.Background()
+	e.maxPendingPerAddress = 2
+	e.maxPendingWatches = 3
+	e.maxPendingWatchesByRoute = map[string]int{"bscusdt:bscusdt:grams": 1}
+
+	octa := func(address string) BridgeRequest {
+		return BridgeRequest{Currency: "octa", FromChain: "octa", BridgeTo: "grams", ShippingAddress: address}
+	}
+	bscusdt := BridgeRequest{Currency: "bscusdt", FromChain: "bscusdt", BridgeTo: "grams", ShippingAddress: "0xd"}
+	take := func(req BridgeRequest, txid string, want string) {
+		t.Helper()
+		perr := e.checkPendingLimits(ctx, req, txid)
+		switch {
+		case want == "" && perr != nil:
+			t.Fatalf("checkPendingLimits(%s, %q) = %v, want no error", req.ShippingAddress, txid, perr)
+		case want != "" && (perr == nil || perr.Code != ErrCodePendingLimit || perr.Field != want):
+			t.Fatalf("checkPendingLimits(%s, %q) = %v, want a pending limit on %s", req.ShippingAddress, txid, perr, want)
+		}
+	}
+
+	take(octa("0xA"), "a1", "")
+	take(octa("0xa"), "a2", "")
+	// addresses are counted case insensitively.
+	take(octa("0xA"), "a3", "data.shippingAddress")
+	take(octa("0xb"), "b1", "")
+	take(octa("0xc"), "c1", "data")
+	// checking without a txid takes no slot.
+	take(bscusdt, "", "")
+	take(bscusdt, "d1", "")
+	take(bscusdt, "d2", "data")
+
+	a1 := AccountWatchRequest{TransactionID: "a1", Chain: "octa", AssistedSellOrderInformation: AssistedTradeOrderInformation{
+		SellerShippingAddress: "0xA", Currency: "octa", BridgeTo: "grams",
+	}}
+	if err := e.releasePendingSlots(ctx, a1); err != nil {
+		t.Fatal(err)
+	}
+	take(octa("0xc"), "c1", "")
+
+	// releasing a bridge twice does not free the slot of another.
+	if err := e.releasePendingSlots(ctx, a1); err != nil {
+		t.Fatal(err)
+	}
+	take(octa("0xc"), "c2", "data")
+
+	// a retried bridge takes its slots back whatever the limits.
+	if err := e.addPendingSlots(ctx, a1); err != nil {
+		t.Fatal(err)
+	}
+	take(octa("0xA"), "a4", "data.shippingAddress")
+	take(octa("0xe"), "e1", "data")
+}
+
+func TestCheckPendingLimitsConcurrently(t *testing.T) {
+	e, _ := newTestServer(t)
+	ctx := context.Background()
+	e.maxPendingWatches = 5
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := BridgeRequest{Currency: "octa", FromChain: "octa", BridgeTo: "grams", ShippingAddress: fmt.Sprintf("0x%d", i)}
+			if perr := e.checkPendingLimits(ctx, req, fmt.Sprintf("tx%d", i)); perr == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if taken != 5 {
+		t.Errorf("%d bridges took a slot, want 5", taken)
+	}
+}
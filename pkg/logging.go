@@ -0,0 +1,193 @@
+package be
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// redactedValue replaces key material in logs.
+const redactedValue = "[redacted]"
+
+// secretFields are the fields, by lowercase JSON name, that hold key material.
+var secretFields = map[string]bool{
+	"privatekey":         true,
+	"frompk":             true,
+	"secret":             true,
+	"secrethash":         true,
+	"previoussecrethash": true,
+}
+
+// newLogger returns base with key material removed from its fields and every line tagged
+// with the pod it was logged on.
+func newLogger(base *zap.SugaredLogger, pod string) *zap.SugaredLogger {
+	return base.Desugar().WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return redactingCore{core}
+	})).Sugar().With("pod", pod)
+}
+
+// bridgeLogger returns a logger whose lines carry the fields that identify the bridge of awr.
+func (e *ExchangeServer) bridgeLogger(awr AccountWatchRequest) *zap.SugaredLogger {
+	return e.logger.With("txid", awr.TransactionID, "awrid", awr.AWRID, "sid", awr.WSClientID, "route", routeOf(awr).Key())
+}
+
+// redactingCore removes key material from the structured fields of every log entry. Structs
+// logged with %v are redacted by their Format methods.
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(ent, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch {
+		case f.Type == zapcore.StringType && secretFields[strings.ToLower(f.Key)] && f.String != "":
+			f.String = redactedValue
+		case f.Type == zapcore.ReflectType:
+			f.Interface = redactValue(f.Interface)
+		}
+		redacted[i] = f
+	}
+	return redacted
+}
+
+// redactValue returns v as it is encoded to JSON, with the secret fields at any depth
+// replaced. Values without secret fields are returned as they are.
+func redactValue(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return v
+	}
+	if !redactSecrets(generic) {
+		return v
+	}
+	return generic
+}
+
+// redactSecrets replaces the secret fields in a decoded JSON value and reports whether it
+// found any.
+func redactSecrets(v interface{}) bool {
+	found := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok && secretFields[strings.ToLower(key)] {
+				if s != "" {
+					v[key] = redactedValue
+					found = true
+				}
+				continue
+			}
+			found = redactSecrets(value) || found
+		}
+	case []interface{}:
+		for _, value := range v {
+			found = redactSecrets(value) || found
+		}
+	}
+	return found
+}
+
+// redact returns s, or redactedValue if it is set.
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// formatDirective rebuilds the directive a value is being formatted with.
+func formatDirective(f fmt.State, verb rune) string {
+	var b strings.Builder
+	b.WriteByte('%')
+	for _, flag := range "+-# 0" {
+		if f.Flag(int(flag)) {
+			b.WriteRune(flag)
+		}
+	}
+	if width, ok := f.Width(); ok {
+		b.WriteString(strconv.Itoa(width))
+	}
+	if prec, ok := f.Precision(); ok {
+		b.WriteByte('.')
+		b.WriteString(strconv.Itoa(prec))
+	}
+	b.WriteRune(verb)
+	return b.String()
+}
+
+// Format prints the wallet without its private key.
+func (w EscrowWallet) Format(f fmt.State, verb rune) {
+	type escrowWallet EscrowWallet
+	w.PrivateKey = redact(w.PrivateKey)
+	fmt.Fprintf(f, formatDirective(f, verb), escrowWallet(w))
+}
+
+// Format prints the bridge account without its private key.
+func (b BridgeStorage) Format(f fmt.State, verb rune) {
+	type bridgeStorage BridgeStorage
+	b.PrivateKey = redact(b.PrivateKey)
+	fmt.Fprintf(f, formatDirective(f, verb), bridgeStorage(b))
+}
+
+// Format prints the request without the private key it pays from.
+func (m MintRequest) Format(f fmt.State, verb rune) {
+	type mintRequest MintRequest
+	m.FromPk = redact(m.FromPk)
+	fmt.Fprintf(f, formatDirective(f, verb), mintRequest(m))
+}
+
+// Format prints the bridge without the private key of its escrow.
+func (pb PendingBridge) Format(f fmt.State, verb rune) {
+	type pendingBridge PendingBridge
+	pb.PrivateKey = redact(pb.PrivateKey)
+	fmt.Fprintf(f, formatDirective(f, verb), pendingBridge(pb))
+}
+
+// Format prints the account without its private key.
+func (r AccountGenResponse) Format(f fmt.State, verb rune) {
+	type accountGenResponse AccountGenResponse
+	r.PrivateKey = redact(r.PrivateKey)
+	fmt.Fprintf(f, formatDirective(f, verb), accountGenResponse(r))
+}
+
+// Format prints the webhook without its signing secret.
+func (wh Webhook) Format(f fmt.State, verb rune) {
+	type webhook Webhook
+	wh.Secret = redact(wh.Secret)
+	fmt.Fprintf(f, formatDirective(f, verb), webhook(wh))
+}
+
+// Format prints the key without the hashes of its secrets.
+func (k APIKey) Format(f fmt.State, verb rune) {
+	type apiKey APIKey
+	k.SecretHash = redact(k.SecretHash)
+	k.PreviousSecretHash = redact(k.PreviousSecretHash)
+	fmt.Fprintf(f, formatDirective(f, verb), apiKey(k))
+}
@@ -41,3 +41,222 @@ func BridgeRequestsDurationSet(awrr AccountWatchRequestResult) {
 		awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo,
 	).Set(duration.Seconds())
 }
+
+var webhookDeliveries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "webhook_delivery_attempts_total",
+		Help: "Number of webhook delivery attempts, partitioned by the resulting delivery status",
+	},
+	[]string{"status"},
+)
+
+func WebhookDeliveriesInc(status string) {
+	webhookDeliveries.WithLabelValues(status).Inc()
+}
+
+var rejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "bridge_rejections_total",
+		Help: "Number of requests rejected by rate limits and pending bridge caps, partitioned by reason",
+	},
+	[]string{"reason"},
+)
+
+func RejectionsInc(reason string) {
+	rejections.WithLabelValues(reason).Inc()
+}
+
+var bridgeDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "bridge_duration_seconds",
+		Help:    "Time from the creation of a bridge to its outcome, partitioned by outcome, asset, fromChain, bridgeTo",
+		Buckets: prometheus.ExponentialBuckets(30, 2, 10),
+	},
+	[]string{"outcome", "asset", "fromChain", "bridgeTo"},
+)
+
+// BridgeDurationObserve records how long a bridge took to reach its outcome.
+func BridgeDurationObserve(outcome string, awr AccountWatchRequest) {
+	if awr.CreatedTime.IsZero() {
+		return
+	}
+	bridgeDuration.WithLabelValues(
+		outcome,
+		awr.AssistedSellOrderInformation.Currency,
+		awr.Chain,
+		awr.AssistedSellOrderInformation.BridgeTo,
+	).Observe(time.Since(awr.CreatedTime).Seconds())
+}
+
+// bridge stages timed in bridge_stage_duration_seconds.
+const (
+	// StageDeposit is from the creation of a bridge until its deposit is detected.
+	StageDeposit = "deposit"
+	// StageSettlement is the mint or release request to the shim.
+	StageSettlement = "settlement"
+	// StageRefund is sending a refund from the escrow.
+	StageRefund = "refund"
+)
+
+var bridgeStageDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "bridge_stage_duration_seconds",
+		Help:    "Duration of the stages of a bridge, partitioned by stage, asset, fromChain, bridgeTo",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 15),
+	},
+	[]string{"stage", "asset", "fromChain", "bridgeTo"},
+)
+
+// BridgeStageObserve records that a stage of awr took d.
+func BridgeStageObserve(stage string, awr AccountWatchRequest, d time.Duration) {
+	bridgeStageDuration.WithLabelValues(
+		stage,
+		awr.AssistedSellOrderInformation.Currency,
+		awr.Chain,
+		awr.AssistedSellOrderInformation.BridgeTo,
+	).Observe(d.Seconds())
+}
+
+var pendingWatches = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "bridge_pending_watches",
+		Help: "Number of bridges waiting for their deposit, partitioned by asset, fromChain, bridgeTo",
+	},
+	[]string{"asset", "fromChain", "bridgeTo"},
+)
+
+var watchRequests = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "bridge_watch_requests",
+		Help: "Number of account watch requests, partitioned by whether a pod holds their lease",
+	},
+	[]string{"locked"},
+)
+
+// WatchRequestsSet updates the pending watch gauges from the active account watch requests.
+func WatchRequestsSet(requests []AccountWatchRequest) {
+	byRoute := make(map[Route]int, len(supportedRoutes))
+	for _, route := range supportedRoutes {
+		byRoute[route] = 0
+	}
+	var locked, unlocked int
+	for _, awr := range requests {
+		byRoute[routeOf(awr)]++
+		if awr.Locked {
+			locked++
+		} else {
+			unlocked++
+		}
+	}
+	for route, n := range byRoute {
+		pendingWatches.WithLabelValues(route.Currency, route.FromChain, route.BridgeTo).Set(float64(n))
+	}
+	watchRequests.WithLabelValues("true").Set(float64(locked))
+	watchRequests.WithLabelValues("false").Set(float64(unlocked))
+}
+
+var rpcDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "rpc_request_duration_seconds",
+		Help:    "Duration of chain RPC requests, partitioned by chain, endpoint and method",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"chain", "endpoint", "method"},
+)
+
+var rpcErrors = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rpc_request_errors_total",
+		Help: "Number of chain RPC requests that failed or got a non 2xx response, partitioned by chain, endpoint and method",
+	},
+	[]string{"chain", "endpoint", "method"},
+)
+
+func RPCRequestObserve(chain, endpoint, method string, d time.Duration, failed bool) {
+	rpcDuration.WithLabelValues(chain, endpoint, method).Observe(d.Seconds())
+	if failed {
+		rpcErrors.WithLabelValues(chain, endpoint, method).Inc()
+	}
+}
+
+var rpcEndpointHealthy = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "rpc_endpoint_healthy",
+		Help: "Whether calls are sent to an RPC endpoint (1) or it is out of rotation (0), partitioned by chain and endpoint",
+	},
+	[]string{"chain", "endpoint"},
+)
+
+var rpcEndpointLag = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "rpc_endpoint_lag_blocks",
+		Help: "Number of blocks an RPC endpoint is behind the most synced endpoint of its chain, partitioned by chain and endpoint",
+	},
+	[]string{"chain", "endpoint"},
+)
+
+func RPCEndpointSet(chain, endpoint string, healthy bool, lag uint64) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	rpcEndpointHealthy.WithLabelValues(chain, endpoint).Set(value)
+	rpcEndpointLag.WithLabelValues(chain, endpoint).Set(float64(lag))
+}
+
+var shimRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "shim_requests_total",
+		Help: "Number of shim requests, partitioned by endpoint and status class (2xx, 4xx, 5xx or error)",
+	},
+	[]string{"endpoint", "status"},
+)
+
+var shimDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "shim_request_duration_seconds",
+		Help:    "Duration of shim requests, partitioned by endpoint",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	},
+	[]string{"endpoint"},
+)
+
+func ShimRequestObserve(endpoint, status string, d time.Duration) {
+	shimRequests.WithLabelValues(endpoint, status).Inc()
+	shimDuration.WithLabelValues(endpoint).Observe(d.Seconds())
+}
+
+var websocketConnections = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "websocket_connections",
+		Help: "Number of open WebSocket connections",
+	},
+)
+
+func WebSocketConnectionsAdd(n float64) {
+	websocketConnections.Add(n)
+}
+
+var redisDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "redis_operation_duration_seconds",
+		Help:    "Duration of Redis operations, partitioned by command, or pipeline for pipelines",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+	},
+	[]string{"command"},
+)
+
+var redisErrors = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "redis_operation_errors_total",
+		Help: "Number of failed Redis operations, partitioned by command, or pipeline for pipelines",
+	},
+	[]string{"command"},
+)
+
+func RedisOperationObserve(command string, d time.Duration, failed bool) {
+	redisDuration.WithLabelValues(command).Observe(d.Seconds())
+	if failed {
+		redisErrors.WithLabelValues(command).Inc()
+	}
+}
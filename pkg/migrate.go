@@ -0,0 +1,138 @@
+package be
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"go.uber.org/zap"
+)
+
+// Migration upgrades records stored by earlier versions of the bridge to the current format.
+// Migrations are idempotent, so running one twice does nothing the second time.
+type Migration struct {
+	Name        string
+	Description string
+	run         func(ctx context.Context, e *ExchangeServer, dryRun bool) (int, error)
+}
+
+// MigrationResult reports how many records a migration changed, or would change on a dry run.
+type MigrationResult struct {
+	Name    string `json:"name"`
+	Changed int    `json:"changed"`
+	DryRun  bool   `json:"dryRun,omitempty"`
+}
+
+// stateLists are the account watch request lists and the state their requests are in.
+var stateLists = []struct {
+	key, state string
+}{
+	{"accountwatchrequests", BridgeStatePending},
+	{heldAccountWatchRequests, BridgeStateHeld},
+	{unconfirmedAccountWatchRequests, BridgeStateUnconfirmed},
+	{"expiredaccountwatchrequests", BridgeStateExpired},
+	{"failedaccountwatchrequests", BridgeStateFailed},
+	{"refundedaccountwatchrequests", BridgeStateRefunded},
+	{"resolvedaccountwatchrequests", BridgeStateResolved},
+}
+
+// Migrations are the storage migrations, in the order they should be run.
+var Migrations = []Migration{
+	{
+		Name:        "bridge-states",
+		Description: "set the state of bridges stored before states were recorded from the list they are in",
+		run:         migrateBridgeStates,
+	},
+	{
+		Name:        "history-backfill",
+		Description: "add bridges stored before the bridge history was kept to it",
+		run:         migrateHistoryBackfill,
+	},
+}
+
+// Migrator runs the storage migrations against Redis.
+type Migrator struct {
+	e *ExchangeServer
+}
+
+// NewMigrator returns a Migrator of the bridge data in rdb.
+func NewMigrator(rdb *redis.Client) *Migrator {
+	return &Migrator{e: &ExchangeServer{redisClient: rdb, logger: zap.NewNop().Sugar()}}
+}
+
+// Run runs the named migration.
+func (m *Migrator) Run(ctx context.Context, name string, dryRun bool) (MigrationResult, error) {
+	for _, migration := range Migrations {
+		if migration.Name == name {
+			changed, err := migration.run(ctx, m.e, dryRun)
+			return MigrationResult{Name: name, Changed: changed, DryRun: dryRun}, err
+		}
+	}
+	return MigrationResult{}, fmt.Errorf("unknown migration %q", name)
+}
+
+// migrateBridgeStates sets the state of requests that have none from the list they are in.
+func migrateBridgeStates(ctx context.Context, e *ExchangeServer, dryRun bool) (int, error) {
+	var changed int
+	for _, list := range stateLists {
+		requests, err := e.retrieveAccountWatchRequestList(list.key)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %w", list.key, err)
+		}
+		var n int
+		for i := range requests {
+			if requests[i].State == "" {
+				requests[i].State = list.state
+				n++
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		changed += n
+		if dryRun {
+			continue
+		}
+		if err := e.storeAccountWatchRequestList(ctx, list.key, requests); err != nil {
+			return changed, fmt.Errorf("%s: %w", list.key, err)
+		}
+	}
+	return changed, nil
+}
+
+// migrateHistoryBackfill records the requests of every list that are not in the history yet.
+func migrateHistoryBackfill(ctx context.Context, e *ExchangeServer, dryRun bool) (int, error) {
+	var changed int
+	for _, list := range stateLists {
+		requests, err := e.retrieveAccountWatchRequestList(list.key)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %w", list.key, err)
+		}
+		for _, awr := range requests {
+			recorded, err := e.redisClient.HExists(ctx, historyKey, awr.TransactionID).Result()
+			if err != nil {
+				return changed, err
+			}
+			if recorded {
+				continue
+			}
+			changed++
+			if dryRun {
+				continue
+			}
+			if awr.State == "" {
+				awr.State = list.state
+			}
+			view := bridgeView(awr)
+			if view.CreatedTime.IsZero() {
+				// requests without a creation time are ordered as if created at their deadline.
+				view.CreatedTime = time.Unix(awr.TimeOut, 0)
+			}
+			if err := e.storeHistoryRecord(ctx, view); err != nil {
+				return changed, fmt.Errorf("%s: %w", awr.TransactionID, err)
+			}
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,271 @@
+package be
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	// nonceLockTTL bounds how long a pod may hold the nonce lock of an address. The lock is
+	// held while a transaction is signed and sent, not while it is mined.
+	nonceLockTTL = 30 * time.Second
+	// nonceLockTimeout bounds the calls made under a nonce lock, so that they are given up on
+	// before the lock can expire and be taken by another pod.
+	nonceLockTimeout = 20 * time.Second
+	// nonceLockRetry is how often a pod tries to take a nonce lock held by another.
+	nonceLockRetry = 100 * time.Millisecond
+	// nonceStateTTL is how long the nonces of an address are remembered after its last
+	// transaction. They are synced from the chain again after that.
+	nonceStateTTL = 24 * time.Hour
+	// nonceWaiterTTL bounds how long the nonce of a transaction stays reserved for the sender
+	// waiting for it to be mined after the sender stops renewing it, e.g. because its pod died.
+	nonceWaiterTTL = time.Minute
+)
+
+// nonceState is what the nonce manager knows of the transactions of an address. It is stored
+// as JSON under nonces:<chain>:<address>.
+type nonceState struct {
+	// Next is the nonce given to the next transaction, unless there is a gap to fill.
+	Next uint64 `json:"next"`
+	// Outstanding are the nonces given out that are not mined yet, with the hash of the last
+	// transaction sent with each. Nonces used by transactions sent by others have no hash.
+	Outstanding map[uint64]string `json:"outstanding,omitempty"`
+}
+
+func nonceKey(chain string, address common.Address) string {
+	return "nonces:" + chain + ":" + strings.ToLower(address.Hex())
+}
+
+// nonceWaiterKey is the lock the sender of the transaction with nonce holds until it is mined.
+// Its nonce is not given out again while it is held, even if the nodes dropped the transaction.
+func nonceWaiterKey(chain string, address common.Address, nonce uint64) string {
+	return fmt.Sprintf("noncewaiter:%s:%s:%d", chain, strings.ToLower(address.Hex()), nonce)
+}
+
+// nonceWaited reports whether a sender still waits for the transaction with nonce. Errors
+// count as waited, so that a nonce is never given out twice.
+func (e *ExchangeServer) nonceWaited(ctx context.Context, chain string, address common.Address, nonce uint64) bool {
+	n, err := e.redisClient.Exists(ctx, nonceWaiterKey(chain, address, nonce)).Result()
+	if err != nil {
+		e.logger.Errorw("failed to check the waiter of a nonce", "chain", chain, "address", address.Hex(), "nonce", nonce, "error", err)
+		return true
+	}
+	return n > 0
+}
+
+// lockNonces takes the nonce lock of address on chain, waiting for other pods to release it.
+// It returns the context to make the calls under the lock with, which ends before the lock
+// can expire, and a function that releases the lock if it is still ours.
+func (e *ExchangeServer) lockNonces(ctx context.Context, chain string, address common.Address) (context.Context, func(), error) {
+	key := "noncelock:" + chain + ":" + strings.ToLower(address.Hex())
+	for {
+		lock, err := e.tryLock(ctx, key, nonceLockTTL)
+		if err != nil {
+			return nil, nil, err
+		}
+		if lock != nil {
+			ctx, cancel := context.WithTimeout(ctx, nonceLockTimeout)
+			return ctx, func() {
+				cancel()
+				if err := lock.release(); err != nil {
+					e.logger.Errorw("failed to release the nonce lock", "chain", chain, "address", address.Hex(), "error", err)
+				}
+			}, nil
+		}
+		select {
+		case <-time.After(nonceLockRetry):
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("waiting for the nonce lock of %s: %w", address.Hex(), ctx.Err())
+		}
+	}
+}
+
+func (e *ExchangeServer) retrieveNonceState(ctx context.Context, chain string, address common.Address) (*nonceState, error) {
+	data, err := e.redisClient.Get(ctx, nonceKey(chain, address)).Bytes()
+	if err == redis.Nil {
+		return &nonceState{Outstanding: map[uint64]string{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &nonceState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Outstanding == nil {
+		state.Outstanding = map[uint64]string{}
+	}
+	return state, nil
+}
+
+func (e *ExchangeServer) storeNonceState(ctx context.Context, chain string, address common.Address, state *nonceState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return e.redisClient.Set(ctx, nonceKey(chain, address), data, nonceStateTTL).Err()
+}
+
+// syncNonces brings state up to date with the chain. Mined nonces are forgotten, and nonces
+// the node has pending that we did not give out are kept clear of.
+func syncNonces(ctx context.Context, rpc *ethclient.Client, address common.Address, state *nonceState) (latest uint64, err error) {
+	latest, err = rpc.NonceAt(ctx, address, nil)
+	if err != nil {
+		return 0, err
+	}
+	pending, err := rpc.PendingNonceAt(ctx, address)
+	if err != nil {
+		return 0, err
+	}
+	for nonce := range state.Outstanding {
+		if nonce < latest {
+			delete(state.Outstanding, nonce)
+		}
+	}
+	if state.Next < latest {
+		state.Next = latest
+	}
+	for ; state.Next < pending; state.Next++ {
+		state.Outstanding[state.Next] = ""
+	}
+	return latest, nil
+}
+
+// nextNonce returns the lowest nonce from latest on whose transaction the nodes dropped, or
+// the lowest from state.Next on if there is none. Nonces waited returns true for are skipped,
+// their sender may still replace the dropped transaction.
+func nextNonce(ctx context.Context, rpc *ethclient.Client, latest uint64, state *nonceState, waited func(nonce uint64) bool) uint64 {
+	for nonce := latest; ; nonce++ {
+		if nonce >= state.Next {
+			if !waited(nonce) {
+				return nonce
+			}
+			continue
+		}
+		hash, ok := state.Outstanding[nonce]
+		if ok && hash == "" {
+			continue
+		}
+		if ok {
+			if _, _, err := rpc.TransactionByHash(ctx, common.HexToHash(hash)); !errors.Is(err, ethereum.NotFound) {
+				continue
+			}
+		}
+		if !waited(nonce) {
+			return nonce
+		}
+	}
+}
+
+// isNonceConflict tells whether a node refused a transaction because its nonce is used.
+func isNonceConflict(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "nonce too low") || strings.Contains(msg, "already known") ||
+		strings.Contains(msg, "replacement transaction underpriced")
+}
+
+// sendWithNonce calls send with the nonce the next transaction of address on chain is given.
+// send signs and sends the transaction with the context it is given. The nonce lock of the
+// address is held throughout, so that concurrent sends from any pod get different nonces.
+// Nonces of transactions the nodes dropped are given out again first, unless their sender
+// still waits for them. When the node refuses the nonce, the nonces are synced from the chain
+// again and send is retried once.
+//
+// It returns the waiter lock of the nonce, which the caller keeps until the transaction is
+// mined and then releases.
+func (e *ExchangeServer) sendWithNonce(ctx context.Context, chain string, rpc *ethclient.Client, address common.Address, send func(ctx context.Context, nonce uint64) (*types.Transaction, error)) (*types.Transaction, *redisLock, error) {
+	ctx, unlock, err := e.lockNonces(ctx, chain, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	state, err := e.retrieveNonceState(ctx, chain, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	waited := func(nonce uint64) bool { return e.nonceWaited(ctx, chain, address, nonce) }
+	for attempt := 0; ; attempt++ {
+		latest, err := syncNonces(ctx, rpc, address, state)
+		if err != nil {
+			return nil, nil, err
+		}
+		nonce := nextNonce(ctx, rpc, latest, state, waited)
+		// the nonce lock is held, so no other sender can take the waiter lock of a free nonce.
+		waiter, err := e.tryLock(ctx, nonceWaiterKey(chain, address, nonce), nonceWaiterTTL)
+		if err == nil && waiter == nil {
+			err = fmt.Errorf("the nonce %d of %s is waited for", nonce, address.Hex())
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tx, err := send(ctx, nonce)
+		if err == nil {
+			state.Outstanding[nonce] = tx.Hash().Hex()
+			if nonce >= state.Next {
+				state.Next = nonce + 1
+			}
+			if err := e.storeNonceState(ctx, chain, address, state); err != nil {
+				e.logger.Errorw("failed to store nonces", "chain", chain, "address", address.Hex(), "error", err)
+			}
+			return tx, waiter, nil
+		}
+		if err := waiter.release(); err != nil {
+			e.logger.Errorw("failed to release the waiter of a nonce", "chain", chain, "address", address.Hex(), "nonce", nonce, "error", err)
+		}
+		if attempt > 0 || !isNonceConflict(err) {
+			return nil, nil, err
+		}
+		e.logger.Infow("nonce in use, syncing nonces from the chain", "chain", chain, "address", address.Hex(), "nonce", nonce, "error", err)
+		state = &nonceState{Outstanding: map[uint64]string{}}
+	}
+}
+
+// replaceNonce calls send to replace the transaction with nonce, and records that it was
+// replaced by the transaction sent, so that the replaced one no longer being known to the
+// nodes does not free the nonce. waiter is the waiter lock of the nonce. Once it is lost the
+// nonce may have been given to another transaction, which a replacement would replace, so
+// nothing is sent.
+func (e *ExchangeServer) replaceNonce(ctx context.Context, chain string, address common.Address, nonce uint64, waiter *redisLock, send func(ctx context.Context) (*types.Transaction, error)) (*types.Transaction, error) {
+	ctx, unlock, err := e.lockNonces(ctx, chain, address)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	held, err := waiter.held(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !held {
+		return nil, fmt.Errorf("the nonce %d of %s is no longer ours, it may have been given to another transaction", nonce, address.Hex())
+	}
+	tx, err := send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := e.retrieveNonceState(ctx, chain, address)
+	if err != nil {
+		return nil, err
+	}
+	state.Outstanding[nonce] = tx.Hash().Hex()
+	if state.Next <= nonce {
+		state.Next = nonce + 1
+	}
+	if err := e.storeNonceState(ctx, chain, address, state); err != nil {
+		e.logger.Errorw("failed to record replaced transaction", "chain", chain, "address", address.Hex(), "nonce", nonce, "error", err)
+	}
+	return tx, nil
+}
@@ -0,0 +1,239 @@
+package be
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// fakeNode answers the JSON-RPC calls the nonce manager makes: the latest and pending nonce
+// of any address, and the transactions it knows by hash.
+type fakeNode struct {
+	latest, pending uint64
+	known           map[string]*types.Transaction
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	switch req.Method {
+	case "eth_getTransactionCount":
+		var block string
+		json.Unmarshal(req.Params[1], &block)
+		result = hexutil.Uint64(n.latest)
+		if block == "pending" {
+			result = hexutil.Uint64(n.pending)
+		}
+	case "eth_getTransactionByHash":
+		var hash string
+		json.Unmarshal(req.Params[0], &hash)
+		if tx, ok := n.known[strings.ToLower(hash)]; ok {
+			result = tx
+		}
+	default:
+		http.Error(w, "unexpected method "+req.Method, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+}
+
+func dialFakeNode(t *testing.T, n *fakeNode) *ethclient.Client {
+	server := httptest.NewServer(n)
+	t.Cleanup(server.Close)
+	rpc, err := ethclient.Dial(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rpc.Close)
+	return rpc
+}
+
+func signedTx(t *testing.T, nonce uint64) *types.Transaction {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := types.SignTx(types.NewTransaction(nonce, common.Address{1}, big.NewInt(1), 21000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestSyncNonces(t *testing.T) {
+	tests := []struct {
+		name            string
+		latest, pending uint64
+		state           nonceState
+		want            nonceState
+	}{
+		{
+			"new address",
+			5, 5,
+			nonceState{Outstanding: map[uint64]string{}},
+			nonceState{Next: 5, Outstanding: map[uint64]string{}},
+		},
+		{
+			"mined nonces are forgotten",
+			7, 8,
+			nonceState{Next: 8, Outstanding: map[uint64]string{5: "0x5", 6: "0x6", 7: "0x7"}},
+			nonceState{Next: 8, Outstanding: map[uint64]string{7: "0x7"}},
+		},
+		{
+			"nonces sent by others are kept clear of",
+			3, 6,
+			nonceState{Next: 4, Outstanding: map[uint64]string{3: "0x3"}},
+			nonceState{Next: 6, Outstanding: map[uint64]string{3: "0x3", 4: "", 5: ""}},
+		},
+		{
+			"dropped nonces are kept",
+			3, 3,
+			nonceState{Next: 6, Outstanding: map[uint64]string{3: "0x3", 4: "0x4", 5: "0x5"}},
+			nonceState{Next: 6, Outstanding: map[uint64]string{3: "0x3", 4: "0x4", 5: "0x5"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rpc := dialFakeNode(t, &fakeNode{latest: tt.latest, pending: tt.pending})
+			state := tt.state
+			latest, err := syncNonces(context.Background(), rpc, common.Address{2}, &state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if latest != tt.latest {
+				t.Errorf("syncNonces() latest = %d, want %d", latest, tt.latest)
+			}
+			if !reflect.DeepEqual(state, tt.want) {
+				t.Errorf("syncNonces() state = %+v, want %+v", state, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextNonce(t *testing.T) {
+	sent := map[uint64]*types.Transaction{3: signedTx(t, 3), 4: signedTx(t, 4), 5: signedTx(t, 5)}
+	hash := func(nonce uint64) string { return sent[nonce].Hash().Hex() }
+	known := func(nonces ...uint64) map[string]*types.Transaction {
+		txs := make(map[string]*types.Transaction)
+		for _, nonce := range nonces {
+			txs[strings.ToLower(hash(nonce))] = sent[nonce]
+		}
+		return txs
+	}
+
+	tests := []struct {
+		name   string
+		known  map[string]*types.Transaction
+		latest uint64
+		state  nonceState
+		waited []uint64
+		want   uint64
+	}{
+		{"nothing outstanding", nil, 3, nonceState{Next: 3}, nil, 3},
+		{"all known", known(3, 4, 5), 3, nonceState{Next: 6, Outstanding: map[uint64]string{3: hash(3), 4: hash(4), 5: hash(5)}}, nil, 6},
+		{"dropped gap", known(3, 5), 3, nonceState{Next: 6, Outstanding: map[uint64]string{3: hash(3), 4: hash(4), 5: hash(5)}}, nil, 4},
+		{"lowest dropped first", known(5), 3, nonceState{Next: 6, Outstanding: map[uint64]string{3: hash(3), 4: hash(4), 5: hash(5)}}, nil, 3},
+		{"missing nonce", known(3), 3, nonceState{Next: 5, Outstanding: map[uint64]string{3: hash(3)}}, nil, 4},
+		{"sent by others", nil, 3, nonceState{Next: 5, Outstanding: map[uint64]string{3: "", 4: ""}}, nil, 5},
+		{"dropped but waited for", known(5), 3, nonceState{Next: 6, Outstanding: map[uint64]string{3: hash(3), 4: hash(4), 5: hash(5)}}, []uint64{3}, 4},
+		{"next waited for", nil, 7, nonceState{Next: 7}, []uint64{7}, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rpc := dialFakeNode(t, &fakeNode{known: tt.known})
+			state := tt.state
+			waited := func(nonce uint64) bool {
+				for _, n := range tt.waited {
+					if n == nonce {
+						return true
+					}
+				}
+				return false
+			}
+			if got := nextNonce(context.Background(), rpc, tt.latest, &state, waited); got != tt.want {
+				t.Errorf("nextNonce() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonceWaiters(t *testing.T) {
+	e, mr := newTestServer(t)
+	ctx := context.Background()
+	address := common.Address{2}
+	// the node dropped every transaction sent, so their nonces look free.
+	rpc := dialFakeNode(t, &fakeNode{latest: 3, pending: 3})
+	send := func(ctx context.Context, nonce uint64) (*types.Transaction, error) { return signedTx(t, nonce), nil }
+
+	first, firstWaiter, err := e.sendWithNonce(ctx, GRAMS, rpc, address, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Nonce() != 3 {
+		t.Fatalf("first nonce = %d, want 3", first.Nonce())
+	}
+	second, secondWaiter, err := e.sendWithNonce(ctx, GRAMS, rpc, address, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Nonce() != 4 {
+		t.Fatalf("second nonce = %d, want 4 while the first sender waits for 3", second.Nonce())
+	}
+
+	// the first sender replaces its dropped transaction while it waits.
+	replaced := 0
+	replace := func(ctx context.Context) (*types.Transaction, error) {
+		replaced++
+		return signedTx(t, 3), nil
+	}
+	if _, err := e.replaceNonce(ctx, GRAMS, address, 3, firstWaiter, replace); err != nil {
+		t.Fatal(err)
+	}
+
+	// once it stops renewing its waiter, e.g. because its pod died, nonce 3 is filled again
+	// and the first sender can no longer replace the transaction that got it.
+	if err := secondWaiter.release(); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(nonceWaiterTTL + time.Second)
+	third, _, err := e.sendWithNonce(ctx, GRAMS, rpc, address, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Nonce() != 3 {
+		t.Fatalf("third nonce = %d, want the dropped 3", third.Nonce())
+	}
+	if _, err := e.replaceNonce(ctx, GRAMS, address, 3, firstWaiter, replace); err == nil {
+		t.Fatal("replaceNonce succeeded after the nonce was given out again")
+	}
+	if replaced != 1 {
+		t.Errorf("replaced %d times, want once", replaced)
+	}
+	state, err := e.retrieveNonceState(ctx, GRAMS, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Outstanding[3] != third.Hash().Hex() {
+		t.Errorf("nonce 3 is recorded for %s, want the third transaction %s", state.Outstanding[3], third.Hash().Hex())
+	}
+}
@@ -0,0 +1,355 @@
+package be
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Payment outcomes recorded on an AccountWatchRequest once a deposit has been seen.
+const (
+	// PaymentExact received exactly the requested amount.
+	PaymentExact = "exact"
+	// PaymentUnderpaid received less than the requested amount.
+	PaymentUnderpaid = "underpaid"
+	// PaymentOverpaid received more than the requested amount.
+	PaymentOverpaid = "overpaid"
+	// PaymentLate received a deposit after the request expired.
+	PaymentLate = "late"
+)
+
+// Policies for handling overpayments and late deposits.
+const (
+	// OverpaymentRefund settles the requested amount and refunds the excess to the refund address.
+	OverpaymentRefund = "refund"
+	// OverpaymentCredit settles the full amount received.
+	OverpaymentCredit = "credit"
+	// LateDepositRefund refunds deposits that arrive after the request expired.
+	LateDepositRefund = "refund"
+	// LateDepositSettle settles late deposits that cover the requested amount.
+	LateDepositSettle = "settle"
+)
+
+// balanceFunc returns the deposit balance of an escrow account.
+type balanceFunc func(ctx context.Context, account string) (*big.Int, error)
+
+// rpcCall calls fn with the client of an endpoint of a chain, see EthereumNode.do and
+// EthereumNode.calls.
+type rpcCall func(ctx context.Context, fn func(*ethclient.Client) error) error
+
+// nativeBalance returns a balanceFunc that reads the native balance of an account.
+func nativeBalance(call rpcCall) balanceFunc {
+	return func(ctx context.Context, account string) (balance *big.Int, err error) {
+		err = call(ctx, func(client *ethclient.Client) error {
+			balance, err = client.BalanceAt(ctx, common.HexToAddress(account), nil)
+			return err
+		})
+		return balance, err
+	}
+}
+
+// tokenBalance returns a balanceFunc that reads a wrapped token balance with one of the
+// query*UserAccountBalance functions.
+func tokenBalance(query func(string, *ethclient.Client) (*big.Int, error), call rpcCall) balanceFunc {
+	return func(ctx context.Context, account string) (balance *big.Int, err error) {
+		err = call(ctx, func(client *ethclient.Client) error {
+			balance, err = query(account, client)
+			return err
+		})
+		return balance, err
+	}
+}
+
+// waitAndVerifyDeposit polls the escrow of request until the requested amount has been deposited,
+// verifying it against the secondary node before dispatching the bridge. Underpayments are given
+// a single top-up window before the request is failed. Failed balance checks are retried on the
+// next tick, only the deadline ends the watch.
+func (a *ExchangeServer) waitAndVerifyDeposit(ctx context.Context, request AccountWatchRequest, primary, secondary balanceFunc) {
+	log := a.bridgeLogger(request)
+	if !a.watch {
+		log.Info("dev mode is on, not watching for payment. Returning success")
+		awrr := &AccountWatchRequestResult{
+			AccountWatchRequest: request,
+			Result:              "success",
+		}
+
+		if err := a.Dispatch(awrr); err != nil {
+			log.Errorw("error dispatching account watch request result", "error", err)
+		}
+		return
+	}
+	primary, secondary = tracedBalance("primary", primary), tracedBalance("secondary", secondary)
+	log.Infow("watching for payment", "account", request.Account, "amount", request.Amount, "chain", request.Chain)
+
+	// create a ticker that ticks every 60 seconds
+	ticker := time.NewTicker(time.Second * 60)
+	defer ticker.Stop()
+	if a.dev {
+		ticker = time.NewTicker(time.Second * 10)
+	}
+
+	// create a timer that fires at the deadline. a request resumed by another pod keeps the
+	// deadline it was created with, and fires immediately if it has already passed.
+	timer := time.NewTimer(time.Until(a.deadline(request)))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			balance, err := primary(ctx, request.Account)
+			if err != nil {
+				log.Errorw("error getting balance", "account", request.Account, "error", err)
+				continue
+			}
+			log.Infow("check balance", "account", request.Account, "balance", balance, "chain", request.Chain)
+			if balance.Cmp(request.Amount) < 0 {
+				continue
+			}
+
+			// verify the balance with the second RPC server.
+			verifiedBalance, err := secondary(ctx, request.Account)
+			if err != nil {
+				log.Errorw("error getting balance from the secondary RPC server", "account", request.Account, "error", err)
+				continue
+			}
+			if verifiedBalance.Cmp(request.Amount) < 0 {
+				log.Infow("secondary RPC server has not seen the deposit yet", "account", request.Account, "balance", verifiedBalance)
+				continue
+			}
+
+			log.Info("attempting to complete order")
+			a.settleDeposit(request, verifiedBalance)
+			return
+		case <-timer.C:
+			balance, err := primary(ctx, request.Account)
+			if err == nil && balance.Cmp(request.Amount) >= 0 {
+				// the deposit arrived since the last poll, or while no pod was watching the request.
+				if verifiedBalance, err := secondary(ctx, request.Account); err == nil && verifiedBalance.Cmp(request.Amount) >= 0 {
+					log.Info("attempting to complete order")
+					a.settleDeposit(request, verifiedBalance)
+					return
+				}
+			}
+			if err == nil && balance.Sign() > 0 && balance.Cmp(request.Amount) < 0 && request.PaymentStatus != PaymentUnderpaid && a.topUpWindow > 0 {
+				a.requestTopUp(&request, balance)
+				timer.Reset(time.Until(a.deadline(request)))
+				continue
+			}
+
+			// if the timer times out, return an error
+			log.Infow("timeout occured waiting for payment", "account", request.Account, "amount", request.Amount)
+			awrr := &AccountWatchRequestResult{
+				AccountWatchRequest: request,
+				Result:              "error",
+			}
+
+			if err := a.Dispatch(awrr); err != nil {
+				log.Errorw("error dispatching account watch request result", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// deadline returns the absolute time the deposit of an account watch request must arrive by.
+// TimeOut holds it as a unix timestamp, requests stored without one fall back to the payment window.
+func (a *ExchangeServer) deadline(awr AccountWatchRequest) time.Time {
+	if awr.TimeOut == 0 {
+		return awr.CreatedTime.Add(a.paymentWindow(routeOf(awr)))
+	}
+	return time.Unix(awr.TimeOut, 0)
+}
+
+// requestTopUp tells the client that only part of the deposit has arrived and gives them the
+// top-up window to send the rest.
+func (a *ExchangeServer) requestTopUp(request *AccountWatchRequest, received *big.Int) {
+	if request.DepositedTime.IsZero() {
+		request.DepositedTime = time.Now()
+		if !request.CreatedTime.IsZero() {
+			BridgeStageObserve(StageDeposit, *request, request.DepositedTime.Sub(request.CreatedTime))
+		}
+		a.recordDepositTx(*request)
+	}
+	request.ReceivedAmount = received
+	request.PaymentStatus = PaymentUnderpaid
+	request.TimeOut = time.Now().Add(a.topUpWindow).Unix()
+	if err := a.updateAccountWatchRequestInDB(*request); err != nil {
+		a.bridgeLogger(*request).Errorw("updating account watch request in db", "error", err.Error())
+	}
+
+	a.emitBridgeEvent(EventBridgeDepositDetected, *request)
+
+	missing := new(big.Int).Sub(request.Amount, received)
+	data := fmt.Sprintf("Received %s of %s. Send the remaining %s to %s within %s or the deposit will be refunded",
+		received.String(), request.Amount.String(), missing.String(), request.Account, a.topUpWindow.String())
+	a.publishStatus(*request, PaymentUnderpaid, data)
+	a.recordPaymentOutcome(*request)
+}
+
+// settleDeposit applies the overpayment policy to a deposit of received and dispatches the bridge.
+func (a *ExchangeServer) settleDeposit(request AccountWatchRequest, received *big.Int) {
+	if request.DepositedTime.IsZero() {
+		request.DepositedTime = time.Now()
+		if !request.CreatedTime.IsZero() {
+			BridgeStageObserve(StageDeposit, request, request.DepositedTime.Sub(request.CreatedTime))
+		}
+		a.recordDepositTx(request)
+	}
+	request.ReceivedAmount = received
+	request.PaymentStatus = PaymentExact
+	if received.Cmp(request.Amount) > 0 {
+		request.PaymentStatus = PaymentOverpaid
+	}
+	a.emitBridgeEvent(EventBridgeDepositDetected, request)
+
+	if received.Cmp(request.Amount) > 0 {
+		excess := new(big.Int).Sub(received, request.Amount)
+		refundAddress := request.AssistedSellOrderInformation.SellerRefundAddress
+
+		var data string
+		if a.overpaymentPolicy == OverpaymentRefund && refundAddress != "" {
+			request.ExcessAmount = excess
+			data = fmt.Sprintf("Received %s, which is %s more than requested. The excess will be refunded to %s", received.String(), excess.String(), refundAddress)
+		} else {
+			request.Amount = received
+			request.AssistedSellOrderInformation.Amount = received
+			data = fmt.Sprintf("Received %s, which is %s more than requested. The full amount will be bridged", received.String(), excess.String())
+		}
+		a.publishStatus(request, PaymentOverpaid, data)
+		a.recordPaymentOutcome(request)
+	}
+
+	if err := a.updateAccountWatchRequestInDB(request); err != nil {
+		a.bridgeLogger(request).Errorw("updating account watch request in db", "error", err.Error())
+	}
+
+	// send a complete order event
+	awrr := &AccountWatchRequestResult{
+		AccountWatchRequest: request,
+		Result:              "success",
+	}
+	if err := a.Dispatch(awrr); err != nil {
+		a.bridgeLogger(request).Errorw("error dispatching account watch request result", "error", err)
+	}
+}
+
+// refundExcess returns the overpaid part of a settled deposit to the refund address.
+func (a *ExchangeServer) refundExcess(awr AccountWatchRequest) {
+	refundAddress := awr.AssistedSellOrderInformation.SellerRefundAddress
+	result, err := a.refundDeposit(context.Background(), awr, refundAddress, awr.ExcessAmount)
+	recordRefund(&awr, result)
+	if err != nil {
+		a.bridgeLogger(awr).Errorw("refunding excess deposit", "error", err)
+		awr.FailureReason = "excess refund failed: " + err.Error()
+		data := "The excess deposit could not be refunded. Please provide this id to support: " + awr.TransactionID
+		a.publishStatus(awr, "error", data)
+		if err := a.storeFailedAccountWatchRequest(awr); err != nil {
+			a.bridgeLogger(awr).Errorw("failed to store failed account watch request", "error", err)
+		}
+		return
+	}
+
+	awr.RefundedTime = time.Now()
+	if err := a.storeRefundedAccountWatchRequest(awr); err != nil {
+		a.bridgeLogger(awr).Errorw("failed to store refunded account watch request", "error", err)
+	}
+	a.recordPaymentOutcome(awr)
+	a.emitBridgeEvent(EventBridgeRefunded, awr)
+	a.publishStatus(awr, "refunded", "The excess deposit has been refunded in transaction "+result.TxHash)
+}
+
+const (
+	// sweepLockTTL is how long the sweep lock is held without being renewed.
+	sweepLockTTL = 30 * time.Second
+	// lateDepositClaimTTL is how long the claim on a late deposit outlives its handling, so
+	// that a pod still holding an old copy of the expired list does not handle it again.
+	lateDepositClaimTTL = 7 * 24 * time.Hour
+)
+
+// sweepExpiredAccountWatchRequests checks the escrows of expired requests for deposits that
+// arrived after the timeout. Requests are forgotten once their grace period is over.
+func (a *ExchangeServer) sweepExpiredAccountWatchRequests(ctx context.Context) {
+	// only one pod sweeps at a time. the lock is renewed while the sweep runs, and the sweep
+	// stops if it is lost.
+	lock, err := a.tryLock(ctx, "expiredaccountwatchrequestslock", sweepLockTTL)
+	if err != nil || lock == nil {
+		return
+	}
+	defer lock.release()
+	ctx, stop := lock.keep(ctx)
+	defer stop()
+
+	expired, err := a.retrieveExpiredAccountWatchRequestsFromDB()
+	if err != nil {
+		a.logger.Errorw("error retrieving expired account watch requests from database", "error", err)
+		return
+	}
+
+	for _, awr := range expired {
+		if time.Now().After(awr.GraceUntil) {
+			a.bridgeLogger(awr).Infow("grace period over, no longer watching expired escrow", "account", awr.Account)
+			if err := a.removeExpiredAccountWatchRequestFromDB(awr.TransactionID); err != nil {
+				a.bridgeLogger(awr).Errorw("failed to remove expired account watch request from db", "error", err)
+			}
+			continue
+		}
+
+		balance, err := a.depositBalance(ctx, awr)
+		if err != nil {
+			a.bridgeLogger(awr).Errorw("error checking expired escrow balance", "account", awr.Account, "error", err)
+			continue
+		}
+		if balance.Sign() == 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			a.logger.Errorw("stopping the sweep of expired escrows", "error", ctx.Err())
+			return
+		}
+
+		// a late deposit is only ever handled once, even by a pod that took over the sweep.
+		claim := "latedepositclaim:" + awr.TransactionID
+		claimed, err := a.redisClient.SetNX(ctx, claim, a.podName, lateDepositClaimTTL).Result()
+		if err != nil || !claimed {
+			a.bridgeLogger(awr).Infow("late deposit already claimed", "error", err)
+			continue
+		}
+		if err := a.removeExpiredAccountWatchRequestFromDB(awr.TransactionID); err != nil {
+			a.bridgeLogger(awr).Errorw("failed to remove expired account watch request from db", "error", err)
+			// let the next sweep handle it.
+			a.redisClient.Del(ctx, claim)
+			continue
+		}
+		a.handleLateDeposit(awr, balance)
+	}
+}
+
+// handleLateDeposit applies the late deposit policy to a deposit found on an expired request.
+func (a *ExchangeServer) handleLateDeposit(awr AccountWatchRequest, balance *big.Int) {
+	a.bridgeLogger(awr).Infow("late deposit found", "balance", balance)
+	awr.ReceivedAmount = balance
+	awr.PaymentStatus = PaymentLate
+	a.recordPaymentOutcome(awr)
+
+	if a.lateDepositPolicy == LateDepositSettle && balance.Cmp(awr.Amount) >= 0 {
+		a.publishStatus(awr, PaymentLate, fmt.Sprintf("A deposit of %s arrived after the timeout. The bridge will be completed", balance.String()))
+		awr.State = BridgeStatePending
+		a.settleDeposit(awr, balance)
+		return
+	}
+
+	a.publishStatus(awr, PaymentLate, fmt.Sprintf("A deposit of %s arrived after the timeout and will be refunded", balance.String()))
+	a.failBridge(awr, fmt.Errorf("deposit of %s arrived after the timeout", balance.String()))
+}
+
+// recordPaymentOutcome stores the latest state of a request whose deposit did not match the
+// requested amount so that the outcome can be looked up later.
+func (a *ExchangeServer) recordPaymentOutcome(awr AccountWatchRequest) {
+	if err := a.storePaymentOutcome(awr); err != nil {
+		a.bridgeLogger(awr).Errorw("failed to store payment outcome", "error", err)
+	}
+}
@@ -0,0 +1,125 @@
+package be
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// pauseAll turns the global kill switch on, so that settled deposits are held instead of
+// being bridged.
+func pauseAll(t *testing.T, e *ExchangeServer) {
+	t.Helper()
+	data, err := json.Marshal(Pause{Scope: PauseGlobal, PausedBy: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.redisClient.HSet(context.Background(), pausesKey, PauseGlobal, data).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// paymentOutcome returns the payment outcome recorded for txid, or nil if there is none.
+func paymentOutcome(t *testing.T, e *ExchangeServer, txid string) *AccountWatchRequest {
+	t.Helper()
+	data, err := e.redisClient.HGet(context.Background(), "paymentoutcomes", txid).Bytes()
+	if err != nil {
+		return nil
+	}
+	var awr AccountWatchRequest
+	if err := json.Unmarshal(data, &awr); err != nil {
+		t.Fatal(err)
+	}
+	return &awr
+}
+
+func TestSettleDeposit(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        string
+		refundAddress bool
+		received      int64
+		wantStatus    string
+		wantAmount    int64
+		wantExcess    int64
+	}{
+		{"exact", OverpaymentRefund, true, 100, PaymentExact, 100, 0},
+		{"overpaid and refunded", OverpaymentRefund, true, 120, PaymentOverpaid, 100, 20},
+		{"overpaid without a refund address", OverpaymentRefund, false, 120, PaymentOverpaid, 120, 0},
+		{"overpaid and credited", OverpaymentCredit, true, 120, PaymentOverpaid, 120, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := newTestServer(t)
+			e.overpaymentPolicy = tt.policy
+			pauseAll(t, e)
+			awr := testBridge("deposit")
+			if !tt.refundAddress {
+				awr.AssistedSellOrderInformation.SellerRefundAddress = ""
+			}
+			if err := e.storeAccountWatchRequestList(context.Background(), "accountwatchrequests", []AccountWatchRequest{awr}); err != nil {
+				t.Fatal(err)
+			}
+
+			e.settleDeposit(awr, big.NewInt(tt.received))
+
+			settled := assertList(t, e, heldAccountWatchRequests, "deposit")[0]
+			if settled.PaymentStatus != tt.wantStatus {
+				t.Errorf("payment status = %q, want %q", settled.PaymentStatus, tt.wantStatus)
+			}
+			if settled.Amount.Int64() != tt.wantAmount || settled.AssistedSellOrderInformation.Amount.Int64() != tt.wantAmount {
+				t.Errorf("bridged %s (order %s), want %d", settled.Amount, settled.AssistedSellOrderInformation.Amount, tt.wantAmount)
+			}
+			if excess := settled.ExcessAmount; (excess == nil && tt.wantExcess != 0) || (excess != nil && excess.Int64() != tt.wantExcess) {
+				t.Errorf("excess = %v, want %d", excess, tt.wantExcess)
+			}
+			if outcome := paymentOutcome(t, e, "deposit"); (outcome != nil) != (tt.wantStatus == PaymentOverpaid) {
+				t.Errorf("payment outcome = %+v for a %s deposit", outcome, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandleLateDeposit(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		balance int64
+		settled bool
+	}{
+		{"refunded", LateDepositRefund, 100, false},
+		{"settled", LateDepositSettle, 100, true},
+		{"settled when overpaid", LateDepositSettle, 150, true},
+		{"underpaid and refunded", LateDepositSettle, 50, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := newTestServer(t)
+			e.lateDepositPolicy = tt.policy
+			e.overpaymentPolicy = OverpaymentRefund
+			pauseAll(t, e)
+			awr := testBridge("late")
+			awr.State = BridgeStateExpired
+			// no node is connected, so refunds fail and the bridge is left for an operator.
+			awr.AssistedSellOrderInformation.SellerRefundAddress = ""
+
+			e.handleLateDeposit(awr, big.NewInt(tt.balance))
+
+			if outcome := paymentOutcome(t, e, "late"); outcome == nil || outcome.ReceivedAmount.Int64() != tt.balance {
+				t.Errorf("payment outcome = %+v, want a late deposit of %d", outcome, tt.balance)
+			}
+			if tt.settled {
+				assertList(t, e, heldAccountWatchRequests, "late")
+				assertList(t, e, "failedaccountwatchrequests")
+				return
+			}
+			assertList(t, e, heldAccountWatchRequests)
+			failed := assertList(t, e, "failedaccountwatchrequests", "late")[0]
+			if failed.PaymentStatus != PaymentLate || !strings.Contains(failed.FailureReason, "after the timeout") {
+				t.Errorf("failed bridge has payment status %q and failure reason %q", failed.PaymentStatus, failed.FailureReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package be
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+)
+
+// ProtocolVersion is the version of the WebSocket protocol spoken by this server. Messages
+// without a version are treated as the current version.
+const ProtocolVersion = 1
+
+// maxMessageIDLength limits the request ids we echo back to clients.
+const maxMessageIDLength = 128
+
+// message types sent by clients.
+const (
+	MsgTypeQuote         = "quote"
+	MsgTypeRequestBridge = "requestBridge"
+	MsgTypeConfirmBridge = "confirmBridge"
+	MsgTypeSubscribe     = "subscribe"
+)
+
+// error codes sent in ErrorMsg. They are part of the protocol and must not change.
+const (
+	ErrCodeInvalidMessage     = "invalid_message"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidAmount      = "invalid_amount"
+	ErrCodeAmountBelowMinimum = "amount_below_minimum"
+	ErrCodeInvalidAddress     = "invalid_address"
+	ErrCodeUnsupportedRoute   = "unsupported_route"
+	ErrCodeCapacityExceeded   = "capacity_exceeded"
+	ErrCodeNoPendingBridge    = "no_pending_bridge"
+	ErrCodeBridgeNotFound     = "bridge_not_found"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodePendingLimit       = "pending_limit_exceeded"
+	ErrCodeAddressRejected    = "address_rejected"
+	ErrCodeRoutePaused        = "route_paused"
+	ErrCodeInternal           = "internal_error"
+)
+
+// protocolSchema is the JSON Schema of every message of the WebSocket protocol.
+//
+//go:embed protocol.schema.json
+var protocolSchema []byte
+
+// ErrorMsg is the reply to a client message that could not be handled. ID is the id of
+// the message that caused the error, if it had one.
+type ErrorMsg struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	ID      string `json:"id,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+// ProtocolError is a client error that is reported back to the client with a stable code.
+type ProtocolError struct {
+	Code    string
+	Message string
+	Field   string
+}
+
+func (p *ProtocolError) Error() string {
+	return p.Code + ": " + p.Message
+}
+
+func protocolErrorf(code, field, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// decodeClientMessage parses and checks the envelope of a client message.
+func decodeClientMessage(message []byte) (RequestBridgeMsg, *ProtocolError) {
+	var req RequestBridgeMsg
+	if err := json.Unmarshal(message, &req); err != nil {
+		return req, protocolErrorf(ErrCodeInvalidMessage, "", "message is not valid: %s", err.Error())
+	}
+	if req.Version == 0 {
+		req.Version = ProtocolVersion
+	}
+	if req.Version != ProtocolVersion {
+		return req, protocolErrorf(ErrCodeUnsupportedVersion, "version", "protocol version %d is not supported, use %d", req.Version, ProtocolVersion)
+	}
+	if len(req.ID) > maxMessageIDLength {
+		req.ID = ""
+		return req, protocolErrorf(ErrCodeInvalidMessage, "id", "id is longer than %d characters", maxMessageIDLength)
+	}
+	if req.Type == "" {
+		return req, protocolErrorf(ErrCodeInvalidMessage, "type", "type is required")
+	}
+	return req, nil
+}
+
+// validateAmount checks that an amount is present and positive.
+func validateAmount(amount *big.Int) *ProtocolError {
+	if amount == nil {
+		return protocolErrorf(ErrCodeInvalidAmount, "data.amount", "amount is required")
+	}
+	if amount.Sign() <= 0 {
+		return protocolErrorf(ErrCodeInvalidAmount, "data.amount", "amount must be positive")
+	}
+	return nil
+}
+
+// validateRoute checks that the currency, source chain and destination chain of a request
+// form a supported route.
+func validateRoute(req BridgeRequest) *ProtocolError {
+	if !isSupportedRoute(routeOfRequest(req)) {
+		return protocolErrorf(ErrCodeUnsupportedRoute, "data", "bridging %s from %s to %s is not supported", req.Currency, req.FromChain, req.BridgeTo)
+	}
+	return nil
+}
+
+// validateQuote checks the fields a quote needs.
+func validateQuote(req BridgeRequest) *ProtocolError {
+	if err := validateRoute(req); err != nil {
+		return err
+	}
+	return validateAmount(req.Amount)
+}
+
+// validateBridgeRequest checks every field of a bridge request.
+func (e *ExchangeServer) validateBridgeRequest(req BridgeRequest) *ProtocolError {
+	if err := validateQuote(req); err != nil {
+		return err
+	}
+	if req.Amount.Cmp(ToWei(e.minimumAmount, 18)) == -1 && !e.dev {
+		return protocolErrorf(ErrCodeAmountBelowMinimum, "data.amount", "amount value is less than the minimum of %d", e.minimumAmount)
+	}
+	// the shipping address receives the bridged asset on bridgeTo, refunds go back to fromChain.
+	if err := validateAddress(req.BridgeTo, req.ShippingAddress); err != nil {
+		return protocolErrorf(ErrCodeInvalidAddress, "data.shippingAddress", "shipping address %s", err.Error())
+	}
+	if req.RefundAddress != "" {
+		if err := validateAddress(req.FromChain, req.RefundAddress); err != nil {
+			return protocolErrorf(ErrCodeInvalidAddress, "data.refundAddress", "refund address %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// sendError replies to the socket that sent the message with id.
+func (e *ExchangeServer) sendError(client *WebSocketClient, id string, perr *ProtocolError) {
+	e.reply(client, ErrorMsg{
+		Type:    "error",
+		Version: ProtocolVersion,
+		ID:      id,
+		Code:    perr.Code,
+		Message: perr.Message,
+		Field:   perr.Field,
+	})
+}
+
+// reply writes a message to a single socket.
+func (e *ExchangeServer) reply(client *WebSocketClient, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		e.logger.Errorw("failed encode reply", "sid", client.sid, "error", err)
+		return
+	}
+	if err := client.write(data); err != nil {
+		e.logger.Errorw("failed to write to websocket", "sid", client.sid, "error", err)
+	}
+}
+
+// handleProtocolSchema serves the JSON Schema of the WebSocket protocol.
+func (e *ExchangeServer) handleProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(protocolSchema)
+}
@@ -0,0 +1,215 @@
+package be
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+// CloudEvent types accepted and replied with by the receiver.
+const (
+	// EventBridgeRequest asks for a bridge. Its data is a BridgeRequest.
+	EventBridgeRequest = "tea.party.bridge.request"
+	// EventBridgeRequestAccepted replies to a bridge request with a ConfirmBridgeResponseMsg.
+	EventBridgeRequestAccepted = "tea.party.bridge.request.accepted"
+	// EventBridgeRequestRejected replies to an invalid bridge request with an ErrorMsg.
+	EventBridgeRequestRejected = "tea.party.bridge.request.rejected"
+)
+
+// bridgeEventClaimTTL bounds how long a delivery of a bridge request holds it before its reply
+// is stored. Redeliveries get 409 meanwhile, and are processed again once a delivery that
+// died without a reply lets it expire.
+const bridgeEventClaimTTL = time.Minute
+
+// startCloudEventsReceiver accepts bridge requests as CloudEvents on port until ctx is done.
+func (e *ExchangeServer) startCloudEventsReceiver(ctx context.Context, port int) {
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: http.HandlerFunc(e.handleCloudEvent)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	e.logger.Infof("receiving cloudevents on %d", port)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		e.logger.Errorw("cloudevents receiver stopped", "error", err)
+	}
+}
+
+// handleCloudEvent authenticates the sender of an event like the HTTP API does and passes it
+// to receiveCloudEvent. Senders need an API key or JWT with the bridge scope, and bridges are
+// created for the client it belongs to.
+func (e *ExchangeServer) handleCloudEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, perr := e.authenticate(r)
+	if perr == nil && p.Anonymous {
+		perr = protocolErrorf(ErrCodeUnauthorized, "", "an API key or JWT is required")
+	}
+	if perr == nil && !p.can(ScopeBridge) {
+		perr = protocolErrorf(ErrCodeForbidden, "", "the %s scope is required", ScopeBridge)
+	}
+	if perr == nil {
+		perr = e.allowRequest(r.Context(), p, p.rateLimitKey(e.remoteIP(r)))
+	}
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	ctx := context.WithValue(r.Context(), principalKey{}, p)
+
+	event, err := binding.ToEvent(ctx, cehttp.NewMessageFromHttpRequest(r))
+	if err != nil {
+		http.Error(w, "invalid cloudevent: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	reply, result := e.receiveCloudEvent(ctx, *event)
+
+	status := http.StatusOK
+	var res *cehttp.Result
+	if protocol.ResultAs(result, &res) {
+		status = res.StatusCode
+	}
+	if reply == nil {
+		if res != nil {
+			http.Error(w, fmt.Sprintf(res.Format, res.Args...), status)
+			return
+		}
+		w.WriteHeader(status)
+		return
+	}
+	if err := cehttp.WriteResponseWriter(ctx, binding.ToMessage(reply), status, w); err != nil {
+		e.logger.Errorw("failed to write bridge request reply", "id", event.ID(), "error", err)
+	}
+}
+
+// receiveCloudEvent handles an inbound event. Bridge requests are answered with an accepted
+// event holding the escrow to deposit to, or a rejected event with the same error codes as
+// the WebSocket and HTTP API.
+func (e *ExchangeServer) receiveCloudEvent(ctx context.Context, event cloudevents.Event) (*cloudevents.Event, protocol.Result) {
+	if event.Type() != EventBridgeRequest {
+		return nil, cloudevents.NewHTTPResult(http.StatusBadRequest, "unsupported event type %q", event.Type())
+	}
+	e.logger.Infow("received bridge request event", "id", event.ID(), "source", event.Source())
+
+	// events are delivered at least once, so a redelivered request gets the original reply.
+	// the key is claimed before the bridge is created so that concurrent deliveries do not
+	// create two bridges, and kept for bridgeEventTTL once it holds the reply.
+	dedupKey := "cebridgerequests:" + principalFrom(ctx).ClientID + ":" + event.Source() + ":" + event.ID()
+	claimed, err := e.redisClient.SetNX(ctx, dedupKey, "", bridgeEventClaimTTL).Result()
+	if err != nil {
+		e.logger.Errorw("failed to claim bridge request event", "id", event.ID(), "error", err)
+		return nil, cloudevents.NewHTTPResult(http.StatusServiceUnavailable, "unable to process the event")
+	}
+	if !claimed {
+		return e.previousBridgeRequestReply(ctx, event, dedupKey)
+	}
+
+	resp, perr := e.bridgeFromCloudEvent(ctx, event)
+	if perr != nil {
+		e.logger.Infow("rejecting bridge request event", "id", event.ID(), "error", perr)
+		// no bridge was created, so the event can be processed again.
+		e.redisClient.Del(ctx, dedupKey)
+		if perr.Code == ErrCodeInternal {
+			// let the sender retry.
+			return nil, cloudevents.NewHTTPResult(http.StatusServiceUnavailable, perr.Message)
+		}
+		return e.bridgeRequestReply(event, EventBridgeRequestRejected, ErrorMsg{
+			Type:    "error",
+			Version: ProtocolVersion,
+			ID:      event.ID(),
+			Code:    perr.Code,
+			Message: perr.Message,
+			Field:   perr.Field,
+		}), cloudevents.ResultACK
+	}
+
+	data, err := json.Marshal(resp)
+	if err == nil {
+		err = e.redisClient.Set(ctx, dedupKey, data, bridgeEventTTL).Err()
+	}
+	if err != nil {
+		// without the reply stored a redelivery could not be answered with this bridge, so the
+		// sender retries and gets a new one once the claim expires.
+		e.logger.Errorw("failed to store bridge request event reply", "id", event.ID(), "txid", resp.TransactionID, "error", err)
+		return nil, cloudevents.NewHTTPResult(http.StatusServiceUnavailable, "unable to process the event")
+	}
+	return e.bridgeRequestReply(event, EventBridgeRequestAccepted, resp), cloudevents.ResultACK
+}
+
+// previousBridgeRequestReply replies to a redelivered bridge request with the bridge created
+// for it the first time.
+func (e *ExchangeServer) previousBridgeRequestReply(ctx context.Context, event cloudevents.Event, dedupKey string) (*cloudevents.Event, protocol.Result) {
+	data, err := e.redisClient.Get(ctx, dedupKey).Bytes()
+	if err != nil && err != redis.Nil {
+		e.logger.Errorw("failed to look up bridge request event", "id", event.ID(), "error", err)
+		return nil, cloudevents.NewHTTPResult(http.StatusServiceUnavailable, "unable to process the event")
+	}
+	if len(data) == 0 {
+		// the first delivery is still being processed.
+		return nil, cloudevents.NewHTTPResult(http.StatusConflict, "the event is already being processed")
+	}
+	var resp ConfirmBridgeResponseMsg
+	if err := json.Unmarshal(data, &resp); err != nil {
+		e.logger.Errorw("failed to decode bridge request event reply", "id", event.ID(), "error", err)
+		return nil, cloudevents.NewHTTPResult(http.StatusInternalServerError, "unable to process the event")
+	}
+	return e.bridgeRequestReply(event, EventBridgeRequestAccepted, resp), cloudevents.ResultACK
+}
+
+// bridgeFromCloudEvent creates and confirms a bridge in one step, as there is no session to
+// hold the escrow between the two.
+func (e *ExchangeServer) bridgeFromCloudEvent(ctx context.Context, event cloudevents.Event) (ConfirmBridgeResponseMsg, *ProtocolError) {
+	var req BridgeRequest
+	if err := event.DataAs(&req); err != nil {
+		return ConfirmBridgeResponseMsg{}, protocolErrorf(ErrCodeInvalidMessage, "data", "event data is not a bridge request: %s", err.Error())
+	}
+
+	principal := principalFrom(ctx)
+	if perr := principal.authorizeRoute(req); perr != nil {
+		return ConfirmBridgeResponseMsg{}, perr
+	}
+
+	acc := e.generateEVMAccount(req.Currency)
+	if _, perr := e.prepareBridge(ctx, &req, acc); perr != nil {
+		return ConfirmBridgeResponseMsg{}, perr
+	}
+
+	// status updates can be followed over a WebSocket with ?id=<transactionID>.
+	awr, perr := e.startBridge(ctx, req, acc, uuid.New().String(), principal.ClientID)
+	if perr != nil {
+		return ConfirmBridgeResponseMsg{}, perr
+	}
+	e.publishStatus(awr, BridgeStatePending, "Waiting for the deposit")
+
+	resp := confirmBridgeResponse(awr)
+	resp.ID = event.ID()
+	return resp, nil
+}
+
+// bridgeRequestReply builds the reply event to a bridge request.
+func (e *ExchangeServer) bridgeRequestReply(request cloudevents.Event, eventType string, data interface{}) *cloudevents.Event {
+	reply := cloudevents.NewEvent()
+	reply.SetID(uuid.New().String())
+	reply.SetType(eventType)
+	reply.SetSource(eventSource)
+	reply.SetTime(time.Now())
+	reply.SetExtension("requestid", request.ID())
+	if resp, ok := data.(ConfirmBridgeResponseMsg); ok {
+		reply.SetSubject(resp.TransactionID)
+	}
+	if err := reply.SetData(cloudevents.ApplicationJSON, data); err != nil {
+		e.logger.Errorw("failed encode bridge request reply", "id", request.ID(), "error", err)
+		return nil
+	}
+	return &reply
+}
@@ -7,7 +7,9 @@ import (
 	"math/big"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/go-redis/redis/v9"
 	uuid "github.com/google/uuid"
 	"go.uber.org/zap"
 )
@@ -58,9 +60,15 @@ func (e *ExchangeServer) updateAccountWatchRequestInDB(request AccountWatchReque
 	// store the new list of account watch requests
 	err = e.redisClient.Set(context.Background(), "accountwatchrequests", crjs, 0).Err()
 	if err != nil {
-		fmt.Println(err)
+		e.bridgeLogger(request).Errorw("storing account watch requests", "error", err)
 		return err
 	}
+	// bridges that are watched again, e.g. after a retry, count towards the pending limits.
+	if !found {
+		if err := e.addPendingSlots(context.Background(), request); err != nil {
+			e.bridgeLogger(request).Errorw("failed to take the pending slots", "error", err)
+		}
+	}
 	return nil
 }
 
@@ -100,7 +108,7 @@ func (e *ExchangeServer) updateAccountWatchRequestsOnCrash() error {
 	// store the new list of account watch requests
 	err = e.redisClient.Set(context.Background(), "accountwatchrequests", crjs, 0).Err()
 	if err != nil {
-		fmt.Println(err)
+		e.logger.Errorw("storing account watch requests", "error", err)
 		return err
 	}
 	return nil
@@ -122,11 +130,16 @@ func (e *ExchangeServer) removeAccountWatchRequestFromDB(requestid string) error
 	}
 	// search for the request in the list by the transaction ID
 	// if it is found, remove it from the list
-	for i, r := range currentRequests {
+	var removed []AccountWatchRequest
+	remaining := currentRequests[:0]
+	for _, r := range currentRequests {
 		if r.TransactionID == requestid {
-			currentRequests = append(currentRequests[:i], currentRequests[i+1:]...)
+			removed = append(removed, r)
+			continue
 		}
+		remaining = append(remaining, r)
 	}
+	currentRequests = remaining
 
 	// marshal the list of account watch requests
 	crjs, err := json.Marshal(currentRequests)
@@ -137,10 +150,16 @@ func (e *ExchangeServer) removeAccountWatchRequestFromDB(requestid string) error
 	// store the new list of account watch requests
 	err = e.redisClient.Set(context.Background(), "accountwatchrequests", crjs, 0).Err()
 	if err != nil {
-		fmt.Println(err)
+		e.logger.Errorw("storing account watch requests", "txid", requestid, "error", err)
 		return err
 	}
 
+	for _, r := range removed {
+		if err := e.releasePendingSlots(context.Background(), r); err != nil {
+			e.bridgeLogger(r).Errorw("failed to release the pending slots", "error", err)
+		}
+	}
+
 	e.logger.Info("removed account watch request from db", zap.String("requestid", requestid))
 
 	return nil
@@ -179,7 +198,7 @@ type BridgeStorage struct {
 // so that when users try to bring a wrapped asset back on the chain, we can fund the transaction
 // without having to move funds around.
 func (e *ExchangeServer) storeBridgeAccount(awrr AccountWatchRequestResult) error {
-	fmt.Println("Storing bridge account")
+	e.bridgeLogger(awrr.AccountWatchRequest).Info("storing bridge account")
 	// create a bridge storage object out of the account watch request result
 	bs := BridgeStorage{
 		Chain:      awrr.AccountWatchRequest.Chain,
@@ -238,7 +257,8 @@ func (b BridgeStorageSlice) Less(i, j int) bool { return b[i].Amount.Cmp(b[j].Am
 func (b BridgeStorageSlice) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
 
 func (e *ExchangeServer) retrieveBridgeAccount(awr AccountWatchRequestResult) (*BridgeStorage, error) {
-	e.logger.Infof("retrieving bridge account for %+v", awr)
+	log := e.bridgeLogger(awr.AccountWatchRequest)
+	log.Info("retrieving bridge account")
 
 	if awr.AccountWatchRequest.Amount == nil {
 		return nil, fmt.Errorf("valueSearch cannot be nil")
@@ -256,7 +276,7 @@ func (e *ExchangeServer) retrieveBridgeAccount(awr AccountWatchRequestResult) (*
 		}
 	}
 
-	e.logger.Info("current accounts", zap.Any("accounts", currentAccounts))
+	log.Debugw("current accounts", "accounts", currentAccounts)
 
 	// Check that valueSearch is not nil and that the list of accounts is not empty
 	if awr.AccountWatchRequest.Amount == nil || len(currentAccounts) == 0 {
@@ -280,7 +300,7 @@ func (e *ExchangeServer) retrieveBridgeAccount(awr AccountWatchRequestResult) (*
 		}
 	}
 
-	e.logger.Info("filteredAccounts1", zap.Any("filteredAccounts", filteredAccounts))
+	log.Debugw("filtered accounts", "accounts", filteredAccounts)
 
 	// // Sort filteredAccounts by amount
 	// sort.Slice(filteredAccounts, func(i, j int) bool {
@@ -306,7 +326,7 @@ func (e *ExchangeServer) retrieveBridgeAccount(awr AccountWatchRequestResult) (*
 		return filteredAccounts[i].Amount.Cmp(awr.AccountWatchRequest.AssistedSellOrderInformation.Amount) >= 0
 	})
 
-	e.logger.Info("index", zap.Int("index", index))
+	log.Debugw("selected bridge account", "index", index)
 
 	var closestAccount *BridgeStorage
 	if index == 0 {
@@ -392,9 +412,286 @@ func (e *ExchangeServer) storeFailedAccountWatchRequest(awr AccountWatchRequest)
 	// store the new list of failed account watch requests
 	err = e.redisClient.Set(context.Background(), "failedaccountwatchrequests", crjs, 0).Err()
 	if err != nil {
-		fmt.Println(err)
+		e.bridgeLogger(awr).Errorw("storing failed account watch requests", "error", err)
 		return err
 	}
 
 	return nil
 }
+
+// storeRefundedAccountWatchRequest stores a refunded account watch request in the database
+// so that there is a record of the refund transaction.
+func (e *ExchangeServer) storeRefundedAccountWatchRequest(awr AccountWatchRequest) error {
+	// fetch the list of current refunded account watch requests
+	requests, _ := e.redisClient.Get(context.Background(), "refundedaccountwatchrequests").Result()
+	// unmarshal the list of refunded account watch requests
+	var currentRequests []AccountWatchRequest
+	if requests != "" {
+		err := json.Unmarshal([]byte(requests), &currentRequests)
+		if err != nil {
+			return err
+		}
+	}
+
+	// add the new refunded account watch request to the list
+	currentRequests = append(currentRequests, awr)
+
+	// marshal the list of refunded account watch requests
+	crjs, err := json.Marshal(currentRequests)
+	if err != nil {
+		return err
+	}
+
+	// store the new list of refunded account watch requests
+	return e.redisClient.Set(context.Background(), "refundedaccountwatchrequests", crjs, 0).Err()
+}
+
+// removeBridgeAccountFromDB removes a bridge account from the database when the funds
+// it holds are no longer available to the bridge.
+func (e *ExchangeServer) removeBridgeAccountFromDB(id string) error {
+	// fetch the list of current bridge accounts
+	accounts, _ := e.redisClient.Get(context.Background(), "bridgeaccounts").Result()
+	if accounts == "" {
+		return nil
+	}
+	// unmarshal the list of bridge accounts
+	var currentAccounts []BridgeStorage
+	if err := json.Unmarshal([]byte(accounts), &currentAccounts); err != nil {
+		return err
+	}
+
+	// keep every account except the one with the specified id
+	remaining := currentAccounts[:0]
+	for _, a := range currentAccounts {
+		if a.ID != id {
+			remaining = append(remaining, a)
+		}
+	}
+
+	// marshal the list of bridge accounts
+	cas, err := json.Marshal(remaining)
+	if err != nil {
+		return err
+	}
+
+	// store the new list of bridge accounts
+	return e.redisClient.Set(context.Background(), "bridgeaccounts", cas, 0).Err()
+}
+
+// storeExpiredAccountWatchRequest stores an expired account watch request in the database
+// so that its escrow can be swept for late deposits.
+func (e *ExchangeServer) storeExpiredAccountWatchRequest(awr AccountWatchRequest) error {
+	currentRequests, err := e.retrieveExpiredAccountWatchRequestsFromDB()
+	if err != nil {
+		return err
+	}
+
+	// add the new expired account watch request to the list
+	currentRequests = append(currentRequests, awr)
+
+	// marshal the list of expired account watch requests
+	crjs, err := json.Marshal(currentRequests)
+	if err != nil {
+		return err
+	}
+
+	// store the new list of expired account watch requests
+	return e.redisClient.Set(context.Background(), "expiredaccountwatchrequests", crjs, 0).Err()
+}
+
+// retrieveExpiredAccountWatchRequestsFromDB retrieves the expired account watch requests
+// that are still within their grace period.
+func (e *ExchangeServer) retrieveExpiredAccountWatchRequestsFromDB() ([]AccountWatchRequest, error) {
+	requests, _ := e.redisClient.Get(context.Background(), "expiredaccountwatchrequests").Result()
+
+	var currentRequests []AccountWatchRequest
+	if requests != "" {
+		if err := json.Unmarshal([]byte(requests), &currentRequests); err != nil {
+			return nil, err
+		}
+	}
+	return currentRequests, nil
+}
+
+// removeExpiredAccountWatchRequestFromDB stops sweeping the escrow of an expired request.
+func (e *ExchangeServer) removeExpiredAccountWatchRequestFromDB(requestid string) error {
+	currentRequests, err := e.retrieveExpiredAccountWatchRequestsFromDB()
+	if err != nil {
+		return err
+	}
+
+	remaining := currentRequests[:0]
+	for _, r := range currentRequests {
+		if r.TransactionID != requestid {
+			remaining = append(remaining, r)
+		}
+	}
+
+	crjs, err := json.Marshal(remaining)
+	if err != nil {
+		return err
+	}
+	return e.redisClient.Set(context.Background(), "expiredaccountwatchrequests", crjs, 0).Err()
+}
+
+// storePaymentOutcome stores an account watch request whose deposit did not match the
+// requested amount, keyed by its transaction id.
+func (e *ExchangeServer) storePaymentOutcome(awr AccountWatchRequest) error {
+	awrjs, err := json.Marshal(awr)
+	if err != nil {
+		return err
+	}
+	return e.redisClient.HSet(context.Background(), "paymentoutcomes", awr.TransactionID, awrjs).Err()
+}
+
+// retrieveAccountWatchRequestList retrieves one of the lists of account watch requests
+// stored as a JSON blob under key, or the burn list, which is a hash.
+func (e *ExchangeServer) retrieveAccountWatchRequestList(key string) ([]AccountWatchRequest, error) {
+	if key == burnAccountWatchRequests {
+		return e.retrieveBurns(context.Background())
+	}
+	requests, _ := e.redisClient.Get(context.Background(), key).Result()
+
+	var currentRequests []AccountWatchRequest
+	if requests != "" {
+		if err := json.Unmarshal([]byte(requests), &currentRequests); err != nil {
+			return nil, err
+		}
+	}
+	return currentRequests, nil
+}
+
+// findAccountWatchRequest looks an account watch request up by transaction id in the active,
+// held, unconfirmed, expired, failed, refunded and resolved lists. It returns nil if it is in none of them.
+func (e *ExchangeServer) findAccountWatchRequest(txid string) (*AccountWatchRequest, error) {
+	var found *AccountWatchRequest
+	for _, key := range []string{"accountwatchrequests", heldAccountWatchRequests, unconfirmedAccountWatchRequests, "expiredaccountwatchrequests", "failedaccountwatchrequests", "refundedaccountwatchrequests", "resolvedaccountwatchrequests"} {
+		requests, err := e.retrieveAccountWatchRequestList(key)
+		if err != nil {
+			return nil, err
+		}
+		// a request can be in more than one list, e.g. failed and later refunded by hand,
+		// so the last list it is found in wins.
+		for i := range requests {
+			if requests[i].TransactionID == txid {
+				found = &requests[i]
+			}
+		}
+	}
+	return found, nil
+}
+
+// removeAccountWatchRequestFromList removes a request from one of the lists of account watch
+// requests stored as a JSON blob under key, or from the burn list.
+func (e *ExchangeServer) removeAccountWatchRequestFromList(key, txid string) error {
+	if key == burnAccountWatchRequests {
+		return e.redisClient.HDel(context.Background(), key, txid).Err()
+	}
+	currentRequests, err := e.retrieveAccountWatchRequestList(key)
+	if err != nil {
+		return err
+	}
+
+	remaining := currentRequests[:0]
+	for _, r := range currentRequests {
+		if r.TransactionID != txid {
+			remaining = append(remaining, r)
+		}
+	}
+	return e.storeAccountWatchRequestList(context.Background(), key, remaining)
+}
+
+// storeAccountWatchRequestList replaces the account watch request list stored under key.
+func (e *ExchangeServer) storeAccountWatchRequestList(ctx context.Context, key string, requests []AccountWatchRequest) error {
+	crjs, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+	return e.redisClient.Set(ctx, key, crjs, 0).Err()
+}
+
+// storeResolvedAccountWatchRequest stores a request that was resolved by hand, so that there
+// is a record of how it was resolved.
+func (e *ExchangeServer) storeResolvedAccountWatchRequest(awr AccountWatchRequest) error {
+	currentRequests, err := e.retrieveAccountWatchRequestList("resolvedaccountwatchrequests")
+	if err != nil {
+		return err
+	}
+
+	// add the resolved account watch request to the list
+	currentRequests = append(currentRequests, awr)
+
+	crjs, err := json.Marshal(currentRequests)
+	if err != nil {
+		return err
+	}
+	return e.redisClient.Set(context.Background(), "resolvedaccountwatchrequests", crjs, 0).Err()
+}
+
+// Redis locks hold a token unique to their holder, so that a holder whose lock expired does
+// not release or renew it once another holder took it.
+var (
+	unlockScript    = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`)
+	renewLockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`)
+)
+
+// redisLock is a lock taken with tryLock.
+type redisLock struct {
+	client *redis.Client
+	key    string
+	token  string
+	ttl    time.Duration
+}
+
+// tryLock takes the lock key for ttl if it is free. It returns nil if another holder has it.
+func (e *ExchangeServer) tryLock(ctx context.Context, key string, ttl time.Duration) (*redisLock, error) {
+	token := e.podName + ":" + uuid.New().String()
+	acquired, err := e.redisClient.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !acquired {
+		return nil, err
+	}
+	return &redisLock{client: e.redisClient, key: key, token: token, ttl: ttl}, nil
+}
+
+// release releases the lock if it is still ours.
+func (l *redisLock) release() error {
+	return unlockScript.Run(context.Background(), l.client, []string{l.key}, l.token).Err()
+}
+
+// held reports whether the lock is still ours.
+func (l *redisLock) held(ctx context.Context) (bool, error) {
+	token, err := l.client.Get(ctx, l.key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return token == l.token, nil
+}
+
+// keep renews the lock every third of its ttl until stop is called. The returned context is
+// canceled when the lock is lost, so that the work done under it stops.
+func (l *redisLock) keep(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			renewed, err := renewLockScript.Run(ctx, l.client, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			if err != nil || renewed == 0 {
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,18 @@
+package be
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+	"go.uber.org/zap"
+)
+
+// newTestServer returns an ExchangeServer backed by an in-memory Redis, which the test can
+// inspect and fast forward through the returned miniredis.
+func newTestServer(t *testing.T) (*ExchangeServer, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return &ExchangeServer{redisClient: rdb, logger: zap.NewNop().Sugar(), podName: "test-pod"}, mr
+}
@@ -0,0 +1,346 @@
+package be
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	bridge "github.com/TeaPartyCrypto/partybridge/pkg/contract/bridge"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// chainClient returns the primary rpc client of an EVM chain we hold escrows on.
+func (e *ExchangeServer) chainClient(chain string) *ethclient.Client {
+	switch chain {
+	case OCTA:
+		return e.octNode.client()
+	case GRAMS:
+		return e.partyChain.client()
+	}
+	return nil
+}
+
+// depositTokenContract returns the token contract a deposit of currency is made in on chain.
+// Deposits of native assets return an empty address.
+func (e *ExchangeServer) depositTokenContract(chain, currency string) string {
+	switch currency {
+	case WGRAMS:
+		if chain == OCTA {
+			return e.wGRAMSOnOCTAContractAddress
+		}
+	case WOCTA:
+		if chain == GRAMS {
+			return e.wOCTAOnPartyChainContractAddress
+		}
+	case BSCUSDT:
+		if chain == BSCUSDT {
+			return bscUSDTContractAddress
+		}
+	case WBSCUSDT:
+		switch chain {
+		case OCTA:
+			return e.wBSCUSDTOnOctaSpaceContractAddress
+		case GRAMS:
+			return e.wBSCUSDTOnPartyChainContractAddress
+		}
+	}
+	return ""
+}
+
+// depositBalance returns the amount currently held by the escrow of an account watch request.
+func (e *ExchangeServer) depositBalance(ctx context.Context, awr AccountWatchRequest) (*big.Int, error) {
+	if awr.Chain == BSCUSDT {
+		return bscUSDTBalance(e.bscNode.do)(ctx, awr.Account)
+	}
+
+	rpc := e.chainClient(awr.Chain)
+	if rpc == nil {
+		return nil, fmt.Errorf("no rpc client configured for chain %s", awr.Chain)
+	}
+
+	account := common.HexToAddress(awr.Account)
+	token := e.depositTokenContract(awr.Chain, awr.AssistedSellOrderInformation.Currency)
+	if token == "" {
+		return rpc.BalanceAt(ctx, account, nil)
+	}
+
+	contract, err := bridge.NewPartyBridgeCaller(common.HexToAddress(token), rpc)
+	if err != nil {
+		return nil, err
+	}
+	return contract.BalanceOf(&bind.CallOpts{Context: ctx}, account)
+}
+
+// failBridge handles a bridge that can not be settled. The deposit is refunded when the user
+// gave us a refund address, otherwise the request is stored so that it can be resolved by hand.
+func (e *ExchangeServer) failBridge(awr AccountWatchRequest, cause error) {
+	e.bridgeLogger(awr).Errorw("bridge failed", "error", cause)
+	awr.State = BridgeStateFailed
+	awr.FailureReason = cause.Error()
+
+	if awr.AssistedSellOrderInformation.SellerRefundAddress != "" {
+		err := e.refundAccountWatchRequest(&awr)
+		if err == nil {
+			return
+		}
+		e.bridgeLogger(awr).Errorw("refunding failed bridge", "error", err)
+		awr.FailureReason = awr.FailureReason + "; refund failed: " + err.Error()
+	}
+
+	e.emitBridgeEvent(EventBridgeFailed, awr)
+	data := "There was a bridge failure. Please provide this id to support: " + awr.TransactionID
+	e.publishStatus(awr, "error", data)
+	// we need to store the error in redis so that we can manually resolve the issue later.
+	if err := e.storeFailedAccountWatchRequest(awr); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to store failed account watch request", "error", err)
+	}
+	if err := e.removeAccountWatchRequestFromDB(awr.TransactionID); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to remove account watch request from db", "error", err)
+	}
+}
+
+// holdUnconfirmedSettlement handles a bridge whose settlement failed after it may have been
+// delivered. It is stored in the unconfirmed list for an operator to check the settlement and
+// resolve, retry or refund it, and is never refunded automatically.
+func (e *ExchangeServer) holdUnconfirmedSettlement(awr AccountWatchRequest, cause *UnconfirmedSettlementError) {
+	e.bridgeLogger(awr).Errorw("settlement unconfirmed, holding the bridge for an operator", "settlementTx", cause.TxHash, "error", cause.Err)
+	awr.State = BridgeStateUnconfirmed
+	awr.FailureReason = cause.Error()
+	awr.SettlementTxHash = cause.TxHash
+	awr.Locked = false
+	awr.LockedBy = ""
+
+	e.emitBridgeEvent(EventBridgeFailed, awr)
+	e.publishStatus(awr, BridgeStateUnconfirmed, "The bridge could not be confirmed and is being checked by support. Please provide this id to support: "+awr.TransactionID)
+	unconfirmed, err := e.retrieveAccountWatchRequestList(unconfirmedAccountWatchRequests)
+	if err == nil {
+		err = e.storeAccountWatchRequestList(context.Background(), unconfirmedAccountWatchRequests, append(unconfirmed, awr))
+	}
+	if err != nil {
+		// the failed list is the next best place for an operator to find it.
+		e.bridgeLogger(awr).Errorw("failed to store unconfirmed account watch request", "error", err)
+		if err := e.storeFailedAccountWatchRequest(awr); err != nil {
+			e.bridgeLogger(awr).Errorw("failed to store failed account watch request", "error", err)
+		}
+	}
+	if err := e.removeAccountWatchRequestFromDB(awr.TransactionID); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to remove account watch request from db", "error", err)
+	}
+}
+
+// expireAccountWatchRequest is called when a watch times out. Anything that made it into the
+// escrow before (or after) the deadline is refunded, the bridge itself is never settled.
+func (e *ExchangeServer) expireAccountWatchRequest(awr AccountWatchRequest) error {
+	balance, err := e.depositBalance(context.Background(), awr)
+	if err != nil {
+		e.failBridge(awr, fmt.Errorf("timed out waiting for the deposit and the escrow balance is unknown: %w", err))
+		return err
+	}
+
+	if balance.Sign() > 0 {
+		awr.ReceivedAmount = balance
+		awr.PaymentStatus = PaymentUnderpaid
+		e.recordPaymentOutcome(awr)
+		e.failBridge(awr, fmt.Errorf("deposit of %s did not complete before the timeout", balance.String()))
+		return nil
+	}
+
+	// keep an eye on the escrow in case the deposit is still on its way.
+	awr.State = BridgeStateExpired
+	awr.GraceUntil = time.Now().Add(e.lateDepositGrace)
+	BridgeRequestsInc("expired", AccountWatchRequestResult{AccountWatchRequest: awr})
+	BridgeDurationObserve("expired", awr)
+	e.emitBridgeEvent(EventBridgeExpired, awr)
+	e.publishStatus(awr, "error", "Timed out waiting for the deposit. The bridge has been cancelled")
+	if err := e.storeExpiredAccountWatchRequest(awr); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to store expired account watch request", "error", err)
+	}
+	return e.removeAccountWatchRequestFromDB(awr.TransactionID)
+}
+
+// refundAccountWatchRequest returns the deposit held in the escrow of req to its refund address
+// and records the refund transaction. A refund transaction that was sent but did not succeed
+// is recorded on req too.
+func (e *ExchangeServer) refundAccountWatchRequest(req *AccountWatchRequest) error {
+	refundAddress := req.AssistedSellOrderInformation.SellerRefundAddress
+	if !common.IsHexAddress(refundAddress) {
+		return fmt.Errorf("invalid refund address %q", refundAddress)
+	}
+
+	result, err := e.refundDeposit(context.Background(), *req, refundAddress, nil)
+	recordRefund(req, result)
+	if err != nil {
+		return err
+	}
+
+	awr := *req
+	awr.State = BridgeStateRefunded
+	awr.RefundedTime = time.Now()
+	e.bridgeLogger(awr).Infow("refunded deposit", "refundTx", result.TxHash, "amount", result.Value, "block", result.Block)
+
+	// the escrow no longer holds the deposit, so it can not be used to fund releases.
+	if err := e.removeBridgeAccountFromDB(awr.TransactionID); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to remove bridge account from db", "error", err)
+	}
+	if err := e.storeRefundedAccountWatchRequest(awr); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to store refunded account watch request", "error", err)
+	}
+	if err := e.removeAccountWatchRequestFromDB(awr.TransactionID); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to remove account watch request from db", "error", err)
+	}
+
+	BridgeRequestsInc("refunded", AccountWatchRequestResult{AccountWatchRequest: awr})
+	BridgeDurationObserve("refunded", awr)
+	e.emitBridgeEvent(EventBridgeRefunded, awr)
+	e.publishStatus(awr, "refunded", "Your deposit has been refunded in transaction "+result.TxHash)
+	return nil
+}
+
+// recordRefund records the refund transaction of result on awr, if one was sent.
+func recordRefund(awr *AccountWatchRequest, result txResult) {
+	if result.TxHash == "" {
+		return
+	}
+	awr.RefundTxHash = result.TxHash
+	awr.RefundAmount = result.Value
+	awr.RefundTxStatus = result.Status
+	awr.RefundBlock = result.Block
+}
+
+// refundDeposit sends amount from the escrow, minus gas, to the refund address and waits for
+// it to be mined. A nil amount refunds the whole escrow balance. It returns the refund
+// transaction, which is set on errors too once it has been sent.
+func (e *ExchangeServer) refundDeposit(ctx context.Context, awr AccountWatchRequest, to string, amount *big.Int) (result txResult, err error) {
+	ctx, span := startBridgeSpan(ctx, "refund deposit", awr)
+	start := time.Now()
+	defer func() {
+		BridgeStageObserve(StageRefund, awr, time.Since(start))
+		endSpan(span, err)
+	}()
+
+	rpc := e.chainClient(awr.Chain)
+	if awr.Chain == BSCUSDT {
+		rpc = e.bscNode.client()
+	}
+	if rpc == nil {
+		return txResult{}, fmt.Errorf("refunds are not supported on chain %s", awr.Chain)
+	}
+
+	wallet := awr.AssistedSellOrderInformation.SellersEscrowWallet
+	key, err := escrowKey(wallet.PrivateKey)
+	if err != nil {
+		return txResult{}, err
+	}
+	escrow := crypto.PubkeyToAddress(key.PublicKey)
+
+	token := e.depositTokenContract(awr.Chain, awr.AssistedSellOrderInformation.Currency)
+	if token != "" {
+		return e.refundToken(ctx, awr.Chain, rpc, token, key, to, amount, awr.TransactionID)
+	}
+
+	balance, err := rpc.BalanceAt(ctx, escrow, nil)
+	if err != nil {
+		return txResult{}, err
+	}
+	if amount == nil || amount.Cmp(balance) > 0 {
+		amount = balance
+	}
+	toAddress := common.HexToAddress(to)
+	gas, err := rpc.EstimateGas(ctx, ethereum.CallMsg{From: escrow, To: &toAddress, Value: amount})
+	if err != nil {
+		return txResult{}, fmt.Errorf("estimating the refund gas: %w", err)
+	}
+	fees, err := e.suggestFees(ctx, awr.Chain, rpc, gas)
+	if err != nil {
+		return txResult{}, err
+	}
+	if cost := fees.maxCost(); amount.Cmp(cost) <= 0 {
+		return txResult{}, fmt.Errorf("refund of %s does not cover the refund gas of %s", amount.String(), cost.String())
+	}
+
+	return e.sendCoreEVMAsset(ctx, awr.Chain, hexKey(key), to, amount, fees, awr.TransactionID, rpc)
+}
+
+// refundToken transfers amount tokens, or the full token balance when amount is nil, from the
+// escrow to the refund address and waits for the transfer to be mined. Token escrows hold no
+// native asset, so the gas of the transfer is sent to the escrow from the hot wallet first.
+func (e *ExchangeServer) refundToken(ctx context.Context, chain string, rpc *ethclient.Client, token string, key *ecdsa.PrivateKey, to string, amount *big.Int, txid string) (txResult, error) {
+	log := e.logger.With("txid", txid)
+	tokenAddress := common.HexToAddress(token)
+	contract, err := bridge.NewPartyBridgeCaller(tokenAddress, rpc)
+	if err != nil {
+		return txResult{}, err
+	}
+
+	escrow := crypto.PubkeyToAddress(key.PublicKey)
+	balance, err := contract.BalanceOf(&bind.CallOpts{Context: ctx}, escrow)
+	if err != nil {
+		return txResult{}, err
+	}
+	if balance.Sign() == 0 {
+		return txResult{}, fmt.Errorf("escrow %s holds no %s tokens to refund", escrow.Hex(), token)
+	}
+	if amount == nil || amount.Cmp(balance) > 0 {
+		amount = balance
+	}
+
+	tokenABI, err := bridge.PartyBridgeMetaData.GetAbi()
+	if err != nil {
+		return txResult{}, err
+	}
+	data, err := tokenABI.Pack("transfer", common.HexToAddress(to), amount)
+	if err != nil {
+		return txResult{}, err
+	}
+	gas, err := rpc.EstimateGas(ctx, ethereum.CallMsg{From: escrow, To: &tokenAddress, Data: data})
+	if err != nil {
+		return txResult{}, fmt.Errorf("estimating the gas of transferring %s tokens from escrow %s: %w", token, escrow.Hex(), err)
+	}
+	fees, err := e.suggestFees(ctx, chain, rpc, gas)
+	if err != nil {
+		return txResult{}, err
+	}
+	if err := e.fundGas(ctx, chain, rpc, escrow, e.gasBudget(chain, fees), log); err != nil {
+		return txResult{}, fmt.Errorf("funding the gas of escrow %s to transfer its %s tokens: %w", escrow.Hex(), token, err)
+	}
+
+	chainID, err := rpc.ChainID(ctx)
+	if err != nil {
+		return txResult{}, err
+	}
+	sign := func(nonce uint64, fees txFees) (*types.Transaction, error) {
+		return signTx(key, chainID, nonce, tokenAddress, new(big.Int), data, fees)
+	}
+	result, err := e.sendTx(ctx, chain, rpc, key, fees, sign, log)
+	// the value of a token transfer is in its call data.
+	if result.TxHash != "" {
+		result.Value = amount
+	}
+	if err != nil {
+		return result, fmt.Errorf("transferring %s tokens from escrow %s after funding its gas from the hot wallet: %w", token, escrow.Hex(), err)
+	}
+	return result, nil
+}
+
+// escrowKey parses the private key of an escrow wallet. Escrow keys are stored without
+// leading zeros, so they are padded back to 32 bytes.
+func escrowKey(privateKey string) (*ecdsa.PrivateKey, error) {
+	privateKey = strings.TrimPrefix(privateKey, "0x")
+	if len(privateKey) < 64 {
+		privateKey = strings.Repeat("0", 64-len(privateKey)) + privateKey
+	}
+	return crypto.HexToECDSA(privateKey)
+}
+
+func hexKey(key *ecdsa.PrivateKey) string {
+	return common.Bytes2Hex(crypto.FromECDSA(key))
+}
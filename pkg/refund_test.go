@@ -0,0 +1,97 @@
+package be
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testBridge returns an octa to grams bridge with a refund address.
+func testBridge(txid string) AccountWatchRequest {
+	return AccountWatchRequest{
+		AWRID:         uuid.New().String(),
+		TransactionID: txid,
+		Chain:         OCTA,
+		Account:       "0x1111111111111111111111111111111111111111",
+		Amount:        big.NewInt(100),
+		State:         BridgeStatePending,
+		AssistedSellOrderInformation: AssistedTradeOrderInformation{
+			Currency:              OCTA,
+			BridgeTo:              GRAMS,
+			Amount:                big.NewInt(100),
+			SellerShippingAddress: "0x2222222222222222222222222222222222222222",
+			SellerRefundAddress:   "0x3333333333333333333333333333333333333333",
+		},
+	}
+}
+
+func TestHoldUnconfirmedSettlement(t *testing.T) {
+	e, _ := newTestServer(t)
+	awr := testBridge("unconfirmed")
+	if err := e.storeAccountWatchRequestList(context.Background(), "accountwatchrequests", []AccountWatchRequest{awr}); err != nil {
+		t.Fatal(err)
+	}
+
+	e.holdUnconfirmedSettlement(awr, &UnconfirmedSettlementError{TxHash: "0xabc", Err: errors.New("timed out")})
+
+	held := assertList(t, e, unconfirmedAccountWatchRequests, "unconfirmed")
+	if held[0].State != BridgeStateUnconfirmed || held[0].SettlementTxHash != "0xabc" {
+		t.Errorf("held bridge has state %q and settlement %q", held[0].State, held[0].SettlementTxHash)
+	}
+	// a bridge whose settlement may have been delivered is never refunded automatically.
+	if held[0].RefundTxHash != "" {
+		t.Errorf("held bridge was refunded in %s", held[0].RefundTxHash)
+	}
+	assertList(t, e, "accountwatchrequests")
+	assertList(t, e, "failedaccountwatchrequests")
+	assertList(t, e, "refundedaccountwatchrequests")
+}
+
+func TestFailBridge(t *testing.T) {
+	e, _ := newTestServer(t)
+	noRefundAddress := testBridge("no-refund-address")
+	noRefundAddress.AssistedSellOrderInformation.SellerRefundAddress = ""
+	// no node is connected, so the refund fails.
+	refundFails := testBridge("refund-fails")
+	if err := e.storeAccountWatchRequestList(context.Background(), "accountwatchrequests", []AccountWatchRequest{noRefundAddress, refundFails}); err != nil {
+		t.Fatal(err)
+	}
+
+	e.failBridge(noRefundAddress, errors.New("boom"))
+	e.failBridge(refundFails, errors.New("boom"))
+
+	failed := assertList(t, e, "failedaccountwatchrequests", "no-refund-address", "refund-fails")
+	for _, awr := range failed {
+		if awr.State != BridgeStateFailed {
+			t.Errorf("failed bridge %s has state %q", awr.TransactionID, awr.State)
+		}
+		refundFailed := strings.Contains(awr.FailureReason, "refund failed")
+		if refundFailed != (awr.TransactionID == "refund-fails") {
+			t.Errorf("failed bridge %s has failure reason %q", awr.TransactionID, awr.FailureReason)
+		}
+	}
+	assertList(t, e, "accountwatchrequests")
+	assertList(t, e, "refundedaccountwatchrequests")
+}
+
+// assertList checks that the list under key holds exactly the bridges of txids, in order, and
+// returns them.
+func assertList(t *testing.T, e *ExchangeServer, key string, txids ...string) []AccountWatchRequest {
+	t.Helper()
+	requests, err := e.retrieveAccountWatchRequestList(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(requests))
+	for i, awr := range requests {
+		got[i] = awr.TransactionID
+	}
+	if strings.Join(got, ",") != strings.Join(txids, ",") {
+		t.Fatalf("%s holds %v, want %v", key, got, txids)
+	}
+	return requests
+}
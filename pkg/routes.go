@@ -0,0 +1,105 @@
+package be
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Route identifies a bridge by the currency deposited, the chain it is deposited on and
+// the chain it is bridged to.
+type Route struct {
+	Currency  string `json:"currency"`
+	FromChain string `json:"fromChain"`
+	BridgeTo  string `json:"bridgeTo"`
+}
+
+// Key returns the route in the "currency:fromChain:bridgeTo" form used in configuration
+// and as a Redis key suffix.
+func (r Route) Key() string {
+	return r.Currency + ":" + r.FromChain + ":" + r.BridgeTo
+}
+
+// routeOf returns the route of an account watch request.
+func routeOf(awr AccountWatchRequest) Route {
+	return Route{
+		Currency:  awr.AssistedSellOrderInformation.Currency,
+		FromChain: awr.Chain,
+		BridgeTo:  awr.AssistedSellOrderInformation.BridgeTo,
+	}
+}
+
+// routeOfRequest returns the route of a bridge request.
+func routeOfRequest(req BridgeRequest) Route {
+	return Route{
+		Currency:  req.Currency,
+		FromChain: req.FromChain,
+		BridgeTo:  req.BridgeTo,
+	}
+}
+
+// parseRouteDurations parses a comma separated list of "currency:fromChain:bridgeTo=duration"
+// pairs, e.g. "octa:octa:grams=30m,bscusdt:bscusdt:grams=1h". The routes must be supported and
+// the durations positive.
+func parseRouteDurations(s string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.Count(kv[0], ":") != 2 {
+			return nil, fmt.Errorf("invalid route duration %q, expected currency:fromChain:bridgeTo=duration", pair)
+		}
+		key := strings.ToLower(kv[0])
+		if !isSupportedRouteKey(key) {
+			return nil, fmt.Errorf("unsupported route %s", kv[0])
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for route %s: %w", kv[0], err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid duration for route %s: %s is not positive", kv[0], kv[1])
+		}
+		durations[key] = d
+	}
+	return durations, nil
+}
+
+// paymentWindow returns how long a client has to make the deposit for a route.
+func (e *ExchangeServer) paymentWindow(r Route) time.Duration {
+	if d, ok := e.paymentWindows[r.Key()]; ok {
+		return d
+	}
+	return e.defaultPaymentWindow
+}
+
+// supportedRoutes are the routes watchAccount knows how to watch.
+var supportedRoutes = []Route{
+	{Currency: OCTA, FromChain: OCTA, BridgeTo: GRAMS},
+	{Currency: WGRAMS, FromChain: OCTA, BridgeTo: GRAMS},
+	{Currency: WBSCUSDT, FromChain: OCTA, BridgeTo: BSCUSDT},
+	{Currency: WOCTA, FromChain: GRAMS, BridgeTo: OCTA},
+	{Currency: GRAMS, FromChain: GRAMS, BridgeTo: OCTA},
+	{Currency: WBSCUSDT, FromChain: GRAMS, BridgeTo: BSCUSDT},
+	{Currency: BSCUSDT, FromChain: BSCUSDT, BridgeTo: OCTA},
+	{Currency: BSCUSDT, FromChain: BSCUSDT, BridgeTo: GRAMS},
+}
+
+// isSupportedRoute reports whether r is one of the supportedRoutes.
+func isSupportedRoute(r Route) bool {
+	for _, s := range supportedRoutes {
+		if s == r {
+			return true
+		}
+	}
+	return false
+}
+
+// isSupportedRouteKey reports whether key is the Key of one of the supportedRoutes.
+func isSupportedRouteKey(key string) bool {
+	for _, s := range supportedRoutes {
+		if s.Key() == key {
+			return true
+		}
+	}
+	return false
+}
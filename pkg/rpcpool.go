@@ -0,0 +1,337 @@
+package be
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"go.uber.org/zap"
+)
+
+// rpcMaxFailures is the number of calls in a row an endpoint may fail before it is taken out
+// of rotation and reconnected.
+const rpcMaxFailures = 3
+
+// rpcCloseGrace is how long the client an endpoint was reconnected from is kept open. Callers
+// hold on to clients, e.g. while a transaction is waited on and bumped, so it outlasts
+// STUCK_TX_AFTER times MAX_GAS_BUMPS at their defaults.
+const rpcCloseGrace = 15 * time.Minute
+
+// EndpointStatus is the state of an RPC endpoint of a chain. Endpoints are named by chain and
+// position, as providers put API keys in their URLs.
+type EndpointStatus struct {
+	Name        string     `json:"name"`
+	Healthy     bool       `json:"healthy"`
+	Connected   bool       `json:"connected"`
+	LatestBlock uint64     `json:"latestBlock,omitempty"`
+	BlockTime   *time.Time `json:"blockTime,omitempty"`
+	// Lag is how many blocks the endpoint is behind the most synced endpoint of the chain.
+	Lag       uint64 `json:"lag"`
+	LatencyMs int64  `json:"latencyMs"`
+	Failures  int    `json:"failures"`
+	Error     string `json:"error,omitempty"`
+}
+
+// rpcEndpoint is a single RPC endpoint of a chain.
+type rpcEndpoint struct {
+	name string
+	url  string
+
+	mu          sync.Mutex
+	client      *ethclient.Client
+	latestBlock uint64
+	blockTime   time.Time
+	lag         uint64
+	latency     time.Duration
+	failures    int
+	lastError   string
+}
+
+func (ep *rpcEndpoint) get() *ethclient.Client {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.client
+}
+
+func (ep *rpcEndpoint) succeeded() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.failures = 0
+	ep.lastError = ""
+}
+
+func (ep *rpcEndpoint) failed(err error) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.failures++
+	ep.lastError = err.Error()
+}
+
+// healthy tells whether calls should be sent to the endpoint. Endpoints that have not been
+// checked yet are.
+func (ep *rpcEndpoint) healthy(maxLag uint64) bool {
+	return ep.client != nil && ep.failures < rpcMaxFailures && ep.lag <= maxLag
+}
+
+// EthereumNode is the pool of RPC endpoints of a chain. Calls go to the healthiest endpoint
+// and fail over to the next one on errors.
+type EthereumNode struct {
+	chain     string
+	endpoints []*rpcEndpoint
+	// maxLag is how many blocks an endpoint may be behind the others and stay healthy.
+	maxLag uint64
+	logger *zap.SugaredLogger
+}
+
+// newEthereumNode connects to the endpoints of chain. Endpoints that cannot be reached are
+// retried by run, an error is only returned when none is configured.
+func newEthereumNode(ctx context.Context, chain string, urls []string, maxLag uint64, logger *zap.SugaredLogger) (*EthereumNode, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no RPC endpoint configured for %s", chain)
+	}
+	n := &EthereumNode{chain: chain, maxLag: maxLag, logger: logger}
+	for i, url := range urls {
+		ep := &rpcEndpoint{name: fmt.Sprintf("%s-%d", chain, i+1), url: url}
+		client, err := dialChain(ctx, chain, url)
+		if err != nil {
+			logger.Errorw("Error connecting to RPC endpoint", "chain", chain, "endpoint", ep.name, "error", err)
+			ep.lastError = err.Error()
+		}
+		ep.client = client
+		n.endpoints = append(n.endpoints, ep)
+	}
+	return n, nil
+}
+
+// ranked returns the endpoints healthiest first: healthy ones before the others, and lagging
+// ones before failing ones, then by lag, failures and latency. Ties keep the configured order.
+func (n *EthereumNode) ranked() []*rpcEndpoint {
+	type ranking struct {
+		ep       *rpcEndpoint
+		healthy  bool
+		lag      uint64
+		failures int
+		latency  time.Duration
+	}
+	rankings := make([]ranking, len(n.endpoints))
+	for i, ep := range n.endpoints {
+		ep.mu.Lock()
+		rankings[i] = ranking{ep, ep.healthy(n.maxLag), ep.lag, ep.failures, ep.latency}
+		ep.mu.Unlock()
+	}
+	sort.SliceStable(rankings, func(i, j int) bool {
+		a, b := rankings[i], rankings[j]
+		switch {
+		case a.healthy != b.healthy:
+			return a.healthy
+		case (a.failures >= rpcMaxFailures) != (b.failures >= rpcMaxFailures):
+			return a.failures < rpcMaxFailures
+		case a.lag != b.lag:
+			return a.lag < b.lag
+		case a.failures != b.failures:
+			return a.failures < b.failures
+		}
+		return a.latency < b.latency
+	})
+	endpoints := make([]*rpcEndpoint, len(rankings))
+	for i, r := range rankings {
+		endpoints[i] = r.ep
+	}
+	return endpoints
+}
+
+// client returns the client of the healthiest endpoint, for calls made once that are not
+// worth failing over.
+func (n *EthereumNode) client() *ethclient.Client {
+	if n == nil {
+		return nil
+	}
+	for _, ep := range n.ranked() {
+		if client := ep.get(); client != nil {
+			return client
+		}
+	}
+	return nil
+}
+
+// do calls fn with the client of the healthiest endpoint, failing over to the next endpoint
+// until one succeeds.
+func (n *EthereumNode) do(ctx context.Context, fn func(*ethclient.Client) error) error {
+	_, err := n.call(ctx, n.ranked(), fn)
+	return err
+}
+
+// calls returns a pair of calls like do, where verify never uses the endpoint do last got an
+// answer from when there are others, so that what do read is confirmed by another node. The
+// endpoint is excluded by identity, as failovers reorder the ranking between the two. Each
+// watch takes its own pair.
+func (n *EthereumNode) calls() (do, verify rpcCall) {
+	var answered *rpcEndpoint
+	do = func(ctx context.Context, fn func(*ethclient.Client) error) error {
+		ep, err := n.call(ctx, n.ranked(), fn)
+		if err == nil {
+			answered = ep
+		}
+		return err
+	}
+	verify = func(ctx context.Context, fn func(*ethclient.Client) error) error {
+		endpoints := n.ranked()
+		if len(endpoints) > 1 {
+			others := make([]*rpcEndpoint, 0, len(endpoints))
+			for _, ep := range endpoints {
+				if ep != answered {
+					others = append(others, ep)
+				}
+			}
+			if len(others) == len(endpoints) {
+				// do has not answered yet, it would ask the healthiest.
+				others = others[1:]
+			}
+			endpoints = others
+		}
+		_, err := n.call(ctx, endpoints, fn)
+		return err
+	}
+	return do, verify
+}
+
+// call calls fn with the client of each of endpoints in turn until one succeeds, and returns
+// the endpoint that answered.
+func (n *EthereumNode) call(ctx context.Context, endpoints []*rpcEndpoint, fn func(*ethclient.Client) error) (*rpcEndpoint, error) {
+	err := fmt.Errorf("no RPC endpoint configured for %s", n.chain)
+	for _, ep := range endpoints {
+		client := ep.get()
+		if client == nil {
+			err = fmt.Errorf("%s is not connected", ep.name)
+			continue
+		}
+		if err = fn(client); err == nil {
+			ep.succeeded()
+			return ep, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		ep.failed(err)
+		n.logger.Errorw("RPC call failed, failing over", "chain", n.chain, "endpoint", ep.name, "error", err)
+	}
+	return nil, err
+}
+
+// run checks the endpoints every interval until ctx is done. Each check reconnects dropped
+// endpoints and measures how far behind the others they are.
+func (n *EthereumNode) run(ctx context.Context, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n.check(ctx, timeout)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check refreshes the latest block and lag of every endpoint.
+func (n *EthereumNode) check(ctx context.Context, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, ep := range n.endpoints {
+		wg.Add(1)
+		go func(ep *rpcEndpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			n.checkEndpoint(ctx, ep)
+		}(ep)
+	}
+	wg.Wait()
+
+	var head uint64
+	for _, ep := range n.endpoints {
+		ep.mu.Lock()
+		if ep.lastError == "" && ep.latestBlock > head {
+			head = ep.latestBlock
+		}
+		ep.mu.Unlock()
+	}
+	for _, ep := range n.endpoints {
+		ep.mu.Lock()
+		if ep.latestBlock < head {
+			ep.lag = head - ep.latestBlock
+		} else {
+			ep.lag = 0
+		}
+		healthy := ep.healthy(n.maxLag)
+		RPCEndpointSet(n.chain, ep.name, healthy, ep.lag)
+		ep.mu.Unlock()
+	}
+}
+
+// checkEndpoint reads the latest block of ep, reconnecting it first if it was dropped or keeps
+// failing.
+func (n *EthereumNode) checkEndpoint(ctx context.Context, ep *rpcEndpoint) {
+	ep.mu.Lock()
+	client, failures := ep.client, ep.failures
+	ep.mu.Unlock()
+
+	if client == nil || failures >= rpcMaxFailures {
+		reconnected, err := dialChain(ctx, n.chain, ep.url)
+		if err != nil {
+			ep.failed(err)
+			n.logger.Errorw("Error reconnecting to RPC endpoint", "chain", n.chain, "endpoint", ep.name, "error", err)
+			return
+		}
+		ep.mu.Lock()
+		old := ep.client
+		ep.client = reconnected
+		ep.mu.Unlock()
+		client = reconnected
+		// calls may still be in flight on the old client, it is closed once they are done.
+		if old != nil {
+			time.AfterFunc(rpcCloseGrace, old.Close)
+		}
+	}
+
+	start := time.Now()
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		ep.failed(err)
+		return
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.latency = time.Since(start)
+	ep.latestBlock = header.Number.Uint64()
+	ep.blockTime = time.Unix(int64(header.Time), 0)
+	ep.failures = 0
+	ep.lastError = ""
+}
+
+// status returns the state of every endpoint.
+func (n *EthereumNode) status() []EndpointStatus {
+	statuses := make([]EndpointStatus, 0, len(n.endpoints))
+	for _, ep := range n.endpoints {
+		ep.mu.Lock()
+		status := EndpointStatus{
+			Name:        ep.name,
+			Healthy:     ep.healthy(n.maxLag),
+			Connected:   ep.client != nil,
+			LatestBlock: ep.latestBlock,
+			Lag:         ep.lag,
+			LatencyMs:   ep.latency.Milliseconds(),
+			Failures:    ep.failures,
+			Error:       ep.lastError,
+		}
+		if !ep.blockTime.IsZero() {
+			blockTime := ep.blockTime
+			status.BlockTime = &blockTime
+		}
+		ep.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
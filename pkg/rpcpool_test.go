@@ -0,0 +1,46 @@
+package be
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"go.uber.org/zap"
+)
+
+func TestVerifyExcludesAnsweringEndpoint(t *testing.T) {
+	a := &rpcEndpoint{name: "a", client: dialFakeNode(t, &fakeNode{}), latency: time.Millisecond}
+	b := &rpcEndpoint{name: "b", client: dialFakeNode(t, &fakeNode{}), latency: 2 * time.Millisecond}
+	c := &rpcEndpoint{name: "c", client: dialFakeNode(t, &fakeNode{}), latency: 3 * time.Millisecond}
+	n := &EthereumNode{chain: GRAMS, endpoints: []*rpcEndpoint{a, b, c}, maxLag: 5, logger: zap.NewNop().Sugar()}
+	ctx := context.Background()
+	do, verify := n.calls()
+
+	var answered *ethclient.Client
+	if err := do(ctx, func(client *ethclient.Client) error { answered = client; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if answered != a.client {
+		t.Fatal("do did not ask the healthiest endpoint")
+	}
+
+	// a health check finds a lagging a little, which ranks it last while it stays healthy.
+	a.lag = 1
+	var asked []string
+	err := verify(ctx, func(client *ethclient.Client) error {
+		for _, ep := range n.endpoints {
+			if ep.client == client {
+				asked = append(asked, ep.name)
+			}
+		}
+		return errors.New("unavailable")
+	})
+	if err == nil {
+		t.Fatal("verify succeeded, want the other endpoints to fail")
+	}
+	if len(asked) != 2 || asked[0] != "b" || asked[1] != "c" {
+		t.Errorf("verify asked %v, want [b c]", asked)
+	}
+}
@@ -0,0 +1,201 @@
+package be
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// evmAddressPattern matches a 20 byte hex address with its 0x prefix.
+var evmAddressPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// addressValidators check the format of an address on each chain we send to.
+var addressValidators = map[string]func(string) error{
+	OCTA:    validateEVMAddress,
+	GRAMS:   validateEVMAddress,
+	BSCUSDT: validateEVMAddress,
+}
+
+// validateEVMAddress checks that address is a 0x prefixed hex address other than the zero
+// address. Mixed case addresses must have a valid EIP-55 checksum, so that a mistyped
+// address is caught rather than minted to.
+func validateEVMAddress(address string) error {
+	if !evmAddressPattern.MatchString(address) {
+		return fmt.Errorf("must be a 0x prefixed address of 40 hex digits")
+	}
+	parsed := common.HexToAddress(address)
+	if parsed == (common.Address{}) {
+		return fmt.Errorf("must not be the zero address")
+	}
+	digits := address[2:]
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && parsed.Hex() != address {
+		return fmt.Errorf("has an invalid checksum")
+	}
+	return nil
+}
+
+// validateAddress checks the format of an address on chain.
+func validateAddress(chain, address string) error {
+	validate, ok := addressValidators[chain]
+	if !ok {
+		return fmt.Errorf("can not be validated on %s", chain)
+	}
+	return validate(address)
+}
+
+// Screener checks destination addresses against sanctions or risk lists before an escrow is
+// issued for a bridge to them.
+type Screener interface {
+	// Screen returns whether address on chain must be refused and why.
+	Screen(ctx context.Context, chain, address string) (blocked bool, reason string, err error)
+}
+
+// FileScreener refuses the addresses listed in a file, one per line, optionally prefixed with
+// the chain they apply to and followed by a reason:
+//
+//	0x8589427373d6d84e98730d7795d8f6f8731fda16 # sanctioned
+//	octa:0x5eb565b14b39171c187d5a260789685042e85eca # reported scam
+//
+// The file is read again when it changes, so that a mounted list can be updated in place.
+type FileScreener struct {
+	path string
+	// interval is how often the file is checked for changes.
+	interval time.Duration
+
+	mu      sync.Mutex
+	modTime time.Time
+	checked time.Time
+	blocked map[string]string
+}
+
+// NewFileScreener returns a FileScreener of the list at path.
+func NewFileScreener(path string) (*FileScreener, error) {
+	s := &FileScreener{path: path, interval: 30 * time.Second}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Screen implements Screener.
+func (s *FileScreener) Screen(ctx context.Context, chain, address string) (bool, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.checked) > s.interval {
+		if err := s.reload(); err != nil {
+			return false, "", err
+		}
+	}
+	address = strings.ToLower(address)
+	if reason, ok := s.blocked[address]; ok {
+		return true, reason, nil
+	}
+	if reason, ok := s.blocked[chain+":"+address]; ok {
+		return true, reason, nil
+	}
+	return false, "", nil
+}
+
+// reload reads the list if it changed since it was last read. s.mu must be held, or s not
+// shared yet.
+func (s *FileScreener) reload() error {
+	s.checked = time.Now()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if s.blocked != nil && info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	blocked := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		reason := "listed"
+		if i := strings.Index(line, "#"); i >= 0 {
+			if r := strings.TrimSpace(line[i+1:]); r != "" {
+				reason = r
+			}
+			line = line[:i]
+		}
+		entry := strings.ToLower(strings.TrimSpace(line))
+		if entry == "" {
+			continue
+		}
+		address := entry
+		if i := strings.Index(entry, ":"); i >= 0 {
+			address = entry[i+1:]
+		}
+		if !evmAddressPattern.MatchString(address) {
+			return fmt.Errorf("%s:%d: %q is not an address", s.path, n, entry)
+		}
+		blocked[entry] = reason
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.blocked = blocked
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// screenBridgeRequest refuses bridges whose shipping address is a contract, when
+// REJECT_CONTRACT_ADDRESSES is set, or whose shipping or refund address is refused by the
+// screener.
+func (e *ExchangeServer) screenBridgeRequest(ctx context.Context, req BridgeRequest) *ProtocolError {
+	if e.rejectContractAddresses {
+		// there is no rpc client for chains we only reach through a shim.
+		if rpc := e.chainClient(req.BridgeTo); rpc != nil {
+			code, err := rpc.CodeAt(ctx, common.HexToAddress(req.ShippingAddress), nil)
+			if err != nil {
+				e.logger.Errorw("failed to look up shipping address code", "chain", req.BridgeTo, "address", req.ShippingAddress, "error", err)
+				return protocolErrorf(ErrCodeInternal, "", "unable to check the shipping address, please try again")
+			}
+			if len(code) > 0 {
+				RejectionsInc(RejectAddressContract)
+				return protocolErrorf(ErrCodeAddressRejected, "data.shippingAddress", "shipping address is a contract, bridges can only be shipped to wallets")
+			}
+		}
+	}
+
+	if e.screener == nil {
+		return nil
+	}
+	for _, check := range []struct {
+		chain, address, field string
+	}{
+		{req.BridgeTo, req.ShippingAddress, "data.shippingAddress"},
+		{req.FromChain, req.RefundAddress, "data.refundAddress"},
+	} {
+		if check.address == "" {
+			continue
+		}
+		blocked, reason, err := e.screener.Screen(ctx, check.chain, check.address)
+		if err != nil {
+			// fail closed, an address that could not be screened is not bridged to.
+			e.logger.Errorw("failed to screen address", "chain", check.chain, "address", check.address, "error", err)
+			return protocolErrorf(ErrCodeInternal, "", "unable to check the address, please try again")
+		}
+		if blocked {
+			e.logger.Infow("refusing screened address", "chain", check.chain, "address", check.address, "reason", reason)
+			RejectionsInc(RejectAddressScreened)
+			return protocolErrorf(ErrCodeAddressRejected, check.field, "the address can not be bridged to")
+		}
+	}
+	return nil
+}
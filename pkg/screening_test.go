@@ -0,0 +1,51 @@
+package be
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileScreener(t *testing.T) {
+	list := `# screening list
+0x8589427373D6D84E98730D7795D8F6F8731FDA16 # sanctioned
+octa:0x5eb565b14b39171c187d5a260789685042e85eca #   reported scam
+
+0x1111111111111111111111111111111111111111
+`
+	path := filepath.Join(t.TempDir(), "screening.txt")
+	if err := os.WriteFile(path, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileScreener(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		chain       string
+		address     string
+		wantBlocked bool
+		wantReason  string
+	}{
+		{"any chain", GRAMS, "0x8589427373d6d84e98730d7795d8f6f8731fda16", true, "sanctioned"},
+		{"mixed case", OCTA, "0x8589427373D6D84E98730D7795D8F6F8731FDA16", true, "sanctioned"},
+		{"chain entry", OCTA, "0x5eb565b14b39171c187d5a260789685042e85eca", true, "reported scam"},
+		{"other chain", GRAMS, "0x5eb565b14b39171c187d5a260789685042e85eca", false, ""},
+		{"no reason", BSCUSDT, "0x1111111111111111111111111111111111111111", true, "listed"},
+		{"not listed", GRAMS, "0x2222222222222222222222222222222222222222", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocked, reason, err := s.Screen(context.Background(), tt.chain, tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blocked != tt.wantBlocked || reason != tt.wantReason {
+				t.Errorf("Screen(%s, %s) = %v, %q, want %v, %q", tt.chain, tt.address, blocked, reason, tt.wantBlocked, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package be
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/gorilla/websocket"
+)
+
+// bridgeEventTTL is how long status events and session bridge lists are kept for replay.
+const bridgeEventTTL = time.Hour * 24 * 7
+
+// bridgeClientsKey is a hash of the API client that created each bridge, by transaction id.
+const bridgeClientsKey = "bridgeclients"
+
+// sessionIDPattern restricts the session tokens clients may choose with ?id=.
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// write sends a message to the client. gorilla/websocket does not support concurrent
+// writers, and status updates are sent from the watcher goroutines.
+func (c *WebSocketClient) write(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// subscribe delivers messages published on topic to client. Topics are session ids and
+// bridge transaction ids.
+func (e *ExchangeServer) subscribe(topic string, client *WebSocketClient) {
+	e.wsClientsMutex.Lock()
+	defer e.wsClientsMutex.Unlock()
+	if e.subscriptions[topic] == nil {
+		e.subscriptions[topic] = make(map[string]*WebSocketClient)
+	}
+	e.subscriptions[topic][client.connID] = client
+	client.topics = append(client.topics, topic)
+}
+
+// unsubscribeAll removes a disconnected client from every topic it subscribed to.
+func (e *ExchangeServer) unsubscribeAll(client *WebSocketClient) {
+	e.wsClientsMutex.Lock()
+	defer e.wsClientsMutex.Unlock()
+	for _, topic := range client.topics {
+		delete(e.subscriptions[topic], client.connID)
+		if len(e.subscriptions[topic]) == 0 {
+			delete(e.subscriptions, topic)
+		}
+	}
+	delete(e.wsClients, client.connID)
+	WebSocketConnectionsAdd(-1)
+}
+
+// broadcast writes data to every socket subscribed to any of the topics, once per socket.
+// It returns the number of sockets the message was written to.
+func (e *ExchangeServer) broadcast(data []byte, topics ...string) int {
+	e.wsClientsMutex.Lock()
+	clients := make(map[string]*WebSocketClient)
+	for _, topic := range topics {
+		for id, client := range e.subscriptions[topic] {
+			clients[id] = client
+		}
+	}
+	e.wsClientsMutex.Unlock()
+
+	for _, client := range clients {
+		if err := client.write(data); err != nil {
+			e.logger.Errorw("failed to write to websocket", "sid", client.sid, "error", err)
+		}
+	}
+	return len(clients)
+}
+
+// publishStatus records a status event of a bridge, updates its history and sends the event
+// to every socket following the bridge or the session that created it.
+func (e *ExchangeServer) publishStatus(awr AccountWatchRequest, msgType string, message string) {
+	e.recordBridge(awr)
+
+	statusMsg := StatusMsg{
+		Type:          msgType,
+		Message:       message,
+		TransactionID: awr.TransactionID,
+		State:         awr.State,
+		Time:          time.Now().Unix(),
+	}
+
+	if err := e.storeBridgeEvent(&statusMsg); err != nil {
+		e.bridgeLogger(awr).Errorw("failed to store bridge event", "error", err)
+	}
+	e.notifyWebhooks(awr, statusMsg)
+
+	data, err := json.Marshal(statusMsg)
+	if err != nil {
+		e.bridgeLogger(awr).Errorw("failed encode statusMsg", "error", err)
+		return
+	}
+
+	e.bridgeLogger(awr).Infow("publishStatus", "data", statusMsg)
+	if e.broadcast(data, awr.TransactionID, awr.WSClientID) == 0 {
+		e.bridgeLogger(awr).Infow("no client connected for bridge, the status will be replayed on reconnect")
+	}
+}
+
+// storeBridgeEvent appends a status event to the event log of its bridge and sets its sequence number.
+func (e *ExchangeServer) storeBridgeEvent(statusMsg *StatusMsg) error {
+	ctx := context.Background()
+	key := "bridgeevents:" + statusMsg.TransactionID
+
+	// the sequence number is reserved first so that it can be stored with the event.
+	seq, err := e.redisClient.Incr(ctx, key+":seq").Result()
+	if err != nil {
+		return err
+	}
+	statusMsg.Seq = seq
+
+	data, err := json.Marshal(statusMsg)
+	if err != nil {
+		return err
+	}
+
+	pipe := e.redisClient.TxPipeline()
+	pipe.RPush(ctx, key, data)
+	pipe.Expire(ctx, key, bridgeEventTTL)
+	pipe.Expire(ctx, key+":seq", bridgeEventTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// retrieveBridgeEvents returns the status events of a bridge with a sequence number above since.
+func (e *ExchangeServer) retrieveBridgeEvents(txid string, since int64) ([]StatusMsg, error) {
+	events, err := e.redisClient.LRange(context.Background(), "bridgeevents:"+txid, 0, -1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	statusMsgs := make([]StatusMsg, 0, len(events))
+	for _, event := range events {
+		var statusMsg StatusMsg
+		if err := json.Unmarshal([]byte(event), &statusMsg); err != nil {
+			return nil, err
+		}
+		if statusMsg.Seq > since {
+			statusMsgs = append(statusMsgs, statusMsg)
+		}
+	}
+	return statusMsgs, nil
+}
+
+// addSessionBridge remembers that a bridge was created by a session so that the session
+// can resume it.
+func (e *ExchangeServer) addSessionBridge(sid, txid string) error {
+	ctx := context.Background()
+	key := "sessionbridges:" + sid
+	pipe := e.redisClient.TxPipeline()
+	pipe.SAdd(ctx, key, txid)
+	pipe.Expire(ctx, key, bridgeEventTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// sessionBridges returns the bridges created by a session.
+func (e *ExchangeServer) sessionBridges(sid string) ([]string, error) {
+	txids, err := e.redisClient.SMembers(context.Background(), "sessionbridges:"+sid).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return txids, nil
+}
+
+// sessionAuth is what a session is resumed with. It is stored as JSON under sessionauth:<sid>
+// for as long as the status updates of its bridges are kept.
+type sessionAuth struct {
+	TokenHash string `json:"tokenHash"`
+	// ClientID is the API client the session was started by, empty for anonymous sessions.
+	ClientID string `json:"clientID,omitempty"`
+}
+
+// startSession issues the resume token of a new session started by principal.
+func (e *ExchangeServer) startSession(ctx context.Context, sid string, principal *Principal) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(sessionAuth{TokenHash: hashSecret(token), ClientID: principal.ClientID})
+	if err != nil {
+		return "", err
+	}
+	return token, e.redisClient.Set(ctx, "sessionauth:"+sid, data, bridgeEventTTL).Err()
+}
+
+// authorizeSession reports whether token resumes the session sid for principal. Sessions are
+// only resumed with their token, by the API client that started them.
+func (e *ExchangeServer) authorizeSession(ctx context.Context, sid, token string, principal *Principal) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	data, err := e.redisClient.Get(ctx, "sessionauth:"+sid).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var auth sessionAuth
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(token)), []byte(auth.TokenHash)) != 1 {
+		return false, nil
+	}
+	return auth.ClientID == principal.ClientID, nil
+}
+
+// setBridgeClient remembers the API client that created a bridge. Bridges created anonymously
+// have none.
+func (e *ExchangeServer) setBridgeClient(ctx context.Context, txid, clientID string) error {
+	if clientID == "" {
+		return nil
+	}
+	return e.redisClient.HSet(ctx, bridgeClientsKey, txid, clientID).Err()
+}
+
+// bridgeClient returns the API client that created a bridge, empty if it was anonymous.
+func (e *ExchangeServer) bridgeClient(ctx context.Context, txid string) (string, error) {
+	clientID, err := e.redisClient.HGet(ctx, bridgeClientsKey, txid).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return clientID, err
+}
+
+// canFollowBridge reports whether client may follow the bridge txid: the bridges of its own
+// session, and those created by the API client it authenticated as.
+func (e *ExchangeServer) canFollowBridge(ctx context.Context, client *WebSocketClient, txid string) (bool, error) {
+	txids, err := e.sessionBridges(client.sid)
+	if err != nil {
+		return false, err
+	}
+	if containsString(txids, txid) {
+		return true, nil
+	}
+	if client.principal == nil || client.principal.ClientID == "" {
+		return false, nil
+	}
+	owner, err := e.bridgeClient(ctx, txid)
+	if err != nil {
+		return false, err
+	}
+	return owner == client.principal.ClientID, nil
+}
+
+// followBridge subscribes a socket to a bridge and replays the status events it missed.
+func (e *ExchangeServer) followBridge(client *WebSocketClient, txid string, since int64) {
+	e.subscribe(txid, client)
+
+	events, err := e.retrieveBridgeEvents(txid, since)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve bridge events", "sid", client.sid, "txid", txid, "error", err)
+		return
+	}
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			e.logger.Errorw("failed encode statusMsg", "sid", client.sid, "error", err)
+			continue
+		}
+		if err := client.write(data); err != nil {
+			e.logger.Errorw("failed to replay bridge event", "sid", client.sid, "txid", txid, "error", err)
+			return
+		}
+	}
+}
+
+// resumeSession subscribes a reconnecting socket to the bridges of the session it resumed,
+// or to the bridge whose transaction id it connected with, and replays what it missed. since
+// is the last sequence number the client has seen, if any. Bridges the client may not follow
+// are not resumed.
+func (e *ExchangeServer) resumeSession(ctx context.Context, client *WebSocketClient, id string, since string) {
+	var txids []string
+	var err error
+	if id == client.sid {
+		txids, err = e.sessionBridges(id)
+	} else {
+		// id is a bridge, or the bridge id of a bridge created over HTTP.
+		var candidates []string
+		if candidates, err = e.sessionBridges(id); err == nil && len(candidates) == 0 {
+			candidates = []string{id}
+		}
+		for _, txid := range candidates {
+			var allowed bool
+			if allowed, err = e.canFollowBridge(ctx, client, txid); err != nil {
+				break
+			}
+			if allowed {
+				txids = append(txids, txid)
+			}
+		}
+	}
+	if err != nil {
+		e.logger.Errorw("failed to look up session bridges", "sid", client.sid, "id", id, "error", err)
+		return
+	}
+	if len(txids) == 0 {
+		e.logger.Infow("nothing to resume", "sid", client.sid, "id", id)
+		return
+	}
+
+	var seq int64
+	if since != "" {
+		seq, _ = strconv.ParseInt(since, 10, 64)
+	}
+
+	resumed := ResumedMsg{
+		Type:           "resumed",
+		SID:            client.sid,
+		TransactionIDs: txids,
+	}
+	data, err := json.Marshal(resumed)
+	if err != nil {
+		e.logger.Errorw("failed encode ResumedMsg", "sid", client.sid, "error", err)
+		return
+	}
+	if err := client.write(data); err != nil {
+		e.logger.Errorw("failed to write to websocket", "sid", client.sid, "error", err)
+		return
+	}
+
+	e.logger.Infow("resuming session", "sid", client.sid, "bridges", txids)
+	for _, txid := range txids {
+		e.followBridge(client, txid, seq)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
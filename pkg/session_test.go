@@ -0,0 +1,109 @@
+package be
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAuthorizeSession(t *testing.T) {
+	e, mr := newTestServer(t)
+	ctx := context.Background()
+	acme := &Principal{ClientID: "acme"}
+	anonymous := &Principal{Anonymous: true}
+
+	acmeToken, err := e.startSession(ctx, "acme-session", acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymousToken, err := e.startSession(ctx, "anonymous-session", anonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		sid       string
+		token     string
+		principal *Principal
+		want      bool
+	}{
+		{"token and client match", "acme-session", acmeToken, acme, true},
+		{"anonymous session resumed anonymously", "anonymous-session", anonymousToken, anonymous, true},
+		{"wrong token", "acme-session", anonymousToken, acme, false},
+		{"empty token", "acme-session", "", acme, false},
+		{"another client", "acme-session", acmeToken, &Principal{ClientID: "other"}, false},
+		{"anonymously", "acme-session", acmeToken, anonymous, false},
+		{"client resuming an anonymous session", "anonymous-session", anonymousToken, acme, false},
+		{"unknown session", "unknown", acmeToken, acme, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.authorizeSession(ctx, tt.sid, tt.token, tt.principal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("authorizeSession = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// sessions are resumable for as long as the status updates of their bridges are kept.
+	mr.FastForward(bridgeEventTTL)
+	if ok, err := e.authorizeSession(ctx, "acme-session", acmeToken, acme); err != nil || ok {
+		t.Errorf("authorizeSession after bridgeEventTTL = %v, %v, want false", ok, err)
+	}
+}
+
+func TestCanFollowBridge(t *testing.T) {
+	e, _ := newTestServer(t)
+	ctx := context.Background()
+
+	if err := e.addSessionBridge("acme-session", "session-bridge"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.setBridgeClient(ctx, "acme-bridge", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.setBridgeClient(ctx, "other-bridge", "other"); err != nil {
+		t.Fatal(err)
+	}
+	// bridges created anonymously are not recorded, so no client owns them.
+	if err := e.setBridgeClient(ctx, "anonymous-bridge", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	acme := &WebSocketClient{sid: "acme-session", principal: &Principal{ClientID: "acme"}}
+	acmeElsewhere := &WebSocketClient{sid: "another-session", principal: &Principal{ClientID: "acme"}}
+	anonymousInSession := &WebSocketClient{sid: "acme-session", principal: &Principal{Anonymous: true}}
+	anonymous := &WebSocketClient{sid: "another-session", principal: &Principal{Anonymous: true}}
+	unauthenticated := &WebSocketClient{sid: "another-session"}
+
+	for _, tt := range []struct {
+		name   string
+		client *WebSocketClient
+		txid   string
+		want   bool
+	}{
+		{"bridge of its session", acme, "session-bridge", true},
+		{"bridge of its client", acme, "acme-bridge", true},
+		{"bridge of its client from another session", acmeElsewhere, "acme-bridge", true},
+		{"bridge of another session", acmeElsewhere, "session-bridge", false},
+		{"bridge of another client", acme, "other-bridge", false},
+		{"anonymous bridge", acme, "anonymous-bridge", false},
+		{"unknown bridge", acme, "unknown", false},
+		{"anonymous client in the session", anonymousInSession, "session-bridge", true},
+		{"anonymous client following a client bridge", anonymousInSession, "acme-bridge", false},
+		{"anonymous client following an anonymous bridge", anonymous, "anonymous-bridge", false},
+		{"unauthenticated client", unauthenticated, "acme-bridge", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.canFollowBridge(ctx, tt.client, tt.txid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("canFollowBridge = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
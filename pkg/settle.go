@@ -0,0 +1,392 @@
+package be
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bridge "github.com/TeaPartyCrypto/partybridge/pkg/contract/bridge"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Executors that settle bridges.
+const (
+	// SettlerShim asks the partyshim service of the route to mint or release.
+	SettlerShim = "shim"
+	// SettlerDirect mints, burns and releases in process, signing with PRIVATE_KEY.
+	SettlerDirect = "direct"
+)
+
+// Settler settles a bridge by delivering the bridged asset to its shipping address. Both
+// methods return the settlement transaction, if it is known.
+type Settler interface {
+	// Mint mints the wrapped asset of a bridge that wraps.
+	Mint(ctx context.Context, awrr AccountWatchRequestResult) (string, error)
+	// Release sends the native asset of a bridge that unwraps.
+	Release(ctx context.Context, awrr AccountWatchRequestResult) (string, error)
+}
+
+// UnconfirmedSettlementError is returned by settlers when a settlement failed after it may
+// have been delivered, e.g. a shim that timed out or a transaction that was not mined in time.
+// Bridges that fail with it are not refunded.
+type UnconfirmedSettlementError struct {
+	// TxHash is the settlement transaction that may be mined, if it is known.
+	TxHash string
+	Err    error
+}
+
+func (e *UnconfirmedSettlementError) Error() string {
+	if e.TxHash == "" {
+		return "settlement unconfirmed: " + e.Err.Error()
+	}
+	return fmt.Sprintf("settlement unconfirmed, transaction %s may still be mined: %s", e.TxHash, e.Err.Error())
+}
+
+func (e *UnconfirmedSettlementError) Unwrap() error {
+	return e.Err
+}
+
+// settlementError returns the error of a settlement transaction. Transactions that were sent
+// and not seen to revert may still be mined, so their errors are unconfirmed.
+func settlementError(result txResult, err error) error {
+	if result.TxHash == "" || result.Status == TxStatusReverted {
+		return err
+	}
+	return &UnconfirmedSettlementError{TxHash: result.TxHash, Err: err}
+}
+
+// shimSettler settles through the partyshim services over mTLS.
+type shimSettler struct {
+	e *ExchangeServer
+}
+
+func (s shimSettler) Mint(ctx context.Context, awrr AccountWatchRequestResult) (string, error) {
+	return s.e.requestToMintWrappedCurrency(ctx, awrr)
+}
+
+func (s shimSettler) Release(ctx context.Context, awrr AccountWatchRequestResult) (string, error) {
+	return s.e.requestToTransferCoinOnChainFromShim(ctx, awrr)
+}
+
+// directSettler settles by sending the transactions itself. Mints and burns are signed with
+// key, which must own the wrapped token contracts. Releases are paid from a bridge account
+// when one holds the asset, and from key otherwise.
+type directSettler struct {
+	e   *ExchangeServer
+	key *ecdsa.PrivateKey
+}
+
+func (s directSettler) Mint(ctx context.Context, awrr AccountWatchRequestResult) (string, error) {
+	awr := awrr.AccountWatchRequest
+	log := s.e.bridgeLogger(awr)
+	info := awr.AssistedSellOrderInformation
+	if !common.IsHexAddress(info.SellerShippingAddress) {
+		return "", fmt.Errorf("invalid shipping address %q", info.SellerShippingAddress)
+	}
+
+	token, rpc := s.e.mintContractForRoute(info.Currency, info.BridgeTo)
+	if token == "" || rpc == nil {
+		return "", fmt.Errorf("no wrapped token of %s on %s to mint", info.Currency, info.BridgeTo)
+	}
+	contract, err := bridge.NewPartyBridgeTransactor(common.HexToAddress(token), rpc)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infow("minting wrapped asset", "token", token, "to", info.SellerShippingAddress, "amount", awr.Amount)
+	result, err := s.e.sendContractTx(ctx, info.BridgeTo, rpc, s.key, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return contract.Mint(opts, common.HexToAddress(info.SellerShippingAddress), awr.Amount)
+	}, log)
+	if err != nil {
+		return result.TxHash, settlementError(result, fmt.Errorf("minting %s on %s: %w", info.Currency, info.BridgeTo, err))
+	}
+	return result.TxHash, nil
+}
+
+func (s directSettler) Release(ctx context.Context, awrr AccountWatchRequestResult) (string, error) {
+	awr := awrr.AccountWatchRequest
+	log := s.e.bridgeLogger(awr)
+	info := awr.AssistedSellOrderInformation
+	if awr.Amount == nil {
+		return "", fmt.Errorf("amount is nil")
+	}
+	if !common.IsHexAddress(info.SellerShippingAddress) {
+		return "", fmt.Errorf("invalid shipping address %q", info.SellerShippingAddress)
+	}
+	to := common.HexToAddress(info.SellerShippingAddress)
+
+	bs, err := s.e.retrieveBridgeAccount(awrr)
+	if err != nil {
+		log.Errorw("failed to retrieve bridge account", "error", err)
+		return "", err
+	}
+	key := s.key
+	if bs != nil {
+		if key, err = escrowKey(bs.PrivateKey); err != nil {
+			return "", fmt.Errorf("parsing the key of bridge account %s: %w", bs.ID, err)
+		}
+	}
+
+	var result txResult
+	switch info.BridgeTo {
+	case GRAMS, OCTA:
+		log.Infow("releasing native asset", "from", crypto.PubkeyToAddress(key.PublicKey).Hex(), "to", to.Hex(), "amount", awr.Amount)
+		result, err = s.e.sendNative(ctx, info.BridgeTo, s.e.chainClient(info.BridgeTo), key, to, awr.Amount, log)
+	case BSCUSDT:
+		rpc := s.e.bscNode.client()
+		if rpc == nil {
+			return "", fmt.Errorf("no rpc client configured for chain %s", BSCUSDT)
+		}
+		var contract *bridge.PartyBridgeTransactor
+		if contract, err = bridge.NewPartyBridgeTransactor(common.HexToAddress(bscUSDTContractAddress), rpc); err != nil {
+			return "", err
+		}
+		log.Infow("releasing BSCUSDT", "from", crypto.PubkeyToAddress(key.PublicKey).Hex(), "to", to.Hex(), "amount", awr.Amount)
+		result, err = s.e.sendContractTx(ctx, BSCUSDT, rpc, key, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+			return contract.Transfer(opts, to, awr.Amount)
+		}, log)
+	default:
+		return "", fmt.Errorf("unsupported bridge to: %s", info.BridgeTo)
+	}
+	if err != nil {
+		return result.TxHash, settlementError(result, fmt.Errorf("releasing %s on %s: %w", info.Currency, info.BridgeTo, err))
+	}
+
+	if bs != nil {
+		if err := s.e.updateBridgeAccountInDB(bs.ID, awr.Amount); err != nil {
+			log.Errorw("failed to update bridge account in db", "error", err)
+		}
+	}
+
+	// the release is done, a failed burn leaves the wrapped tokens in the escrow and is retried.
+	if err := s.burnDeposit(ctx, awr); err != nil {
+		log.Errorw("failed to burn the wrapped deposit, queueing it for retry", "escrow", awr.Account, "amount", awr.Amount, "error", err)
+		awr.SettlementTxHash = result.TxHash
+		s.e.queueBurn(awr, err)
+	}
+	return result.TxHash, nil
+}
+
+// burnRetryInterval is how often the burn of a deposit is retried. A pod claims each retry for
+// as long, so it also bounds how long a burn may take before another pod tries again.
+const burnRetryInterval = 15 * time.Minute
+
+// burnCheckInterval is how often the burn list is checked for burns to retry.
+const burnCheckInterval = time.Minute
+
+// queueBurn stores a settled unwrap whose deposit could not be burned in the burn list, where
+// runBurnRetries picks it up and operators can see why it failed. The list is a hash keyed by
+// transaction id, so that queueing a burn never overwrites the burns queued or removed by
+// other pods at the same time.
+func (e *ExchangeServer) queueBurn(awr AccountWatchRequest, cause error) {
+	awr.State = BridgeStateSettled
+	awr.SettledTime = time.Now()
+	awr.FailureReason = "burning the wrapped deposit: " + cause.Error()
+	awr.Locked = false
+	awr.LockedBy = ""
+	b, err := json.Marshal(awr)
+	if err == nil {
+		err = e.redisClient.HSet(context.Background(), burnAccountWatchRequests, awr.TransactionID, b).Err()
+	}
+	if err != nil {
+		e.bridgeLogger(awr).Errorw("failed to queue the burn of the wrapped deposit", "escrow", awr.Account, "amount", awr.Amount, "error", err)
+	}
+}
+
+// retrieveBurns returns the queued burns, oldest settlement first.
+func (e *ExchangeServer) retrieveBurns(ctx context.Context) ([]AccountWatchRequest, error) {
+	values, err := e.redisClient.HVals(ctx, burnAccountWatchRequests).Result()
+	if err != nil {
+		return nil, err
+	}
+	burns := make([]AccountWatchRequest, 0, len(values))
+	for _, v := range values {
+		var awr AccountWatchRequest
+		if err := json.Unmarshal([]byte(v), &awr); err != nil {
+			return nil, err
+		}
+		burns = append(burns, awr)
+	}
+	sort.Slice(burns, func(i, j int) bool { return burns[i].SettledTime.Before(burns[j].SettledTime) })
+	return burns, nil
+}
+
+// runBurnRetries retries the queued burns every burnCheckInterval until ctx is done. Without
+// a hot wallet to burn with the burns wait for an operator.
+func (e *ExchangeServer) runBurnRetries(ctx context.Context) {
+	if e.hotWallet == nil {
+		return
+	}
+	ticker := time.NewTicker(burnCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		e.retryBurns(ctx, e.burnQueued)
+	}
+}
+
+// retryBurns calls burn with the queued burns that no pod retried in the last
+// burnRetryInterval, and removes those it burned from the burn list.
+func (e *ExchangeServer) retryBurns(ctx context.Context, burn func(context.Context, AccountWatchRequest) error) {
+	burns, err := e.retrieveBurns(ctx)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve the burns to retry", "error", err)
+		return
+	}
+	for _, awr := range burns {
+		log := e.bridgeLogger(awr)
+		claimed, err := e.redisClient.SetNX(ctx, "burning:"+awr.TransactionID, e.podName, burnRetryInterval).Result()
+		if err != nil || !claimed {
+			continue
+		}
+		if err := burn(ctx, awr); err != nil {
+			log.Errorw("failed to burn the wrapped deposit", "escrow", awr.Account, "amount", awr.Amount, "error", err)
+			continue
+		}
+		if err := e.redisClient.HDel(ctx, burnAccountWatchRequests, awr.TransactionID).Err(); err != nil {
+			log.Errorw("failed to remove the burn from the burn list", "error", err)
+		}
+	}
+}
+
+// burnQueued burns a queued deposit with the hot wallet. Deposits that are no longer in their
+// escrow, because an earlier attempt went through after all or they were burned by hand, are
+// not burned again.
+func (e *ExchangeServer) burnQueued(ctx context.Context, awr AccountWatchRequest) error {
+	log := e.bridgeLogger(awr)
+	balance, err := e.depositBalance(ctx, awr)
+	if err != nil {
+		return fmt.Errorf("reading the escrow balance: %w", err)
+	}
+	if balance.Cmp(awr.Amount) < 0 {
+		log.Infow("the wrapped deposit is no longer in the escrow, not burning it", "escrow", awr.Account, "balance", balance)
+		return nil
+	}
+	if err := (directSettler{e, e.hotWallet}).burnDeposit(ctx, awr); err != nil {
+		return err
+	}
+	log.Infow("burned the wrapped deposit", "escrow", awr.Account, "amount", awr.Amount)
+	return nil
+}
+
+// burnDeposit burns the wrapped tokens deposited in the escrow of awr, which an unwrap has
+// released the native asset of.
+func (s directSettler) burnDeposit(ctx context.Context, awr AccountWatchRequest) error {
+	token := s.e.depositTokenContract(awr.Chain, awr.AssistedSellOrderInformation.Currency)
+	if token == "" {
+		return fmt.Errorf("no wrapped token of %s on %s to burn", awr.AssistedSellOrderInformation.Currency, awr.Chain)
+	}
+	rpc := s.e.chainClient(awr.Chain)
+	if rpc == nil {
+		return fmt.Errorf("no rpc client configured for chain %s", awr.Chain)
+	}
+	contract, err := bridge.NewPartyBridgeTransactor(common.HexToAddress(token), rpc)
+	if err != nil {
+		return err
+	}
+	_, err = s.e.sendContractTx(ctx, awr.Chain, rpc, s.key, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return contract.Burn(opts, common.HexToAddress(awr.Account), awr.Amount)
+	}, s.e.bridgeLogger(awr))
+	return err
+}
+
+// parseRouteSettlers parses a comma separated list of "currency:fromChain:bridgeTo=settler"
+// pairs, e.g. "octa:octa:grams=direct".
+func parseRouteSettlers(s string) (map[string]string, error) {
+	settlers := make(map[string]string)
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.Count(kv[0], ":") != 2 {
+			return nil, fmt.Errorf("invalid route settler %q, expected currency:fromChain:bridgeTo=settler", pair)
+		}
+		kind := strings.ToLower(kv[1])
+		if kind != SettlerShim && kind != SettlerDirect {
+			return nil, fmt.Errorf("invalid settler for route %s: %q", kv[0], kv[1])
+		}
+		settlers[strings.ToLower(kv[0])] = kind
+	}
+	return settlers, nil
+}
+
+// shimAddressOf returns the address of the shim that settles route.
+func (e *ExchangeServer) shimAddressOf(route Route) string {
+	switch {
+	case route.BridgeTo == BSCUSDT && route.FromChain == GRAMS,
+		route.Currency == BSCUSDT && route.BridgeTo == GRAMS:
+		return e.bscUSDTOnPartyChainShimServerAddress
+	case route.BridgeTo == BSCUSDT && route.FromChain == OCTA,
+		route.Currency == BSCUSDT && route.BridgeTo == OCTA:
+		return e.bscUSDTOnOctaSpaceShimServerAddress
+	case route.Currency == GRAMS, route.Currency == WGRAMS:
+		return e.gramsShimServerAddress
+	case route.Currency == OCTA, route.Currency == WOCTA:
+		return e.octaShimServerAddress
+	}
+	return ""
+}
+
+// configureSettlers picks the settler of every supported route, kind unless overrides names
+// another. The direct settler signs with the hot wallet, and every shim route needs its shim.
+func (e *ExchangeServer) configureSettlers(kind, overrides string) error {
+	kinds, err := parseRouteSettlers(overrides)
+	if err != nil {
+		return err
+	}
+	kind = strings.ToLower(kind)
+	if kind != SettlerShim && kind != SettlerDirect {
+		return fmt.Errorf("invalid settler %q", kind)
+	}
+
+	e.settlers = make(map[string]Settler)
+	var direct Settler
+	for _, route := range supportedRoutes {
+		routeKind, ok := kinds[route.Key()]
+		if !ok {
+			routeKind = kind
+		}
+		if routeKind == SettlerShim {
+			if e.shimAddressOf(route) == "" {
+				return fmt.Errorf("route %s is settled by a shim but its shim address is not configured", route.Key())
+			}
+			if e.shimCertLocation == "" {
+				return fmt.Errorf("route %s is settled by a shim but SHIM_CA_CERT is not configured", route.Key())
+			}
+			e.settlers[route.Key()] = shimSettler{e}
+			continue
+		}
+		if direct == nil {
+			if e.hotWallet == nil {
+				return fmt.Errorf("route %s is settled directly but PRIVATE_KEY is not a valid key", route.Key())
+			}
+			direct = directSettler{e, e.hotWallet}
+		}
+		e.settlers[route.Key()] = direct
+	}
+	for key := range kinds {
+		if !isSupportedRouteKey(key) {
+			return fmt.Errorf("unsupported route %s", key)
+		}
+	}
+	return nil
+}
+
+// settlerOf returns the settler of route.
+func (e *ExchangeServer) settlerOf(route Route) (Settler, error) {
+	settler, ok := e.settlers[route.Key()]
+	if !ok {
+		return nil, fmt.Errorf("no settler configured for route %s", route.Key())
+	}
+	return settler, nil
+}
@@ -0,0 +1,88 @@
+package be
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestRetryBurns(t *testing.T) {
+	e, mr := newTestServer(t)
+	ctx := context.Background()
+	burn := func(txid string) AccountWatchRequest {
+		return AccountWatchRequest{TransactionID: txid, Account: "0x" + txid, Amount: big.NewInt(1)}
+	}
+	e.queueBurn(burn("burned"), errors.New("nonce too low"))
+	e.queueBurn(burn("failing"), errors.New("nonce too low"))
+
+	var tried []string
+	e.retryBurns(ctx, func(ctx context.Context, awr AccountWatchRequest) error {
+		tried = append(tried, awr.TransactionID)
+		if awr.TransactionID == "failing" {
+			return errors.New("still failing")
+		}
+		// a settlement queues another burn while the retry runs.
+		e.queueBurn(burn("queued"), errors.New("insufficient funds"))
+		return nil
+	})
+	if len(tried) != 2 {
+		t.Fatalf("tried %v, want both queued burns", tried)
+	}
+	assertBurns(t, e, "failing", "queued")
+
+	// burns are claimed for burnRetryInterval, so only the new one is tried right away.
+	tried = nil
+	e.retryBurns(ctx, func(ctx context.Context, awr AccountWatchRequest) error {
+		tried = append(tried, awr.TransactionID)
+		return nil
+	})
+	if len(tried) != 1 || tried[0] != "queued" {
+		t.Fatalf("tried %v, want [queued]", tried)
+	}
+	assertBurns(t, e, "failing")
+
+	mr.FastForward(burnRetryInterval + time.Second)
+	e.retryBurns(ctx, func(ctx context.Context, awr AccountWatchRequest) error { return nil })
+	assertBurns(t, e)
+}
+
+func TestQueueBurnConcurrently(t *testing.T) {
+	e, _ := newTestServer(t)
+	done := make(chan struct{})
+	for _, txid := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		go func(txid string) {
+			e.queueBurn(AccountWatchRequest{TransactionID: txid, Amount: big.NewInt(1)}, errors.New("boom"))
+			done <- struct{}{}
+		}(txid)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	assertBurns(t, e, "a", "b", "c", "d", "e", "f", "g", "h")
+}
+
+// assertBurns checks that the burn list holds exactly the burns of txids.
+func assertBurns(t *testing.T, e *ExchangeServer, txids ...string) {
+	t.Helper()
+	burns, err := e.retrieveAccountWatchRequestList(burnAccountWatchRequests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, awr := range burns {
+		got[awr.TransactionID] = true
+		if awr.State != BridgeStateSettled || awr.FailureReason == "" {
+			t.Errorf("burn %s has state %q and failure reason %q", awr.TransactionID, awr.State, awr.FailureReason)
+		}
+	}
+	if len(got) != len(txids) {
+		t.Errorf("burns = %v, want %v", got, txids)
+	}
+	for _, txid := range txids {
+		if !got[txid] {
+			t.Errorf("burn %s is missing from %v", txid, got)
+		}
+	}
+}
@@ -2,16 +2,17 @@ package be
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"math/big"
+	"net"
 	"net/http"
-	"os"
 	"strings"
 )
 
@@ -22,7 +23,7 @@ type MintRequest struct {
 	SID       string   `json:"sid"`
 }
 
-func (e *ExchangeServer) requestToMintWrappedCurrency(awrr AccountWatchRequestResult) error {
+func (e *ExchangeServer) requestToMintWrappedCurrency(ctx context.Context, awrr AccountWatchRequestResult) (string, error) {
 	mintRequest := MintRequest{
 		ToAddress: awrr.AccountWatchRequest.AssistedSellOrderInformation.SellerShippingAddress,
 		Amount:    awrr.AccountWatchRequest.Amount,
@@ -31,7 +32,7 @@ func (e *ExchangeServer) requestToMintWrappedCurrency(awrr AccountWatchRequestRe
 
 	jsn, err := json.Marshal(mintRequest)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	var shimServerAddress string
@@ -48,39 +49,38 @@ func (e *ExchangeServer) requestToMintWrappedCurrency(awrr AccountWatchRequestRe
 		case OCTA:
 			shimServerAddress = e.bscUSDTOnOctaSpaceShimServerAddress
 		default:
-			return fmt.Errorf("bridge to chain does not support BSCUSDT: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo)
+			return "", fmt.Errorf("bridge to chain does not support BSCUSDT: %s", awrr.AccountWatchRequest.AssistedSellOrderInformation.BridgeTo)
 		}
 	}
 
 	// Load client certificate and key pair
 	cert, err := tls.LoadX509KeyPair(e.shimCertLocation+"/client.crt", e.shimCertLocation+"/client.key")
 	if err != nil {
-		log.Fatal(err)
+		e.logger.Fatalw("loading the shim client certificate", "error", err)
 	}
 
 	// Load the server's CA certificate
 	caCert, err := ioutil.ReadFile(e.shimCertLocation + "/ca.crt")
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		e.logger.Fatalw("loading the shim CA certificate", "error", err)
 	}
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
 
 	// Create a new HTTP client with a custom TLS configuration
 	client := &http.Client{
-		Transport: &http.Transport{
+		Transport: &shimTransport{next: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				Certificates: []tls.Certificate{cert},
 				RootCAs:      caCertPool,
 			},
-		},
+		}},
 	}
 
 	// Create HTTPS POST request to the WGRAMS PartyShim
-	req, err := http.NewRequest("POST", "https://"+shimServerAddress+"/mint", bytes.NewBuffer(jsn))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+shimServerAddress+"/mint", bytes.NewBuffer(jsn))
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Set the content type
@@ -93,32 +93,31 @@ func (e *ExchangeServer) requestToMintWrappedCurrency(awrr AccountWatchRequestRe
 	// Send the request
 	res, err := client.Do(req)
 	if err != nil {
-		return err
+		return "", shimRequestError(err)
 	}
 
-	// Check the response if the header contains 500 then return an error
-	if res.StatusCode == http.StatusInternalServerError {
-		// TODO: this should emit metircs, logs, failure retry, etc.
-		return errors.New("failed to mint")
+	// the shim answered, anything but success means it did not mint.
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return "", fmt.Errorf("failed to mint, the shim replied %s", res.Status)
 	}
 
-	return nil
+	return shimTxHash(res), nil
 }
 
-func (e *ExchangeServer) requestToTransferCoinOnChainFromShim(awr AccountWatchRequestResult) error {
+func (e *ExchangeServer) requestToTransferCoinOnChainFromShim(ctx context.Context, awr AccountWatchRequestResult) (string, error) {
+	log := e.bridgeLogger(awr.AccountWatchRequest)
 	if awr.AccountWatchRequest.Amount == nil {
-		e.logger.Errorf("amount is nil")
-		return errors.New("amount is nil")
+		log.Error("amount is nil")
+		return "", errors.New("amount is nil")
 	}
 	// fetch the private key from the database
 	bs, err := e.retrieveBridgeAccount(awr)
 	if err != nil {
-		e.logger.Errorf("failed to retrieve bridge account: %v", err)
-		return err
+		log.Errorw("failed to retrieve bridge account", "error", err)
+		return "", err
 	}
 
-	e.logger.Infof("awr %+v", awr)
-
 	var transferRequest MintRequest
 	if bs == nil {
 		transferRequest = MintRequest{
@@ -137,7 +136,7 @@ func (e *ExchangeServer) requestToTransferCoinOnChainFromShim(awr AccountWatchRe
 
 	jsn, err := json.Marshal(transferRequest)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	var shimServerAddress string
@@ -163,39 +162,38 @@ func (e *ExchangeServer) requestToTransferCoinOnChainFromShim(awr AccountWatchRe
 	// Load client certificate and key pair
 	cert, err := tls.LoadX509KeyPair(e.shimCertLocation+"/client.crt", e.shimCertLocation+"/client.key")
 	if err != nil {
-		log.Fatal(err)
+		e.logger.Fatalw("loading the shim client certificate", "error", err)
 	}
 
 	// Load the server's CA certificate
 	caCert, err := ioutil.ReadFile(e.shimCertLocation + "/ca.crt")
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		e.logger.Fatalw("loading the shim CA certificate", "error", err)
 	}
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
 
 	// Create a new HTTP client with a custom TLS configuration
 	client := &http.Client{
-		Transport: &http.Transport{
+		Transport: &shimTransport{next: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				Certificates: []tls.Certificate{cert},
 				RootCAs:      caCertPool,
 			},
-		},
+		}},
 	}
 
-	e.logger.Infof("requesting from %+v shim: %s", jsn, shimServerAddress)
+	log.Infow("requesting transfer from shim", "shim", shimServerAddress, "endpoint", shimEndpoint, "to", transferRequest.ToAddress, "amount", transferRequest.Amount)
 	// create http post request to the WGRAMS PartyShim
-	req, err := http.NewRequest("POST", "https://"+shimServerAddress+shimEndpoint, bytes.NewBuffer(jsn))
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+shimServerAddress+shimEndpoint, bytes.NewBuffer(jsn))
 	if err != nil {
 		// if the response contains "insufficient balance" then we need to throw an error and retrieve another bridge account
 		// and try again
 		if strings.Contains(err.Error(), "insufficient balance") {
-			e.logger.Errorf("failed to create request to transfer coin on chain from shim: %v", err)
-			return e.requestToTransferCoinOnChainFromShim(awr)
+			log.Errorw("failed to create request to transfer coin on chain from shim", "error", err)
+			return e.requestToTransferCoinOnChainFromShim(ctx, awr)
 		}
-		return err
+		return "", err
 	}
 
 	// set the content type
@@ -206,27 +204,54 @@ func (e *ExchangeServer) requestToTransferCoinOnChainFromShim(awr AccountWatchRe
 	}
 	res, err := client.Do(req)
 	if err != nil {
-		return err
+		return "", shimRequestError(err)
 	}
 
-	// check the response if the header contains 500 then return an error
-	if res.StatusCode == http.StatusInternalServerError {
-		e.logger.Errorf("failed to transfer native asset on chain")
-		return errors.New("failed to transfer native asset  on chain")
+	// the shim answered, anything but success means it did not transfer.
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		log.Errorw("failed to transfer native asset on chain", "status", res.Status)
+		return "", fmt.Errorf("failed to transfer native asset on chain, the shim replied %s", res.Status)
 	}
 
 	// remove the bridge account from the db
-	e.logger.Infof("Updating the bridge account in the db...")
+	log.Info("updating the bridge account in the db")
 	// if err := e.removeBridgeAccountFromDB(awrr.AccountWatchRequest.TransactionID); err != nil {
 	// 	e.logger.Errorw("failed to remove bridge account from db", err)
 	// 	// data := "There was a bridge failure. Please provide this id to support: " + awrr.AccountWatchRequest.TransactionID
 	// }
 	if err := e.updateBridgeAccountInDB(bs.ID, awr.AccountWatchRequest.Amount); err != nil {
-		e.logger.Errorw("failed to update bridge account in db", err)
+		log.Errorw("failed to update bridge account in db", "error", err)
 		// data := "There was a bridge failure. Please provide this id to support: " + awrr.AccountWatchRequest.TransactionID
 	}
 
-	return nil
+	return shimTxHash(res), nil
+}
+
+// shimRequestError returns the error of a shim request that got no response. The shim may have
+// settled unless the connection to it could not be made.
+func shimRequestError(err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return err
+	}
+	return &UnconfirmedSettlementError{Err: err}
+}
+
+// shimResponse is what the shims may reply to a mint or transfer with.
+type shimResponse struct {
+	TxHash string `json:"txHash"`
+}
+
+// shimTxHash returns the transaction a shim reports in its response, if any. Shims that reply
+// with an empty or non JSON body report none.
+func shimTxHash(res *http.Response) string {
+	defer res.Body.Close()
+	var body shimResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxRequestBodySize)).Decode(&body); err != nil {
+		return ""
+	}
+	return body.TxHash
 }
 
 // func (e *ExchangeServer) requestToTransferGRAMSOnPartyChain(awr AccountWatchRequestResult) error {
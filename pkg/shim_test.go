@@ -0,0 +1,54 @@
+package be
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestShimRequestError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		unconfirmed bool
+	}{
+		{"dial refused", &url.Error{Op: "Post", URL: "https://shim/mint", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, false},
+		{"read reset", &url.Error{Op: "Post", URL: "https://shim/mint", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}, true},
+		{"timeout", &url.Error{Op: "Post", URL: "https://shim/mint", Err: context.DeadlineExceeded}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var unconfirmed *UnconfirmedSettlementError
+			if got := errors.As(shimRequestError(tt.err), &unconfirmed); got != tt.unconfirmed {
+				t.Errorf("unconfirmed = %v, want %v", got, tt.unconfirmed)
+			}
+		})
+	}
+}
+
+func TestSettlementError(t *testing.T) {
+	cause := errors.New("boom")
+	tests := []struct {
+		name        string
+		result      txResult
+		unconfirmed bool
+	}{
+		{"not sent", txResult{}, false},
+		{"reverted", txResult{TxHash: "0x1", Status: TxStatusReverted}, false},
+		{"pending", txResult{TxHash: "0x1", Status: TxStatusPending}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := settlementError(tt.result, cause)
+			var unconfirmed *UnconfirmedSettlementError
+			if got := errors.As(err, &unconfirmed); got != tt.unconfirmed {
+				t.Errorf("unconfirmed = %v, want %v", got, tt.unconfirmed)
+			}
+			if !errors.Is(err, cause) {
+				t.Errorf("%v does not wrap the cause", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package be
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	// pausesKey is a hash of Pause by the key of the switch.
+	pausesKey = "pauses"
+	// heldAccountWatchRequests is the list of requests whose deposit arrived while their route
+	// was paused. They are settled when it resumes.
+	heldAccountWatchRequests = "heldaccountwatchrequests"
+	// unconfirmedAccountWatchRequests is the list of requests whose settlement may have been
+	// delivered although it failed. They wait for an operator.
+	unconfirmedAccountWatchRequests = "unconfirmedaccountwatchrequests"
+	// burnAccountWatchRequests is the hash of settled unwraps, by transaction id, whose wrapped
+	// deposit could not be burned. The burn is retried until it goes through.
+	burnAccountWatchRequests = "burnaccountwatchrequests"
+	// releaseLockTTL bounds how long a pod may take to release a held settlement.
+	releaseLockTTL = 10 * time.Minute
+)
+
+// kill switch scopes. A global pause stops every route, the others stop the routes of a
+// route key, of a chain on either end, or of a currency.
+const (
+	PauseGlobal = "global"
+	PauseRoute  = "route"
+	PauseChain  = "chain"
+	PauseAsset  = "asset"
+)
+
+// PauseScopes are the scopes a kill switch can have.
+var PauseScopes = []string{PauseGlobal, PauseRoute, PauseChain, PauseAsset}
+
+// Pause is a kill switch that is on. While a route is paused, quotes and bridges over it are
+// refused and the deposits of its pending bridges are watched but not settled.
+type Pause struct {
+	Scope string `json:"scope"`
+	// Target is the route key, chain or currency paused, empty for a global pause.
+	Target     string    `json:"target,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	PausedBy   string    `json:"pausedBy"`
+	PausedTime time.Time `json:"pausedTime"`
+}
+
+// Key returns the field the pause is stored under.
+func (p Pause) Key() string {
+	return pauseKey(p.Scope, p.Target)
+}
+
+func pauseKey(scope, target string) string {
+	if scope == PauseGlobal {
+		return PauseGlobal
+	}
+	return scope + ":" + target
+}
+
+// validatePause checks that target names something the scope can pause.
+func validatePause(scope, target string) error {
+	switch scope {
+	case PauseGlobal:
+		if target != "" {
+			return fmt.Errorf("a global pause has no target")
+		}
+		return nil
+	case PauseRoute:
+		if isSupportedRouteKey(target) {
+			return nil
+		}
+		return fmt.Errorf("unknown route %q, expected currency:fromChain:bridgeTo", target)
+	case PauseChain, PauseAsset:
+		for _, route := range supportedRoutes {
+			if scope == PauseChain && (route.FromChain == target || route.BridgeTo == target) {
+				return nil
+			}
+			if scope == PauseAsset && route.Currency == target {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown %s %q", scope, target)
+	}
+	return fmt.Errorf("unknown scope %q, expected one of global, route, chain or asset", scope)
+}
+
+// pauses returns the kill switches that are on.
+func (e *ExchangeServer) pauses(ctx context.Context) ([]Pause, error) {
+	entries, err := e.redisClient.HGetAll(ctx, pausesKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	pauses := make([]Pause, 0, len(entries))
+	for _, data := range entries {
+		var pause Pause
+		if err := json.Unmarshal([]byte(data), &pause); err != nil {
+			return nil, err
+		}
+		pauses = append(pauses, pause)
+	}
+	return pauses, nil
+}
+
+// pauseKeysOf returns the keys of every switch that pauses route, broadest first.
+func pauseKeysOf(route Route) []string {
+	return []string{
+		PauseGlobal,
+		pauseKey(PauseAsset, route.Currency),
+		pauseKey(PauseChain, route.FromChain),
+		pauseKey(PauseChain, route.BridgeTo),
+		pauseKey(PauseRoute, route.Key()),
+	}
+}
+
+// pauseOf returns the switch that pauses route, or nil if it is not paused.
+func (e *ExchangeServer) pauseOf(ctx context.Context, route Route) (*Pause, error) {
+	values, err := e.redisClient.HMGet(ctx, pausesKey, pauseKeysOf(route)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var pause Pause
+		if err := json.Unmarshal([]byte(data), &pause); err != nil {
+			return nil, err
+		}
+		return &pause, nil
+	}
+	return nil, nil
+}
+
+// checkRoutePaused refuses quotes and bridges over routes that are paused.
+func (e *ExchangeServer) checkRoutePaused(ctx context.Context, req BridgeRequest) *ProtocolError {
+	pause, err := e.pauseOf(ctx, routeOfRequest(req))
+	if err != nil {
+		e.logger.Errorw("failed to check whether the route is paused", "error", err)
+		return protocolErrorf(ErrCodeInternal, "", "unable to check the route, please try again")
+	}
+	if pause != nil {
+		RejectionsInc(RejectRoutePaused)
+		return protocolErrorf(ErrCodeRoutePaused, "data", "bridging %s from %s to %s is paused, please try again later", req.Currency, req.FromChain, req.BridgeTo)
+	}
+	return nil
+}
+
+// holdSettlement moves a request whose deposit arrived while its route is paused to the held
+// list and tells the client. The deposit stays in the escrow until the route resumes.
+func (e *ExchangeServer) holdSettlement(awr AccountWatchRequest, pause *Pause) error {
+	e.bridgeLogger(awr).Infow("holding settlement of paused route", "pause", pause.Key())
+	awr.State = BridgeStateHeld
+	awr.Locked = false
+	awr.LockedBy = ""
+
+	held, err := e.retrieveAccountWatchRequestList(heldAccountWatchRequests)
+	if err != nil {
+		return err
+	}
+	held = append(held, awr)
+	if err := e.storeAccountWatchRequestList(context.Background(), heldAccountWatchRequests, held); err != nil {
+		return err
+	}
+	if err := e.removeAccountWatchRequestFromDB(awr.TransactionID); err != nil {
+		return err
+	}
+	e.publishStatus(awr, BridgeStateHeld, "The deposit has been received, but bridging is paused. It will be completed when bridging resumes")
+	return nil
+}
+
+// releaseHeldSettlements settles the held requests whose route is no longer paused. It runs
+// on every tick of the warren scheduler. A lock per request keeps two pods from settling it
+// twice.
+func (e *ExchangeServer) releaseHeldSettlements(ctx context.Context) {
+	held, err := e.retrieveAccountWatchRequestList(heldAccountWatchRequests)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve held account watch requests", "error", err)
+		return
+	}
+	for _, awr := range held {
+		pause, err := e.pauseOf(ctx, routeOf(awr))
+		if err != nil {
+			e.bridgeLogger(awr).Errorw("failed to check whether the route is paused", "error", err)
+			return
+		}
+		if pause != nil {
+			continue
+		}
+
+		lock := "releasing:" + awr.TransactionID
+		acquired, err := e.redisClient.SetNX(ctx, lock, e.podName, releaseLockTTL).Result()
+		if err != nil || !acquired {
+			continue
+		}
+		// another pod may have released it before we took the lock.
+		if found, err := e.isHeld(awr.TransactionID); err != nil || !found {
+			e.redisClient.Del(ctx, lock)
+			continue
+		}
+		if err := e.removeAccountWatchRequestFromList(heldAccountWatchRequests, awr.TransactionID); err != nil {
+			e.bridgeLogger(awr).Errorw("failed to remove held account watch request", "error", err)
+			e.redisClient.Del(ctx, lock)
+			continue
+		}
+
+		e.bridgeLogger(awr).Infow("releasing held settlement")
+		awr.State = BridgeStatePending
+		if err := e.Dispatch(&AccountWatchRequestResult{AccountWatchRequest: awr, Result: "success"}); err != nil {
+			e.bridgeLogger(awr).Errorw("failed to settle held bridge", "error", err)
+		}
+		e.redisClient.Del(ctx, lock)
+	}
+}
+
+// isHeld reports whether txid is in the held list.
+func (e *ExchangeServer) isHeld(txid string) (bool, error) {
+	held, err := e.retrieveAccountWatchRequestList(heldAccountWatchRequests)
+	if err != nil {
+		return false, err
+	}
+	for _, awr := range held {
+		if awr.TransactionID == txid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,181 @@
+package be
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters spans can be sent with.
+const (
+	// TracingNone records no spans. Trace context received from clients is still passed on.
+	TracingNone = "none"
+	// TracingOTLP sends spans to an OpenTelemetry collector.
+	TracingOTLP = "otlp"
+)
+
+// tracer starts the spans of the bridge. It records nothing until setupTracing installs an
+// exporter.
+var tracer = otel.Tracer("github.com/TeaPartyCrypto/partybridge")
+
+// setupTracing installs the tracer provider of the configured exporter. It returns a function
+// that flushes the spans not sent yet.
+func setupTracing(ctx context.Context, env *envAccessor, podName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	switch env.TracingExporter {
+	case TracingNone, "":
+		return func(context.Context) error { return nil }, nil
+	case TracingOTLP:
+	default:
+		return nil, fmt.Errorf("unknown exporter %q, expected none or otlp", env.TracingExporter)
+	}
+
+	var client otlptrace.Client
+	switch env.OTLPProtocol {
+	case "grpc":
+		var opts []otlptracegrpc.Option
+		if env.OTLPEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(env.OTLPEndpoint))
+		}
+		if env.OTLPInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(opts...)
+	case "http":
+		var opts []otlptracehttp.Option
+		if env.OTLPEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(env.OTLPEndpoint))
+		}
+		if env.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(opts...)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, expected grpc or http", env.OTLPProtocol)
+	}
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceNameKey.String("partybridge"),
+		semconv.ServiceInstanceIDKey.String(podName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(env.TracingSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// bridgeAttributes identify the bridge a span belongs to.
+func bridgeAttributes(awr AccountWatchRequest) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("bridge.transaction_id", awr.TransactionID),
+		attribute.String("bridge.sid", awr.WSClientID),
+		attribute.String("bridge.route", routeOf(awr).Key()),
+	}
+}
+
+// saveTraceContext stores the trace context of ctx with awr, so that the spans of the pods
+// that watch and settle it later join the trace it was created in.
+func saveTraceContext(ctx context.Context, awr *AccountWatchRequest) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		awr.TraceContext = carrier
+	}
+}
+
+// bridgeContext returns ctx with the trace context saved with awr, unless ctx is part of a
+// trace already.
+func bridgeContext(ctx context.Context, awr AccountWatchRequest) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(awr.TraceContext))
+}
+
+// startBridgeSpan starts a span of the bridge of awr.
+func startBridgeSpan(ctx context.Context, name string, awr AccountWatchRequest) (context.Context, trace.Span) {
+	return tracer.Start(bridgeContext(ctx, awr), name, trace.WithAttributes(bridgeAttributes(awr)...))
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedBalance records every balance check of check in a span, so that polls of token
+// balances, which do not pass the context on to the RPC client, show up in the trace too.
+func tracedBalance(node string, check balanceFunc) balanceFunc {
+	return func(ctx context.Context, account string) (*big.Int, error) {
+		ctx, span := tracer.Start(ctx, "check deposit", trace.WithAttributes(attribute.String("rpc.node", node)))
+		balance, err := check(ctx, account)
+		if balance != nil {
+			span.SetAttributes(attribute.String("bridge.balance", balance.String()))
+		}
+		endSpan(span, err)
+		return balance, err
+	}
+}
+
+// statusRecorder keeps the status code a handler replied with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// traced starts a span for every request to a route of the router, continuing the trace of
+// the caller if it sent a traceparent header.
+func traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				name = tpl
+			}
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.method", r.Method), attribute.String("http.route", name)))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
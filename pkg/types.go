@@ -3,13 +3,14 @@ package be
 import (
 	"context"
 	"math/big"
+	"net"
+	"net/http"
 	"sync"
 	"time"
 
 	"crypto/ecdsa"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/go-redis/redis/v9"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
@@ -28,20 +29,55 @@ const (
 
 type HelloMsg struct {
 	Type          string `json:"type"`
+	Version       int    `json:"version"`
 	SID           string `json:"sid"`
+	ResumeToken   string `json:"resumeToken"` // resumes the session with ?id=<sid>&resumeToken=<token>
 	Fee           int    `json:"fee"`
 	MinimumAmount int    `json:"minimumAmount"`
 }
 
+// RequestBridgeMsg is the envelope of every client message. ID is chosen by the client and
+// echoed in the reply, including error replies.
 type RequestBridgeMsg struct {
-	Type string        `json:"type"`
-	Data BridgeRequest `json:"data,omitempty"`
+	Version int           `json:"version,omitempty"`
+	ID      string        `json:"id,omitempty"`
+	Type    string        `json:"type"`
+	Data    BridgeRequest `json:"data,omitempty"`
 }
 
 type RequestBridgeResponseMsg struct {
-	Type    string   `json:"type"`
-	Amount  *big.Int `json:"amount"`
-	Address string   `json:"address"`
+	Type     string        `json:"type"`
+	Version  int           `json:"version"`
+	ID       string        `json:"id,omitempty"`
+	Amount   *big.Int      `json:"amount"`
+	Address  string        `json:"address"`
+	Capacity *MintCapacity `json:"capacity,omitempty"`
+	// BridgeID is the id to confirm the bridge with over the HTTP API.
+	BridgeID string `json:"bridgeID,omitempty"`
+}
+
+// ConfirmBridgeResponseMsg tells the client which bridge is now waiting for their deposit
+// and when the deposit must arrive by.
+type ConfirmBridgeResponseMsg struct {
+	Type          string   `json:"type"`
+	Version       int      `json:"version"`
+	ID            string   `json:"id,omitempty"`
+	TransactionID string   `json:"transactionID"`
+	Address       string   `json:"address"`
+	Amount        *big.Int `json:"amount"`
+	Deadline      int64    `json:"deadline"`
+}
+
+// QuoteResponseMsg tells the client what a bridge would cost and how much the
+// destination contract can still mint, without issuing an escrow.
+type QuoteResponseMsg struct {
+	Type     string        `json:"type"`
+	Version  int           `json:"version"`
+	ID       string        `json:"id,omitempty"`
+	Amount   *big.Int      `json:"amount"`
+	Fee      *big.Int      `json:"fee"`
+	Capacity *MintCapacity `json:"capacity,omitempty"`
+	Error    string        `json:"error,omitempty"`
 }
 
 type Token struct {
@@ -77,6 +113,19 @@ type ErrorEvent struct {
 type StatusMsg struct {
 	Type    string `json:"type"`
 	Message string `json:"message"`
+	// TransactionID, State, Seq and Time are set on status events of a bridge.
+	TransactionID string `json:"transactionID,omitempty"`
+	State         string `json:"state,omitempty"`
+	Seq           int64  `json:"seq,omitempty"`
+	Time          int64  `json:"time,omitempty"`
+}
+
+// ResumedMsg tells a reconnecting client which bridges it is following again. The status
+// events it missed are replayed after it.
+type ResumedMsg struct {
+	Type           string   `json:"type"`
+	SID            string   `json:"sid"`
+	TransactionIDs []string `json:"transactionIDs"`
 }
 
 // AccountWatchRequest is the information we need to watch a new account
@@ -96,8 +145,72 @@ type AccountWatchRequest struct {
 	AWRID                        string                        `json:"awrid"`
 	WSClientID                   string                        `json:"wsClientID"`
 	CreatedTime                  time.Time                     `json:"createdTime"`
+	// State reflects where the request is in the bridge lifecycle.
+	State string `json:"state,omitempty"`
+	// FailureReason reflects why the bridge could not be settled, if it failed.
+	FailureReason string `json:"failureReason,omitempty"`
+	// RefundTxHash reflects the transaction that returned the deposit to the refund address.
+	RefundTxHash string `json:"refundTxHash,omitempty"`
+	// RefundAmount reflects the amount returned to the refund address, after gas.
+	RefundAmount *big.Int `json:"refundAmount,omitempty"`
+	// RefundTxStatus reflects the receipt of the refund transaction, see TxStatusConfirmed,
+	// and RefundBlock the block it was mined in.
+	RefundTxStatus string `json:"refundTxStatus,omitempty"`
+	RefundBlock    uint64 `json:"refundBlock,omitempty"`
+	// RefundedTime reflects when the refund was sent.
+	RefundedTime time.Time `json:"refundedTime,omitempty"`
+	// ReceivedAmount reflects the escrow balance when the deposit was last checked.
+	ReceivedAmount *big.Int `json:"receivedAmount,omitempty"`
+	// PaymentStatus reflects how the deposit compared to the requested amount.
+	PaymentStatus string `json:"paymentStatus,omitempty"`
+	// ExcessAmount reflects the overpaid amount that is refunded after settlement.
+	ExcessAmount *big.Int `json:"excessAmount,omitempty"`
+	// GraceUntil reflects how long an expired request is watched for late deposits.
+	GraceUntil time.Time `json:"graceUntil,omitempty"`
+	// ClientID reflects the API client that created the bridge, if it was created over the HTTP API.
+	ClientID string `json:"clientID,omitempty"`
+	// WatchFromBlock reflects the block of the deposit chain the escrow was issued at.
+	WatchFromBlock uint64 `json:"watchFromBlock,omitempty"`
+	// DepositedTime reflects when the deposit was detected.
+	DepositedTime time.Time `json:"depositedTime,omitempty"`
+	// DepositTxHash reflects the transaction the deposit was made in, once it has been found.
+	DepositTxHash string `json:"depositTxHash,omitempty"`
+	// SettlementTxHash reflects the transaction that minted or released the bridged asset, if
+	// the shim reported it.
+	SettlementTxHash string `json:"settlementTxHash,omitempty"`
+	// SettledTime reflects when the bridged asset was sent to the shipping address.
+	SettledTime time.Time `json:"settledTime,omitempty"`
+	// ResolutionNote reflects how an operator resolved the bridge by hand, and ResolvedBy who.
+	ResolutionNote string    `json:"resolutionNote,omitempty"`
+	ResolvedBy     string    `json:"resolvedBy,omitempty"`
+	ResolvedTime   time.Time `json:"resolvedTime,omitempty"`
+	// TraceContext reflects the trace the bridge was created in, so that the pods that watch
+	// and settle it continue it.
+	TraceContext map[string]string `json:"traceContext,omitempty"`
 }
 
+// Bridge states recorded on an AccountWatchRequest.
+const (
+	// BridgeStatePending is waiting for the deposit.
+	BridgeStatePending = "pending"
+	// BridgeStateSettled has been minted or released to the shipping address.
+	BridgeStateSettled = "settled"
+	// BridgeStateExpired timed out without receiving a deposit.
+	BridgeStateExpired = "expired"
+	// BridgeStateFailed could not be settled or refunded and needs manual resolution.
+	BridgeStateFailed = "failed"
+	// BridgeStateRefunded had its deposit returned to the refund address.
+	BridgeStateRefunded = "refunded"
+	// BridgeStateHeld received its deposit while its route was paused and is settled when it
+	// resumes.
+	BridgeStateHeld = "held"
+	// BridgeStateResolved was resolved by hand, see its ResolutionNote.
+	BridgeStateResolved = "resolved"
+	// BridgeStateUnconfirmed failed to settle in a way that may still have delivered the
+	// bridged asset. It is never refunded automatically, an operator resolves it.
+	BridgeStateUnconfirmed = "unconfirmed"
+)
+
 // AccountWatchRequestResult is the result of the watch request
 type AccountWatchRequestResult struct {
 	AccountWatchRequest AccountWatchRequest `json:"account_watch_request"`
@@ -112,24 +225,43 @@ type envAccessor struct {
 
 	SMARTCONTRACTPRIVATEKEY string `envconfig:"PRIVATE_KEY" required:"true"`
 
-	PartyChainRPC1 string `envconfig:"PARTY_CHAIN_1" required:"true"`
-	PartyChainRPC2 string `envconfig:"PARTY_CHAIN_2" required:"true"`
-
-	OCTARPC1 string `envconfig:"OCTA_RPC_1" default:"" required:"true"`
-	OCTARPC2 string `envconfig:"OCTA_RPC_2" default:"" required:"true"`
+	// RPC endpoints. PARTY_CHAIN_RPCS, OCTA_RPCS and BSC_RPCS are comma separated lists of the
+	// endpoints of a chain, PARTY_CHAIN_1, PARTY_CHAIN_2, OCTA_RPC_1 and OCTA_RPC_2 are used when
+	// they are unset. Endpoints more than RPC_MAX_LAG blocks behind the others are not called.
+	PartyChainRPC1   string        `envconfig:"PARTY_CHAIN_1" default:""`
+	PartyChainRPC2   string        `envconfig:"PARTY_CHAIN_2" default:""`
+	PartyChainRPCs   string        `envconfig:"PARTY_CHAIN_RPCS" default:""`
+	OCTARPC1         string        `envconfig:"OCTA_RPC_1" default:""`
+	OCTARPC2         string        `envconfig:"OCTA_RPC_2" default:""`
+	OCTARPCs         string        `envconfig:"OCTA_RPCS" default:""`
+	BSCRPCs          string        `envconfig:"BSC_RPCS" default:""`
+	RPCCheckInterval time.Duration `envconfig:"RPC_CHECK_INTERVAL" default:"10s"`
+	RPCMaxLag        uint64        `envconfig:"RPC_MAX_LAG" default:"5"`
+
+	// Outbound transactions. GAS_PRICE_CEILINGS caps the gas price, or the fee cap on chains
+	// with EIP-1559, per chain in gwei, e.g. "grams=200,octa=2.5". Transactions pending for
+	// STUCK_TX_AFTER are replaced with higher fees, at most MAX_GAS_BUMPS times.
+	GasPriceCeilings    string        `envconfig:"GAS_PRICE_CEILINGS" default:""`
+	ReceiptPollInterval time.Duration `envconfig:"RECEIPT_POLL_INTERVAL" default:"5s"`
+	StuckTxAfter        time.Duration `envconfig:"STUCK_TX_AFTER" default:"2m"`
+	MaxGasBumps         int           `envconfig:"MAX_GAS_BUMPS" default:"3"`
 
 	// redis server
 	RedisAddress  string `envconfig:"REDIS_ADDRESS" required:"true"`
 	RedisPassword string `envconfig:"REDIS_PASSWORD" default:""`
 	RedisDB       int    `envconfig:"REDIS_DB" default:"0"`
 
-	// Shim Servers
-	WGramsShimServerAddress               string `envconfig:"WGRAMS_SHIM_SERVER_ADDRESS" required:"true"`
-	WOctaShimServerAddress                string `envconfig:"WOCTA_SHIM_SERVER_ADDRESS" required:"true"`
-	WBSCUSDTOnOctaSpaceShimServerAddress  string `envconfig:"WBSCUSDT_OCTA_SPACE_SHIM_SERVER_ADDRESS" required:"true"`
-	WBSCUSDTOnPartyChainShimServerAddress string `envconfig:"WBSCUSDT_PARTY_CHAIN_SHIM_SERVER_ADDRESS" required:"true"`
+	// Settlement. SETTLER is how bridges are settled, "shim" or "direct", and SETTLERS overrides
+	// it per route, e.g. "octa:octa:grams=direct". The direct settler signs with PRIVATE_KEY.
+	// The shims and SHIM_CA_CERT are only required by the routes they settle.
+	Settler                               string `envconfig:"SETTLER" default:"shim"`
+	Settlers                              string `envconfig:"SETTLERS" default:""`
+	WGramsShimServerAddress               string `envconfig:"WGRAMS_SHIM_SERVER_ADDRESS" default:""`
+	WOctaShimServerAddress                string `envconfig:"WOCTA_SHIM_SERVER_ADDRESS" default:""`
+	WBSCUSDTOnOctaSpaceShimServerAddress  string `envconfig:"WBSCUSDT_OCTA_SPACE_SHIM_SERVER_ADDRESS" default:""`
+	WBSCUSDTOnPartyChainShimServerAddress string `envconfig:"WBSCUSDT_PARTY_CHAIN_SHIM_SERVER_ADDRESS" default:""`
 
-	ShimCertLocation string `envconfig:"SHIM_CA_CERT" required:"true"`
+	ShimCertLocation string `envconfig:"SHIM_CA_CERT" default:""`
 
 	PodName string `envconfig:"HOSTNAME" required:"true"`
 
@@ -143,6 +275,74 @@ type envAccessor struct {
 
 	ServerSSLCRTFilePath string `envconfig:"SERVER_SSL_CRT_FILE_PATH" required:"true"`
 	ServerSSLKeyFilePath string `envconfig:"SERVER_SSL_KEY_FILE_PATH" required:"true"`
+
+	// Payment handling. PAYMENT_WINDOWS overrides PAYMENT_WINDOW per route,
+	// e.g. "octa:octa:grams=30m,bscusdt:bscusdt:grams=1h".
+	PaymentWindow     time.Duration `envconfig:"PAYMENT_WINDOW" default:"30m"`
+	PaymentWindows    string        `envconfig:"PAYMENT_WINDOWS" default:""`
+	TopUpWindow       time.Duration `envconfig:"TOP_UP_WINDOW" default:"15m"`
+	OverpaymentPolicy string        `envconfig:"OVERPAYMENT_POLICY" default:"refund"`
+	LateDepositPolicy string        `envconfig:"LATE_DEPOSIT_POLICY" default:"refund"`
+	LateDepositGrace  time.Duration `envconfig:"LATE_DEPOSIT_GRACE" default:"24h"`
+
+	// Webhooks
+	WebhookTimeout      time.Duration `envconfig:"WEBHOOK_TIMEOUT" default:"10s"`
+	WebhookMaxAttempts  int           `envconfig:"WEBHOOK_MAX_ATTEMPTS" default:"8"`
+	WebhookRetryBackoff time.Duration `envconfig:"WEBHOOK_RETRY_BACKOFF" default:"30s"`
+
+	// CE_RECEIVER_PORT is the port bridge requests are accepted on as CloudEvents, 0 disables it.
+	CEReceiverPort int `envconfig:"CE_RECEIVER_PORT" default:"0"`
+
+	// Authentication. ALLOWED_ORIGINS is a comma separated list of the origins browsers may
+	// call the API and open sockets from, "*" allows any. Rate limits are per minute.
+	AllowedOrigins     string `envconfig:"ALLOWED_ORIGINS" default:"*"`
+	AnonymousAccess    bool   `envconfig:"ANONYMOUS_ACCESS" default:"true"`
+	AnonymousScopes    string `envconfig:"ANONYMOUS_SCOPES" default:"quote,bridge,read"`
+	AnonymousRateLimit int    `envconfig:"ANONYMOUS_RATE_LIMIT" default:"60"`
+	APIKeyRateLimit    int    `envconfig:"API_KEY_RATE_LIMIT" default:"600"`
+	// JWT_SECRET verifies HS256 tokens issued to integrators. Tokens are refused when unset.
+	JWTSecret string `envconfig:"JWT_SECRET" default:""`
+	// TRUSTED_PROXIES is a comma separated list of the networks of proxies, e.g. the ingress,
+	// whose TRUSTED_PROXY_HEADER is believed for the address of the client.
+	TrustedProxies     string `envconfig:"TRUSTED_PROXIES" default:""`
+	TrustedProxyHeader string `envconfig:"TRUSTED_PROXY_HEADER" default:"X-Forwarded-For"`
+
+	// Abuse protection. The limits are token buckets of the form "<count>/<duration>", kept per
+	// address for anonymous clients and per key, API_KEY_LIMIT_MULTIPLIER times as large, for
+	// the others. An empty limit disables it. MAX_PENDING_WATCHES_BY_ROUTE overrides
+	// MAX_PENDING_WATCHES per route, e.g. "octa:octa:grams=100", 0 means no limit.
+	ConnectionLimit          string `envconfig:"CONNECTION_LIMIT" default:"30/1m"`
+	QuoteLimit               string `envconfig:"QUOTE_LIMIT" default:"60/1m"`
+	BridgeLimit              string `envconfig:"BRIDGE_LIMIT" default:"10/1h"`
+	APIKeyLimitMultiplier    int    `envconfig:"API_KEY_LIMIT_MULTIPLIER" default:"10"`
+	MaxPendingPerAddress     int    `envconfig:"MAX_PENDING_PER_ADDRESS" default:"3"`
+	MaxPendingWatches        int    `envconfig:"MAX_PENDING_WATCHES" default:"500"`
+	MaxPendingWatchesByRoute string `envconfig:"MAX_PENDING_WATCHES_BY_ROUTE" default:""`
+
+	// Address screening. SCREENING_FILE is a list of addresses bridges are refused to, see
+	// FileScreener.
+	RejectContractAddresses bool   `envconfig:"REJECT_CONTRACT_ADDRESSES" default:"true"`
+	ScreeningFile           string `envconfig:"SCREENING_FILE" default:""`
+
+	// Admin API. ADMIN_TOKENS is a comma separated list of operator=token pairs, the API is
+	// not served without it. Active bridges past their deadline by STUCK_AFTER are stuck.
+	AdminPort   int           `envconfig:"ADMIN_PORT" default:"9090"`
+	AdminTokens string        `envconfig:"ADMIN_TOKENS" default:""`
+	StuckAfter  time.Duration `envconfig:"STUCK_AFTER" default:"15m"`
+
+	// Health checks. Dependencies are checked every HEALTH_CHECK_INTERVAL, and an RPC endpoint
+	// whose latest block is older than MAX_BLOCK_AGE is unhealthy.
+	HealthCheckInterval time.Duration `envconfig:"HEALTH_CHECK_INTERVAL" default:"15s"`
+	HealthCheckTimeout  time.Duration `envconfig:"HEALTH_CHECK_TIMEOUT" default:"5s"`
+	MaxBlockAge         time.Duration `envconfig:"MAX_BLOCK_AGE" default:"5m"`
+
+	// Tracing. TRACING_EXPORTER is none or otlp, OTLP sends the spans to OTLP_ENDPOINT over
+	// OTLP_PROTOCOL, grpc or http, which default to the OTEL_EXPORTER_OTLP_* variables.
+	TracingExporter    string  `envconfig:"TRACING_EXPORTER" default:"none"`
+	OTLPEndpoint       string  `envconfig:"OTLP_ENDPOINT" default:""`
+	OTLPProtocol       string  `envconfig:"OTLP_PROTOCOL" default:"grpc"`
+	OTLPInsecure       bool    `envconfig:"OTLP_INSECURE" default:"false"`
+	TracingSampleRatio float64 `envconfig:"TRACING_SAMPLE_RATIO" default:"1"`
 }
 
 type WebSocketClient struct {
@@ -151,6 +351,14 @@ type WebSocketClient struct {
 	acc     *ecdsa.PrivateKey
 	send    chan []byte
 	request BridgeRequest
+	// connID identifies the socket. Several sockets can share a session id.
+	connID string
+	// topics are the session and bridge ids the socket is subscribed to.
+	topics []string
+	// principal is who the socket authenticated as when it connected.
+	principal  *Principal
+	remoteIP   string
+	writeMutex sync.Mutex
 }
 
 // ExchangeServer holds the state of the exchange server.
@@ -158,13 +366,24 @@ type ExchangeServer struct {
 	ctx     context.Context
 	podName string
 
-	partyChain                           EthereumNode
-	octNode                              EthereumNode
+	partyChain                           *EthereumNode
+	octNode                              *EthereumNode
+	bscNode                              *EthereumNode
+	rpcCheckInterval                     time.Duration
+	gasPriceCeilings                     map[string]*big.Int
+	receiptPollInterval                  time.Duration
+	stuckTxAfter                         time.Duration
+	maxGasBumps                          int
 	gramsShimServerAddress               string
 	octaShimServerAddress                string
 	bscUSDTOnPartyChainShimServerAddress string
 	bscUSDTOnOctaSpaceShimServerAddress  string
 	shimCertLocation                     string
+	// hotWallet is the PRIVATE_KEY account. It signs direct settlements and pays the gas of
+	// token refunds.
+	hotWallet *ecdsa.PrivateKey
+	// settlers are the settlers of the supported routes, by route key.
+	settlers map[string]Settler
 
 	redisClient *redis.Client
 
@@ -172,11 +391,16 @@ type ExchangeServer struct {
 	warrenWG   *sync.WaitGroup
 
 	ceClient cloudevents.Client
-	logger   *zap.SugaredLogger
-	dev      bool
-	watch    bool
+	// ceSinkConfigured is set when K_SINK is, events are only emitted then.
+	ceSinkConfigured bool
+	ceReceiverPort   int
+	logger           *zap.SugaredLogger
+	dev              bool
+	watch            bool
 
 	wsClients map[string]*WebSocketClient
+	// subscriptions maps session ids and bridge transaction ids to the sockets following them.
+	subscriptions map[string]map[string]*WebSocketClient
 
 	minimumAmount int
 	fee           int
@@ -189,12 +413,53 @@ type ExchangeServer struct {
 	wBSCUSDTOnPartyChainContractAddress string
 	wBSCUSDTOnOctaSpaceContractAddress  string
 
-	wsClientsMutex sync.Mutex
-}
+	defaultPaymentWindow time.Duration
+	paymentWindows       map[string]time.Duration
+	topUpWindow          time.Duration
+	overpaymentPolicy    string
+	lateDepositPolicy    string
+	lateDepositGrace     time.Duration
+
+	webhookClient       *http.Client
+	webhookMaxAttempts  int
+	webhookRetryBackoff time.Duration
+
+	keys               *KeyStore
+	allowedOrigins     []string
+	trustedProxies     []*net.IPNet
+	trustedProxyHeader string
+	anonymousAccess    bool
+	anonymousScopes    []string
+	anonymousRateLimit int
+	apiKeyRateLimit    int
+	jwtSecret          []byte
+
+	connectionLimit          tokenBucket
+	quoteLimit               tokenBucket
+	bridgeLimit              tokenBucket
+	apiKeyLimitMultiplier    int
+	maxPendingPerAddress     int
+	maxPendingWatches        int
+	maxPendingWatchesByRoute map[string]int
+
+	rejectContractAddresses bool
+	// screener checks addresses before an escrow is issued for them, nil to skip screening.
+	screener Screener
+
+	adminPort int
+	// adminTokens are the admin API tokens by the operator they belong to.
+	adminTokens map[string]string
+	stuckAfter  time.Duration
+
+	health              healthState
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	maxBlockAge         time.Duration
+
+	// flushTraces sends the spans that have not been exported yet.
+	flushTraces func(context.Context) error
 
-type EthereumNode struct {
-	rpcClient    *ethclient.Client
-	rpcClientTwo *ethclient.Client
+	wsClientsMutex sync.Mutex
 }
 
 type AccountGenResponse struct {
@@ -216,7 +481,7 @@ type SellOrder struct {
 	// TXID reflects the Transaction ID of the SELL order to be created.
 	TXID string `json:"txid"`
 	// Locked tells us if this transaction is pending/proccessing another payment.
-	Locked bool `json:"locked" default:false`
+	Locked bool `json:"locked" default:"false"`
 	// SellerShippingAddress reflects the public key of the account the seller wants to receive on
 	SellerShippingAddress string `json:"sellerShippingAddress"`
 	// SellerNKNAddress reflects the  public NKN address of the seller.
@@ -341,4 +606,6 @@ type BridgeRequest struct {
 	BridgeTo        string   `json:"bridgeTo"`
 	ShippingAddress string   `json:"shippingAddress"`
 	TxId            string   `json:"TxId"`
+	// RefundAddress reflects the address on FromChain the deposit is returned to if the bridge fails.
+	RefundAddress string `json:"refundAddress,omitempty"`
 }
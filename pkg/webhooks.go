@@ -0,0 +1,593 @@
+package be
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// WebhookSignatureHeader carries "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+	WebhookSignatureHeader = "X-PartyBridge-Signature"
+	// WebhookDeliveryHeader carries the id of the delivery, which stays the same across retries.
+	WebhookDeliveryHeader = "X-PartyBridge-Delivery"
+
+	// webhookQueue is a sorted set of delivery ids scored by when they are due.
+	webhookQueue = "webhookqueue"
+	// maxWebhookBackoff caps the delay between two attempts of a delivery.
+	maxWebhookBackoff = time.Hour
+	// maxWebhookDeliveryLog is how many deliveries are kept in the log of a client.
+	maxWebhookDeliveryLog = 1000
+	// webhookWorkers limits how many deliveries a pod makes at once.
+	webhookWorkers = 8
+)
+
+// webhook delivery statuses.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// webhookEventTypes are the status types a webhook can subscribe to.
+var webhookEventTypes = []string{BridgeStatePending, "success", "error", BridgeStateRefunded, PaymentUnderpaid, PaymentOverpaid, PaymentLate, BridgeStateHeld, BridgeStateUnconfirmed, BridgeStateResolved}
+
+// Webhook is an endpoint an API client registered to be notified of the status changes of
+// its bridges. Events limits the status types it receives, all of them when empty.
+type Webhook struct {
+	ID          string    `json:"id"`
+	ClientID    string    `json:"clientID"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"secret,omitempty"`
+	Events      []string  `json:"events,omitempty"`
+	CreatedTime time.Time `json:"createdTime"`
+}
+
+// WebhookEvent is the body of a webhook delivery.
+type WebhookEvent struct {
+	ID            string     `json:"id"`
+	Type          string     `json:"type"`
+	TransactionID string     `json:"transactionID"`
+	Status        string     `json:"status"`
+	State         string     `json:"state,omitempty"`
+	Message       string     `json:"message"`
+	Seq           int64      `json:"seq,omitempty"`
+	Time          int64      `json:"time"`
+	Bridge        BridgeView `json:"bridge"`
+}
+
+// WebhookDelivery is an entry of the delivery log.
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	WebhookID      string          `json:"webhookID"`
+	ClientID       string          `json:"clientID"`
+	TransactionID  string          `json:"transactionID"`
+	URL            string          `json:"url"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"lastStatusCode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	NextAttempt    time.Time       `json:"nextAttempt,omitempty"`
+	CreatedTime    time.Time       `json:"createdTime"`
+	DeliveredTime  time.Time       `json:"deliveredTime,omitempty"`
+}
+
+// signWebhook returns the signature header of a delivery body sent at t.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookResolveTimeout bounds the lookup of the host of a webhook when it is registered.
+const webhookResolveTimeout = 5 * time.Second
+
+// isPublicIP reports whether ip may receive webhooks. Private, loopback, link-local and other
+// addresses that are not routed on the internet would let clients reach internal services.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which clusters use internally too.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// checkWebhookHost resolves host and refuses it if any of its addresses is not public.
+func checkWebhookHost(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("host %s can not be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("host %s resolves to %s, which is not a public address", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// newWebhookClient returns the client webhooks are delivered with. It only connects to public
+// addresses, checked when dialing so that a host resolving to another address since it was
+// registered is refused too, and does not follow redirects. internal allows any address, for
+// development.
+func newWebhookClient(timeout time.Duration, internal bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !internal {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("refusing to deliver a webhook to %s, which is not a public address", host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be dialed instead of the webhook, and connect to any address.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// the redirect response counts as a failed delivery.
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// createWebhook registers a webhook for clientID. The returned webhook includes its secret,
+// which is not shown again.
+func (e *ExchangeServer) createWebhook(clientID, endpoint string, events []string) (Webhook, *ProtocolError) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(e.dev && u.Scheme == "http")) {
+		return Webhook{}, protocolErrorf(ErrCodeInvalidMessage, "url", "url must be an absolute https url")
+	}
+	if !e.dev {
+		if err := checkWebhookHost(u.Hostname()); err != nil {
+			return Webhook{}, protocolErrorf(ErrCodeInvalidMessage, "url", "url %s", err.Error())
+		}
+	}
+
+	for _, event := range events {
+		if !containsString(webhookEventTypes, event) {
+			return Webhook{}, protocolErrorf(ErrCodeInvalidMessage, "events", "unknown event %q", event)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, protocolErrorf(ErrCodeInternal, "", "unable to generate a webhook secret")
+	}
+
+	wh := Webhook{
+		ID:          uuid.New().String(),
+		ClientID:    clientID,
+		URL:         u.String(),
+		Secret:      hex.EncodeToString(secret),
+		Events:      events,
+		CreatedTime: time.Now(),
+	}
+	data, err := json.Marshal(wh)
+	if err != nil {
+		return Webhook{}, protocolErrorf(ErrCodeInternal, "", "unable to store the webhook")
+	}
+	if err := e.redisClient.HSet(context.Background(), "webhooks:"+clientID, wh.ID, data).Err(); err != nil {
+		e.logger.Errorw("failed to store webhook", "client", clientID, "error", err)
+		return Webhook{}, protocolErrorf(ErrCodeInternal, "", "unable to store the webhook")
+	}
+	return wh, nil
+}
+
+// webhooksOf returns the webhooks registered by clientID.
+func (e *ExchangeServer) webhooksOf(clientID string) ([]Webhook, error) {
+	entries, err := e.redisClient.HGetAll(context.Background(), "webhooks:"+clientID).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	webhooks := make([]Webhook, 0, len(entries))
+	for _, entry := range entries {
+		var wh Webhook
+		if err := json.Unmarshal([]byte(entry), &wh); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, nil
+}
+
+// webhook returns a webhook of clientID, or nil if it does not exist.
+func (e *ExchangeServer) webhook(clientID, id string) (*Webhook, error) {
+	entry, err := e.redisClient.HGet(context.Background(), "webhooks:"+clientID, id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var wh Webhook
+	if err := json.Unmarshal([]byte(entry), &wh); err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
+
+// notifyWebhooks queues a delivery of a status event to every webhook of the client that
+// created the bridge.
+func (e *ExchangeServer) notifyWebhooks(awr AccountWatchRequest, statusMsg StatusMsg) {
+	if awr.ClientID == "" {
+		return
+	}
+	webhooks, err := e.webhooksOf(awr.ClientID)
+	if err != nil {
+		e.bridgeLogger(awr).Errorw("failed to retrieve webhooks", "client", awr.ClientID, "error", err)
+		return
+	}
+
+	for _, wh := range webhooks {
+		if len(wh.Events) > 0 && !containsString(wh.Events, statusMsg.Type) {
+			continue
+		}
+
+		delivery := WebhookDelivery{
+			ID:            uuid.New().String(),
+			WebhookID:     wh.ID,
+			ClientID:      wh.ClientID,
+			TransactionID: awr.TransactionID,
+			URL:           wh.URL,
+			Status:        WebhookDeliveryPending,
+			NextAttempt:   time.Now(),
+			CreatedTime:   time.Now(),
+		}
+		payload, err := json.Marshal(WebhookEvent{
+			ID:            delivery.ID,
+			Type:          "bridge." + statusMsg.Type,
+			TransactionID: awr.TransactionID,
+			Status:        statusMsg.Type,
+			State:         statusMsg.State,
+			Message:       statusMsg.Message,
+			Seq:           statusMsg.Seq,
+			Time:          statusMsg.Time,
+			Bridge:        bridgeView(awr),
+		})
+		if err != nil {
+			e.bridgeLogger(awr).Errorw("failed encode webhook event", "error", err)
+			continue
+		}
+		delivery.Payload = payload
+
+		if err := e.queueWebhookDelivery(delivery, true); err != nil {
+			e.bridgeLogger(awr).Errorw("failed to queue webhook delivery", "client", wh.ClientID, "error", err)
+		}
+	}
+}
+
+// queueWebhookDelivery stores a delivery and schedules its next attempt. New deliveries are
+// also added to the delivery log of their client.
+func (e *ExchangeServer) queueWebhookDelivery(delivery WebhookDelivery, isNew bool) error {
+	ctx := context.Background()
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	pipe := e.redisClient.TxPipeline()
+	pipe.Set(ctx, "webhookdeliveries:"+delivery.ID, data, bridgeEventTTL)
+	if isNew {
+		logKey := "webhookdeliveries:client:" + delivery.ClientID
+		pipe.LPush(ctx, logKey, delivery.ID)
+		pipe.LTrim(ctx, logKey, 0, maxWebhookDeliveryLog-1)
+		pipe.Expire(ctx, logKey, bridgeEventTTL)
+	}
+	if delivery.Status == WebhookDeliveryPending {
+		pipe.ZAdd(ctx, webhookQueue, redis.Z{Score: float64(delivery.NextAttempt.Unix()), Member: delivery.ID})
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// webhookDelivery returns a delivery from the log, or nil if it does not exist.
+func (e *ExchangeServer) webhookDelivery(id string) (*WebhookDelivery, error) {
+	data, err := e.redisClient.Get(context.Background(), "webhookdeliveries:"+id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var delivery WebhookDelivery
+	if err := json.Unmarshal([]byte(data), &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// webhookDeliveries returns the most recent deliveries of clientID, newest first.
+func (e *ExchangeServer) webhookDeliveries(clientID string, limit int64) ([]WebhookDelivery, error) {
+	ids, err := e.redisClient.LRange(context.Background(), "webhookdeliveries:client:"+clientID, 0, limit-1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	deliveries := make([]WebhookDelivery, 0, len(ids))
+	for _, id := range ids {
+		delivery, err := e.webhookDelivery(id)
+		if err != nil {
+			return nil, err
+		}
+		if delivery != nil {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+// runWebhookDeliveries makes the webhook deliveries that are due until ctx is done. Every
+// pod runs it; a delivery is claimed by removing it from the queue.
+func (e *ExchangeServer) runWebhookDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	sem := make(chan struct{}, webhookWorkers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids, err := e.redisClient.ZRangeByScore(ctx, webhookQueue, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(time.Now().Unix(), 10),
+			Count: webhookWorkers * 4,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				e.logger.Errorw("failed to retrieve due webhook deliveries", "error", err)
+			}
+			continue
+		}
+
+		for _, id := range ids {
+			claimed, err := e.redisClient.ZRem(ctx, webhookQueue, id).Result()
+			if err != nil || claimed == 0 {
+				continue
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(id string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				e.deliverWebhook(ctx, id)
+			}(id)
+		}
+	}
+}
+
+// deliverWebhook makes one attempt of a delivery and schedules a retry if it fails.
+func (e *ExchangeServer) deliverWebhook(ctx context.Context, id string) {
+	delivery, err := e.webhookDelivery(id)
+	if err != nil || delivery == nil {
+		e.logger.Errorw("failed to retrieve webhook delivery", "delivery", id, "error", err)
+		return
+	}
+
+	wh, err := e.webhook(delivery.ClientID, delivery.WebhookID)
+	if err != nil {
+		// try again later, the webhook may still exist.
+		e.logger.Errorw("failed to retrieve webhook", "delivery", id, "error", err)
+		delivery.NextAttempt = time.Now().Add(e.webhookRetryBackoff)
+		if err := e.queueWebhookDelivery(*delivery, false); err != nil {
+			e.logger.Errorw("failed to requeue webhook delivery", "delivery", id, "error", err)
+		}
+		return
+	}
+
+	delivery.Attempts++
+	if wh == nil {
+		delivery.Status = WebhookDeliveryFailed
+		delivery.LastError = "the webhook has been deleted"
+	} else {
+		delivery.LastStatusCode, err = e.postWebhook(ctx, wh, delivery)
+		switch {
+		case err == nil:
+			delivery.Status = WebhookDeliveryDelivered
+			delivery.DeliveredTime = time.Now()
+			delivery.LastError = ""
+		case delivery.Attempts >= e.webhookMaxAttempts:
+			delivery.Status = WebhookDeliveryFailed
+			delivery.LastError = err.Error()
+		default:
+			delivery.LastError = err.Error()
+			delivery.NextAttempt = time.Now().Add(webhookBackoff(e.webhookRetryBackoff, delivery.Attempts))
+		}
+	}
+
+	WebhookDeliveriesInc(delivery.Status)
+	e.logger.Infow("webhook delivery attempt", "delivery", id, "txid", delivery.TransactionID, "status", delivery.Status, "attempts", delivery.Attempts, "error", delivery.LastError)
+	if err := e.queueWebhookDelivery(*delivery, false); err != nil {
+		e.logger.Errorw("failed to store webhook delivery", "delivery", id, "error", err)
+	}
+}
+
+// postWebhook sends a delivery to its webhook. Any 2xx response counts as delivered.
+func (e *ExchangeServer) postWebhook(ctx context.Context, wh *Webhook, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(wh.Secret, time.Now(), delivery.Payload))
+
+	resp, err := e.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookBackoff doubles base for every failed attempt, up to maxWebhookBackoff.
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < maxWebhookBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxWebhookBackoff {
+		backoff = maxWebhookBackoff
+	}
+	return backoff
+}
+
+// redeliverWebhook queues a logged delivery of clientID again, with a fresh set of attempts.
+func (e *ExchangeServer) redeliverWebhook(clientID, id string) (*WebhookDelivery, *ProtocolError) {
+	delivery, err := e.webhookDelivery(id)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve webhook delivery", "delivery", id, "error", err)
+		return nil, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the delivery")
+	}
+	if delivery == nil || delivery.ClientID != clientID {
+		return nil, protocolErrorf(ErrCodeNotFound, "id", "delivery not found")
+	}
+
+	delivery.Status = WebhookDeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now()
+	if err := e.queueWebhookDelivery(*delivery, false); err != nil {
+		e.logger.Errorw("failed to queue webhook delivery", "delivery", id, "error", err)
+		return nil, protocolErrorf(ErrCodeInternal, "", "unable to queue the delivery")
+	}
+	return delivery, nil
+}
+
+type createWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+}
+
+// requireClientID returns the API client of a request and writes an error if it was not made
+// with an API key or token.
+func (e *ExchangeServer) requireClientID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	principal := principalFrom(r.Context())
+	if principal == nil || principal.ClientID == "" {
+		e.writeAPIError(w, protocolErrorf(ErrCodeUnauthorized, "", "webhooks require an api key or token"))
+		return "", false
+	}
+	return principal.ClientID, true
+}
+
+func (e *ExchangeServer) handleAPICreateWebhook(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := e.requireClientID(w, r)
+	if !ok {
+		return
+	}
+	var req createWebhookRequest
+	if perr := decodeAPIRequest(r, &req); perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	wh, perr := e.createWebhook(clientID, req.URL, req.Events)
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	e.writeJSON(w, http.StatusCreated, wh)
+}
+
+func (e *ExchangeServer) handleAPIListWebhooks(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := e.requireClientID(w, r)
+	if !ok {
+		return
+	}
+	webhooks, err := e.webhooksOf(clientID)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve webhooks", "client", clientID, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the webhooks"))
+		return
+	}
+	// the secret is only shown when the webhook is created.
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	e.writeJSON(w, http.StatusOK, webhooks)
+}
+
+func (e *ExchangeServer) handleAPIDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := e.requireClientID(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := e.redisClient.HDel(r.Context(), "webhooks:"+clientID, mux.Vars(r)["id"]).Result()
+	if err != nil {
+		e.logger.Errorw("failed to delete webhook", "client", clientID, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to delete the webhook"))
+		return
+	}
+	if deleted == 0 {
+		e.writeAPIError(w, protocolErrorf(ErrCodeNotFound, "id", "webhook not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *ExchangeServer) handleAPIListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := e.requireClientID(w, r)
+	if !ok {
+		return
+	}
+	limit := int64(100)
+	if l, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64); err == nil && l > 0 && l <= maxWebhookDeliveryLog {
+		limit = l
+	}
+	deliveries, err := e.webhookDeliveries(clientID, limit)
+	if err != nil {
+		e.logger.Errorw("failed to retrieve webhook deliveries", "client", clientID, "error", err)
+		e.writeAPIError(w, protocolErrorf(ErrCodeInternal, "", "unable to retrieve the deliveries"))
+		return
+	}
+	e.writeJSON(w, http.StatusOK, deliveries)
+}
+
+func (e *ExchangeServer) handleAPIRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := e.requireClientID(w, r)
+	if !ok {
+		return
+	}
+	delivery, perr := e.redeliverWebhook(clientID, mux.Vars(r)["id"])
+	if perr != nil {
+		e.writeAPIError(w, perr)
+		return
+	}
+	e.writeJSON(w, http.StatusAccepted, delivery)
+}
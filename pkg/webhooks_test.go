@@ -0,0 +1,63 @@
+package be
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCreateWebhookHosts(t *testing.T) {
+	e, _ := newTestServer(t)
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://1.1.1.1/hooks", false},
+		{"http://1.1.1.1/hooks", true},
+		{"https://127.0.0.1/hooks", true},
+		{"https://localhost/hooks", true},
+		{"https://10.1.2.3/hooks", true},
+		{"https://192.168.1.1/hooks", true},
+		{"https://169.254.169.254/latest/meta-data", true},
+		{"https://100.64.0.1/hooks", true},
+		{"https://[::1]/hooks", true},
+		{"https://[fd00::1]/hooks", true},
+		{"https://0.0.0.0/hooks", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			_, perr := e.createWebhook("acme", tt.url, []string{"success"})
+			if (perr != nil) != tt.wantErr {
+				t.Errorf("createWebhook(%q) error = %v, wantErr %v", tt.url, perr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	redirected := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal" {
+			redirected = true
+			return
+		}
+		http.Redirect(w, r, "/internal", http.StatusFound)
+	}))
+	defer server.Close()
+
+	// the test server listens on loopback, which webhooks are not delivered to.
+	if resp, err := newWebhookClient(time.Second, false).Post(server.URL, "application/json", nil); err == nil {
+		resp.Body.Close()
+		t.Fatal("delivered a webhook to a loopback address")
+	}
+
+	resp, err := newWebhookClient(time.Second, true).Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || redirected {
+		t.Errorf("got %d and redirected = %v, want the redirect not to be followed", resp.StatusCode, redirected)
+	}
+}